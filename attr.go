@@ -0,0 +1,127 @@
+package mega
+
+import (
+	"encoding/json"
+	"maps"
+	"strings"
+)
+
+// Colour labels of nodes
+const (
+	LABEL_NONE = iota
+	LABEL_RED
+	LABEL_ORANGE
+	LABEL_YELLOW
+	LABEL_GREEN
+	LABEL_BLUE
+	LABEL_PURPLE
+	LABEL_GREY
+)
+
+// FileAttr holds the attributes of a node, which are stored encrypted
+// with its key.
+//
+// The attributes this package knows about have fields, any others set
+// by other clients are kept as they are so changing the attributes
+// doesn't lose them.
+type FileAttr struct {
+	// Name is the name of the node, "n"
+	Name string
+	// Fingerprint is the fingerprint of a file, "c", see Fingerprint
+	Fingerprint string
+	// Label is the colour label, "lbl", one of the LABEL_ constants
+	Label int
+	// Favourite is set for favourites, "fav"
+	Favourite bool
+	// Description is the description, "des"
+	Description string
+	// Tags are the tags, "t"
+	Tags []string
+
+	// extra has the attributes without fields and those which
+	// couldn't be decoded
+	extra map[string]json.RawMessage
+}
+
+// Extra returns the attributes which aren't in the fields by their
+// keys, as JSON
+func (a *FileAttr) Extra() map[string]json.RawMessage {
+	return maps.Clone(a.extra)
+}
+
+// clone returns a copy of a which doesn't share anything with it
+func (a FileAttr) clone() FileAttr {
+	a.Tags = append([]string(nil), a.Tags...)
+	a.extra = maps.Clone(a.extra)
+	return a
+}
+
+// MarshalJSON implements json.Marshaler, writing the fields which are
+// set along with the extra attributes
+func (a FileAttr) MarshalJSON() ([]byte, error) {
+	m := make(map[string]any, len(a.extra)+6)
+	for key, value := range a.extra {
+		m[key] = value
+	}
+	m["n"] = a.Name
+	if a.Fingerprint != "" {
+		m["c"] = a.Fingerprint
+	}
+	if a.Label != LABEL_NONE {
+		m["lbl"] = a.Label
+	}
+	if a.Favourite {
+		m["fav"] = 1
+	}
+	if a.Description != "" {
+		m["des"] = a.Description
+	}
+	if len(a.Tags) > 0 {
+		// the tags are stored separated by commas
+		m["t"] = strings.Join(a.Tags, ",")
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (a *FileAttr) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	*a = FileAttr{}
+	for key, value := range raw {
+		known := true
+		switch key {
+		case "n":
+			err = json.Unmarshal(value, &a.Name)
+		case "c":
+			err = json.Unmarshal(value, &a.Fingerprint)
+		case "lbl":
+			err = json.Unmarshal(value, &a.Label)
+		case "fav":
+			var fav int
+			err = json.Unmarshal(value, &fav)
+			a.Favourite = fav != 0
+		case "des":
+			err = json.Unmarshal(value, &a.Description)
+		case "t":
+			var tags string
+			err = json.Unmarshal(value, &tags)
+			if tags != "" {
+				a.Tags = strings.Split(tags, ",")
+			}
+		default:
+			known = false
+		}
+		// keep what can't be decoded so it is written back as it was
+		if !known || err != nil {
+			if a.extra == nil {
+				a.extra = make(map[string]json.RawMessage)
+			}
+			a.extra[key] = value
+		}
+	}
+	return nil
+}
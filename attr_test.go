@@ -0,0 +1,73 @@
+package mega
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFileAttrJSON(t *testing.T) {
+	in := `{"n":"a.txt","c":"fp","lbl":3,"fav":1,"des":"notes","t":"x,y","e":{"s":"v"},"lbl2":[1,2]}`
+	var attr FileAttr
+	if err := json.Unmarshal([]byte(in), &attr); err != nil {
+		t.Fatal(err)
+	}
+	if attr.Name != "a.txt" || attr.Fingerprint != "fp" || attr.Label != LABEL_YELLOW || !attr.Favourite ||
+		attr.Description != "notes" || !reflect.DeepEqual(attr.Tags, []string{"x", "y"}) {
+		t.Errorf("Wrong fields %+v", attr)
+	}
+	extra := attr.Extra()
+	if len(extra) != 2 || string(extra["e"]) != `{"s":"v"}` || string(extra["lbl2"]) != `[1,2]` {
+		t.Errorf("Wrong extra %v", extra)
+	}
+
+	// it round trips
+	out, err := json.Marshal(attr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, got map[string]any
+	_ = json.Unmarshal([]byte(in), &want)
+	_ = json.Unmarshal(out, &got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %s, want %s", out, in)
+	}
+
+	// unset fields are left out and bad ones kept as they were
+	attr = FileAttr{}
+	if err := json.Unmarshal([]byte(`{"n":"b","lbl":"red","fav":0}`), &attr); err != nil {
+		t.Fatal(err)
+	}
+	out, _ = json.Marshal(attr)
+	if string(out) != `{"lbl":"red","n":"b"}` {
+		t.Errorf("Got %s", out)
+	}
+
+	// clones don't share
+	attr.Tags = []string{"a"}
+	c := attr.clone()
+	c.Tags[0] = "b"
+	c.extra["lbl"] = json.RawMessage(`1`)
+	if attr.Tags[0] != "a" || string(attr.extra["lbl"]) != `"red"` {
+		t.Error("Clone shares with the original")
+	}
+}
+
+func TestEncryptDecryptAttr(t *testing.T) {
+	key := randomBytes(t, 16)
+	var attr FileAttr
+	if err := json.Unmarshal([]byte(`{"n":"name","x":{"y":"z"}}`), &attr); err != nil {
+		t.Fatal(err)
+	}
+	data, err := encryptAttr(key, attr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decryptAttr(key, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, attr) {
+		t.Errorf("Got %+v, want %+v", got, attr)
+	}
+}
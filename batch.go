@@ -0,0 +1,528 @@
+package mega
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+)
+
+// Maximum number of commands sent in a single API request by a Batch
+const maxBatchCommands = 500
+
+// Batch queues API commands so they can be sent to the server in a
+// single request.
+//
+// Each queueing method returns a *BatchResult which is filled in by
+// Exec. The server runs the commands in order but each one succeeds
+// or fails on its own, so a command can't depend on the result of an
+// earlier command in the same batch.
+type Batch struct {
+	m    *Mega
+	cmds []*batchCmd
+}
+
+// BatchResult holds the outcome of a single command in a Batch
+type BatchResult struct {
+	// Err is the error returned for this command, nil on success
+	Err error
+	// Node is the node made by CreateDir
+	Node *Node
+	// Link is the public link made by Link
+	Link string
+}
+
+// batchCmd is a queued command
+type batchCmd struct {
+	cmd    string
+	msg    any
+	apply  func(result json.RawMessage) error // called with FS.mutex held
+	result *BatchResult
+}
+
+// NewBatch returns an empty Batch of commands for m
+func (m *Mega) NewBatch() *Batch {
+	return &Batch{m: m}
+}
+
+// Len returns the number of commands queued
+func (b *Batch) Len() int {
+	return len(b.cmds)
+}
+
+// queue adds a command to the batch
+func (b *Batch) queue(cmd string, msg any, apply func(json.RawMessage) error) *BatchResult {
+	r := &BatchResult{}
+	b.cmds = append(b.cmds, &batchCmd{cmd: cmd, msg: msg, apply: apply, result: r})
+	return r
+}
+
+// failed returns a result which is already failed with err
+func failed(err error) *BatchResult {
+	return &BatchResult{Err: err}
+}
+
+// Move queues moving src into parent
+func (b *Batch) Move(src *Node, parent *Node) *BatchResult {
+	m := b.m
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+
+	if src == nil || parent == nil {
+		return failed(EARGS)
+	}
+	var msg MoveFileMsg
+	var err error
+
+	msg.Cmd = "m"
+	msg.N = src.hash
+	msg.T = parent.hash
+	msg.I, err = randString(10)
+	if err != nil {
+		return failed(err)
+	}
+
+	return b.queue(msg.Cmd, msg, func(json.RawMessage) error {
+		if src.parent != nil {
+			src.parent.removeChild(src)
+		}
+		parent.addChild(src)
+		src.parent = parent
+		return nil
+	})
+}
+
+// Rename queues renaming src to name, keeping its other attributes
+func (b *Batch) Rename(src *Node, name string) *BatchResult {
+	m := b.m
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+
+	if src == nil {
+		return failed(EARGS)
+	}
+	attr := src.attr.clone()
+	attr.Name = name
+	return b.setAttr(src, attr)
+}
+
+// SetAttr queues replacing the attributes of src with attr. Get attr
+// from GetAttr so the attributes which aren't being changed are kept.
+func (b *Batch) SetAttr(src *Node, attr FileAttr) *BatchResult {
+	m := b.m
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+
+	if src == nil {
+		return failed(EARGS)
+	}
+	return b.setAttr(src, attr.clone())
+}
+
+// setAttr queues setting the attributes of src to attr
+//
+// Call with m.FS.mutex held
+func (b *Batch) setAttr(src *Node, attr FileAttr) *BatchResult {
+	m := b.m
+	var msg FileAttrMsg
+
+	master_aes, err := aes.NewCipher(m.k)
+	if err != nil {
+		return failed(err)
+	}
+	attr_data, err := encryptAttr(src.meta.key, attr)
+	if err != nil {
+		return failed(err)
+	}
+	key := make([]byte, len(src.meta.compkey))
+	err = blockEncrypt(master_aes, key, src.meta.compkey)
+	if err != nil {
+		return failed(err)
+	}
+
+	msg.Cmd = "a"
+	msg.Attr = attr_data
+	msg.Key = base64urlencode(key)
+	msg.N = src.hash
+	msg.I, err = randString(10)
+	if err != nil {
+		return failed(err)
+	}
+
+	return b.queue(msg.Cmd, msg, func(json.RawMessage) error {
+		m.FS.setAttr(src, attr)
+		return nil
+	})
+}
+
+// Delete queues deleting node. If destroy is false the node is moved
+// to the trash instead.
+func (b *Batch) Delete(node *Node, destroy bool) *BatchResult {
+	if node == nil {
+		return failed(EARGS)
+	}
+	if !destroy {
+		return b.Move(node, b.m.FS.GetTrash())
+	}
+
+	m := b.m
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+
+	var msg FileDeleteMsg
+	var err error
+	msg.Cmd = "d"
+	msg.N = node.hash
+	msg.I, err = randString(10)
+	if err != nil {
+		return failed(err)
+	}
+
+	return b.queue(msg.Cmd, msg, func(json.RawMessage) error {
+		if node.parent != nil {
+			node.parent.removeChild(node)
+		}
+		delete(m.FS.lookup, node.hash)
+		m.FS.unindex(node)
+		return nil
+	})
+}
+
+// CreateDir queues making a directory called name in parent. The new
+// node is returned in the Node field of the result.
+func (b *Batch) CreateDir(name string, parent *Node) *BatchResult {
+	m := b.m
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+
+	if parent == nil {
+		return failed(EARGS)
+	}
+	var msg UploadCompleteMsg
+
+	compkey := []uint32{0, 0, 0, 0, 0, 0}
+	for i := range compkey {
+		compkey[i] = uint32(mrand.Int31())
+	}
+
+	master_aes, err := aes.NewCipher(m.k)
+	if err != nil {
+		return failed(err)
+	}
+	attr := FileAttr{Name: name}
+	ukey, err := a32_to_bytes(compkey[:4])
+	if err != nil {
+		return failed(err)
+	}
+	attr_data, err := encryptAttr(ukey, attr)
+	if err != nil {
+		return failed(err)
+	}
+	key := make([]byte, len(ukey))
+	err = blockEncrypt(master_aes, key, ukey)
+	if err != nil {
+		return failed(err)
+	}
+
+	msg.Cmd = "p"
+	msg.T = parent.hash
+	msg.N[0].H = "xxxxxxxx"
+	msg.N[0].T = FOLDER
+	msg.N[0].A = attr_data
+	msg.N[0].K = base64urlencode(key)
+	msg.I, err = randString(10)
+	if err != nil {
+		return failed(err)
+	}
+	return b.queuePut(msg)
+}
+
+// Copy queues copying the file src into parent as name, or with the
+// name of src if name is empty. The server makes the copy so the
+// contents aren't transferred. The new node is returned in the Node
+// field of the result.
+func (b *Batch) Copy(src *Node, parent *Node, name string) *BatchResult {
+	m := b.m
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+
+	if src == nil || parent == nil || src.ntype != FILE {
+		return failed(EARGS)
+	}
+	if name == "" {
+		name = src.name
+	}
+	var msg UploadCompleteMsg
+
+	master_aes, err := aes.NewCipher(m.k)
+	if err != nil {
+		return failed(err)
+	}
+	// the copy shares the key and attributes of src
+	attr := src.attr.clone()
+	attr.Name = name
+	attr_data, err := encryptAttr(src.meta.key, attr)
+	if err != nil {
+		return failed(err)
+	}
+	key := make([]byte, len(src.meta.compkey))
+	err = blockEncrypt(master_aes, key, src.meta.compkey)
+	if err != nil {
+		return failed(err)
+	}
+
+	msg.Cmd = "p"
+	msg.T = parent.hash
+	msg.N[0].H = src.hash
+	msg.N[0].T = FILE
+	msg.N[0].A = attr_data
+	msg.N[0].K = base64urlencode(key)
+	msg.I, err = randString(10)
+	if err != nil {
+		return failed(err)
+	}
+	return b.queuePut(msg)
+}
+
+// queuePut queues the "p" command msg which makes a node, setting the
+// Node field of the result to it
+func (b *Batch) queuePut(msg UploadCompleteMsg) *BatchResult {
+	m := b.m
+	var r *BatchResult
+	r = b.queue(msg.Cmd, msg, func(result json.RawMessage) error {
+		var res UploadCompleteResp
+		err := json.Unmarshal(result, &res)
+		if err != nil {
+			return err
+		}
+		if len(res.F) == 0 {
+			return EBADRESP
+		}
+		r.Node, err = m.addFSNode(res.F[0])
+		return err
+	})
+	return r
+}
+
+// Link queues exporting a public link for n, with or without the
+// decryption key included. The link is returned in the Link field of
+// the result.
+//
+// Folders are shared first, as MEGA clients do, and the key in their
+// links is the share key. A folder which is shared already keeps its
+// share key. Nodes added to the folder afterwards can't be read through
+// the link until it is made again.
+func (b *Batch) Link(n *Node, includeKey bool) *BatchResult {
+	m := b.m
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+
+	if n == nil {
+		return failed(EARGS)
+	}
+	var msg GetLinkMsg
+
+	msg.Cmd = "l"
+	msg.N = n.hash
+
+	// folder links are marked with an F
+	kind := "!"
+	key := n.meta.compkey
+	var share *BatchResult
+	if n.ntype == FOLDER {
+		var err error
+		kind = "F!"
+		key, share, err = b.share(n)
+		if err != nil {
+			return failed(err)
+		}
+	}
+
+	var r *BatchResult
+	r = b.queue(msg.Cmd, msg, func(result json.RawMessage) error {
+		if share != nil && share.Err != nil {
+			return share.Err
+		}
+		var id string
+		err := json.Unmarshal(result, &id)
+		if err != nil {
+			return err
+		}
+		if includeKey {
+			r.Link = fmt.Sprintf("%v/#%v%v!%v", BASE_DOWNLOAD_URL, kind, id, base64urlencode(key))
+		} else {
+			r.Link = fmt.Sprintf("%v/#%v%v", BASE_DOWNLOAD_URL, kind, id)
+		}
+		return nil
+	})
+	return r
+}
+
+// share queues sharing the folder n for export, returning its share
+// key. The keys of n and the nodes in it are sent encrypted with the
+// share key so they can be read through the share.
+//
+// Call with m.FS.mutex held
+func (b *Batch) share(n *Node) ([]byte, *BatchResult, error) {
+	m := b.m
+	master_aes, err := aes.NewCipher(m.k)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sk := make([]byte, 16)
+	if ok, found := m.FS.skmap[n.hash]; found {
+		sk, err = base64urldecode(ok)
+		if err == nil {
+			err = blockDecrypt(master_aes, sk, sk)
+		}
+	} else {
+		_, err = rand.Read(sk)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	ok := make([]byte, len(sk))
+	err = blockEncrypt(master_aes, ok, sk)
+	if err != nil {
+		return nil, nil, err
+	}
+	ha := make([]byte, 2*len(n.hash))
+	err = blockEncrypt(master_aes, ha, []byte(n.hash+n.hash))
+	if err != nil {
+		return nil, nil, err
+	}
+	sk_aes, err := aes.NewCipher(sk)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var handles, keys []any
+	var add func(c *Node) error
+	add = func(c *Node) error {
+		key := make([]byte, len(c.meta.compkey))
+		err := blockEncrypt(sk_aes, key, c.meta.compkey)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, 0, len(handles), base64urlencode(key))
+		handles = append(handles, c.hash)
+		for _, child := range c.children {
+			err = add(child)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = add(n)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var msg ShareMsg
+	msg.Cmd = "s2"
+	msg.N = n.hash
+	msg.S = []ShareUser{{U: "EXP", R: 0}}
+	msg.Ok = base64urlencode(ok)
+	msg.Ha = base64urlencode(ha)
+	msg.Cr = [3][]any{{n.hash}, handles, keys}
+	msg.I, err = randString(10)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := b.queue(msg.Cmd, msg, func(json.RawMessage) error {
+		m.FS.skmap[n.hash] = msg.Ok
+		return nil
+	})
+	return sk, r, nil
+}
+
+// Exec sends the queued commands to the server and fills in their
+// results. The batch is empty afterwards and can be reused.
+//
+// The error returned is for the batch as a whole, eg a network
+// failure, in which case all the unsent commands have it as their
+// result too. Check the Err of each BatchResult for the outcome of
+// the individual commands.
+func (b *Batch) Exec() error {
+	return b.ExecContext(context.Background())
+}
+
+// ExecContext is like Exec but with a context
+func (b *Batch) ExecContext(ctx context.Context) error {
+	cmds := b.cmds
+	b.cmds = nil
+	for len(cmds) > 0 {
+		n := min(len(cmds), maxBatchCommands)
+		err := b.m.batchRequest(ctx, cmds[:n])
+		if err != nil {
+			for _, c := range cmds {
+				c.result.Err = err
+			}
+			return err
+		}
+		cmds = cmds[n:]
+	}
+	return nil
+}
+
+// execOne runs the batch and returns the error for r
+func (b *Batch) execOne(ctx context.Context, r *BatchResult) error {
+	err := b.ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	return r.Err
+}
+
+// batchRequest sends cmds in a single API request and applies the
+// results
+func (m *Mega) batchRequest(ctx context.Context, cmds []*batchCmd) error {
+	msgs := make([]any, len(cmds))
+	for i, c := range cmds {
+		msgs[i] = c.msg
+	}
+	req, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+	result, err := m.api_request(ctx, req)
+	// An error with an array response is the error for a command
+	// rather than for the request as a whole
+	if err != nil && !bytes.HasPrefix(result, []byte("[")) {
+		return err
+	}
+
+	var results []json.RawMessage
+	err = json.Unmarshal(result, &results)
+	if err != nil {
+		return err
+	}
+	if len(results) != len(cmds) {
+		return EBADRESP
+	}
+
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+	for i, c := range cmds {
+		c.result.Err = c.done(results[i])
+	}
+	return nil
+}
+
+// done processes the result for the command
+//
+// Call with m.FS.mutex held
+func (c *batchCmd) done(result json.RawMessage) error {
+	var errno ErrorMsg
+	if json.Unmarshal(result, &errno) == nil && errno != 0 {
+		merr := newAPIError(errno)
+		merr.Cmd = c.cmd
+		return merr
+	}
+	return c.apply(result)
+}
@@ -3,6 +3,8 @@ package mega
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 )
 
 var (
@@ -42,6 +44,15 @@ var (
 
 	// Config errors
 	EWORKER_LIMIT_EXCEEDED = errors.New("Maximum worker limit exceeded")
+
+	// Upload errors
+	ESPOOL_LIMIT_EXCEEDED = errors.New("Upload of unknown size is larger than the spool limit")
+
+	// Transfer errors
+	ETRANSFER_CANCELLED = errors.New("Transfer cancelled")
+
+	// Link errors
+	EBADLINK = errors.New("Bad public link")
 )
 
 type ErrorMsg int
@@ -104,3 +115,102 @@ func parseError(errno ErrorMsg) error {
 		return fmt.Errorf("Unknown mega error %d", errno)
 	}
 }
+
+// MegaError is returned for failed API commands and chunk transfers.
+// It records where the failure happened and whether it is likely to
+// go away if the operation is retried.
+//
+// The underlying error is one of the errors above for API failures
+// so it can be checked with errors.Is, eg errors.Is(err, EOVERQUOTA).
+type MegaError struct {
+	// Code is the API error code, 0 if the server didn't return one
+	Code ErrorMsg
+	// Cmd is the API command(s) which failed, eg "us" or "m"
+	Cmd string
+	// URL is the chunk URL for transfer errors
+	URL string
+	// Status is the HTTP status code, 0 if no response was received
+	Status int
+	// Attempts is the number of attempts made
+	Attempts int
+	// Retryable is set if the failure is transient
+	Retryable bool
+	// Err is the underlying error
+	Err error
+}
+
+// Error returns the error message
+func (e *MegaError) Error() string {
+	var b strings.Builder
+	switch {
+	case e.Cmd != "":
+		fmt.Fprintf(&b, "api command %q: ", e.Cmd)
+	case e.URL != "":
+		fmt.Fprintf(&b, "transfer %q: ", e.URL)
+	}
+	b.WriteString(e.Err.Error())
+	if e.Attempts > 1 {
+		fmt.Fprintf(&b, " (after %d attempts)", e.Attempts)
+	}
+	return b.String()
+}
+
+// Unwrap returns the underlying error
+func (e *MegaError) Unwrap() error {
+	return e.Err
+}
+
+// retryableCode returns true if the API error code is transient
+func retryableCode(errno ErrorMsg) bool {
+	switch errno {
+	case -3, -4, -18, -19: // EAGAIN, ERATELIMIT, ETEMPUNAVAIL, ETOOMANYCONNECTIONS
+		return true
+	}
+	return false
+}
+
+// retryableStatus returns true if the HTTP status code is transient
+func retryableStatus(status int) bool {
+	switch {
+	case status == http.StatusPaymentRequired: // hashcash challenge
+		return true
+	case status == http.StatusRequestTimeout, status == http.StatusTooManyRequests:
+		return true
+	case status >= 500: // including 509 bandwidth limit exceeded
+		return true
+	}
+	return false
+}
+
+// newAPIError makes the error for an API error code
+func newAPIError(errno ErrorMsg) *MegaError {
+	return &MegaError{
+		Code:      errno,
+		Err:       parseError(errno),
+		Retryable: retryableCode(errno),
+	}
+}
+
+// newHTTPError makes the error for a response with an unexpected
+// HTTP status
+func newHTTPError(resp *http.Response) *MegaError {
+	return &MegaError{
+		Status:    resp.StatusCode,
+		Err:       errors.New("Http Status: " + resp.Status),
+		Retryable: retryableStatus(resp.StatusCode),
+	}
+}
+
+// newTransferError makes the error for a failed attempt at the chunk
+// transfer url from either the response or the error returned by the
+// HTTP client.
+func newTransferError(url string, resp *http.Response, err error) *MegaError {
+	var merr *MegaError
+	if resp != nil {
+		merr = newHTTPError(resp)
+	} else {
+		merr = &MegaError{Err: err, Retryable: true}
+	}
+	merr.URL = url
+	return merr
+}
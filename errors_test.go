@@ -0,0 +1,46 @@
+package mega
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMegaErrorIs(t *testing.T) {
+	for _, test := range []struct {
+		errno     ErrorMsg
+		want      error
+		retryable bool
+	}{
+		{-3, EAGAIN, true},
+		{-4, ERATELIMIT, true},
+		{-6, ETOOMANY, false},
+		{-9, ENOENT, false},
+		{-15, ESID, false},
+		{-17, EOVERQUOTA, false},
+		{-18, ETEMPUNAVAIL, true},
+		{-19, ETOOMANYCONNECTIONS, true},
+	} {
+		merr := newAPIError(test.errno)
+		merr.Cmd = "f"
+		var err error = merr
+		if !errors.Is(err, test.want) {
+			t.Errorf("%d: errors.Is(%v, %v) = false", test.errno, err, test.want)
+		}
+		if merr.Retryable != test.retryable {
+			t.Errorf("%d: want retryable %v, got %v", test.errno, test.retryable, merr.Retryable)
+		}
+	}
+}
+
+func TestMegaErrorString(t *testing.T) {
+	merr := &MegaError{Cmd: "us", Err: ENOENT, Attempts: 3}
+	want := `api command "us": Object (typically, node or user) not found (after 3 attempts)`
+	if got := merr.Error(); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	merr = &MegaError{URL: "http://example.com/dl", Err: EREAD, Attempts: 1}
+	want = `transfer "http://example.com/dl": File could not be read from (or changed unexpectedly during reading)`
+	if got := merr.Error(); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
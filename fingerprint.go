@@ -0,0 +1,118 @@
+package mega
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// The fingerprint is made of four CRC32s of the contents, stored big
+// endian, followed by the modification time, as the MEGA SDK and web
+// client compute it.
+const (
+	// files up to this size have their CRCs computed over all of them
+	fingerprintFull = 8192
+	// larger files have CRCs of this many samples of fingerprintBlock
+	// bytes each spread evenly through them
+	fingerprintBlock   = 64
+	fingerprintSamples = fingerprintFull / (fingerprintBlock * 4)
+)
+
+// Fingerprint returns the MEGA fingerprint of size bytes read from r
+// with the modification time mtime. It is stored in the "c" attribute
+// of files and identifies files with the same contents without
+// reading all of them.
+func Fingerprint(r io.ReaderAt, size int64, mtime time.Time) (string, error) {
+	var crcs [16]byte
+	switch {
+	case size <= int64(len(crcs)):
+		// tiny files are their own fingerprint
+		if _, err := readFullAt(r, crcs[:size], 0); err != nil {
+			return "", err
+		}
+	case size <= fingerprintFull:
+		buf := make([]byte, size)
+		if _, err := readFullAt(r, buf, 0); err != nil {
+			return "", err
+		}
+		for i := int64(0); i < 4; i++ {
+			part := buf[i*size/4 : (i+1)*size/4]
+			binary.BigEndian.PutUint32(crcs[i*4:], crc32.ChecksumIEEE(part))
+		}
+	default:
+		block := make([]byte, fingerprintBlock)
+		for i := int64(0); i < 4; i++ {
+			var crc uint32
+			for j := int64(0); j < fingerprintSamples; j++ {
+				off := (size - fingerprintBlock) * (i*fingerprintSamples + j) / (4*fingerprintSamples - 1)
+				if _, err := readFullAt(r, block, off); err != nil {
+					return "", err
+				}
+				crc = crc32.Update(crc, crc32.IEEETable, block)
+			}
+			binary.BigEndian.PutUint32(crcs[i*4:], crc)
+		}
+	}
+
+	// the time in seconds is appended as a count of bytes followed by
+	// that many little endian bytes
+	buf := append([]byte(nil), crcs[:]...)
+	t := uint64(max(mtime.Unix(), 0))
+	var tb []byte
+	for ; t != 0; t >>= 8 {
+		tb = append(tb, byte(t))
+	}
+	buf = append(buf, byte(len(tb)))
+	buf = append(buf, tb...)
+	return base64urlencode(buf), nil
+}
+
+// readFullAt reads len(buf) bytes at off from r
+func readFullAt(r io.ReaderAt, buf []byte, off int64) (int, error) {
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) {
+		return n, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// fingerprintFile returns the fingerprint of size bytes read from r
+// with the modification time mtime, along with a file already in the
+// Cloud Drive with the same contents to copy instead of uploading r, if
+// deduplication is on and there is one
+func (m *Mega) fingerprintFile(r io.ReaderAt, size int64, mtime time.Time) (fp string, src *Node, err error) {
+	fp, err = Fingerprint(r, size, mtime)
+	if err != nil {
+		return "", nil, err
+	}
+	if m.dedup {
+		src = m.FS.dedupSource(fp, size)
+	}
+	return fp, src, nil
+}
+
+// dedupSource returns a file in the Cloud Drive with the fingerprint fp
+// and size bytes long, or nil if there is none. Files in the Trash, the
+// Inbox and shares from other users aren't used.
+func (fs *MegaFS) dedupSource(fp string, size int64) *Node {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	for _, n := range fs.fingerprints[fp] {
+		if n.size != size {
+			continue
+		}
+		p := n.parent
+		for p != nil && p != fs.root {
+			p = p.parent
+		}
+		if p != nil {
+			return n
+		}
+	}
+	return nil
+}
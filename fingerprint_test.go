@@ -0,0 +1,98 @@
+package mega
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"testing"
+	"time"
+)
+
+// fingerprintParts decodes a fingerprint into its CRCs and time
+func fingerprintParts(t *testing.T, fp string) ([]byte, []byte) {
+	b, err := base64urldecode(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 17 || len(b) != 17+int(b[16]) {
+		t.Fatalf("Bad fingerprint %x", b)
+	}
+	return b[:16], b[17:]
+}
+
+func TestFingerprint(t *testing.T) {
+	mtime := time.Unix(0x01020304, 0)
+	fingerprint := func(data []byte, mtime time.Time) string {
+		fp, err := Fingerprint(bytes.NewReader(data), int64(len(data)), mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fp
+	}
+
+	// tiny files are copied into the CRCs
+	crcs, tm := fingerprintParts(t, fingerprint([]byte("hello"), mtime))
+	if !bytes.Equal(crcs, append([]byte("hello"), make([]byte, 11)...)) {
+		t.Errorf("Wrong CRCs for tiny file %x", crcs)
+	}
+	if !bytes.Equal(tm, []byte{4, 3, 2, 1}) {
+		t.Errorf("Wrong time %x", tm)
+	}
+	if _, tm := fingerprintParts(t, fingerprint(nil, time.Unix(0, 0))); len(tm) != 0 {
+		t.Errorf("Expected no time bytes, got %x", tm)
+	}
+
+	// small files have CRCs of each quarter
+	data := randomBytes(t, 1001)
+	crcs, _ = fingerprintParts(t, fingerprint(data, mtime))
+	for i, q := range [][]byte{data[:250], data[250:500], data[500:750], data[750:]} {
+		if got, want := binary.BigEndian.Uint32(crcs[i*4:]), crc32.ChecksumIEEE(q); got != want {
+			t.Errorf("quarter %d: got CRC %08x, want %08x", i, got, want)
+		}
+	}
+
+	// large files are sampled, the first and last bytes always
+	data = randomBytes(t, 3*1024*1024+7)
+	fp := fingerprint(data, mtime)
+	if fp != fingerprint(data, mtime) {
+		t.Error("Fingerprint not repeatable")
+	}
+	if fp == fingerprint(data, mtime.Add(time.Second)) {
+		t.Error("Fingerprint doesn't depend on time")
+	}
+	for _, off := range []int{0, len(data) - 1} {
+		data[off] ^= 1
+		if fingerprint(data, mtime) == fp {
+			t.Errorf("Changing byte %d didn't change the fingerprint", off)
+		}
+		data[off] ^= 1
+	}
+
+	// known answers for data of each kind, worked out independently
+	// following the SDK
+	mtime = time.Unix(1700000000, 0)
+	for _, test := range []struct {
+		size int
+		want string
+	}{
+		{5, "ByZFZIMAAAAAAAAAAAAAAAQA8VNl"},
+		{1000, "hW2n_1eRbEJ_aU_f_OtSWAQA8VNl"},
+		{100000, "1olFIEX22mXdfvEZWwi7LwQA8VNl"},
+	} {
+		data := make([]byte, test.size)
+		for i := range data {
+			data[i] = byte(i*31 + 7)
+		}
+		if got := fingerprint(data, mtime); got != test.want {
+			t.Errorf("size %d: got %s, want %s", test.size, got, test.want)
+		}
+	}
+
+	// short data is an error
+	_, err := Fingerprint(bytes.NewReader(data[:100]), int64(len(data)), mtime)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package mega
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PublicFolder returns a read-only filesystem of the folder a public
+// link is for, which must include the key. This doesn't need a login.
+//
+// The root of the filesystem is the folder. Use PathLookup and
+// GetChildren to find the files in it, which can be downloaded or
+// opened with m like any other. The filesystem isn't kept up to date
+// with changes to the folder and can't be changed.
+func (m *Mega) PublicFolder(link string) (*MegaFS, error) {
+	return m.PublicFolderContext(context.Background(), link)
+}
+
+// PublicFolderContext is like PublicFolder but with a context
+func (m *Mega) PublicFolderContext(ctx context.Context, link string) (*MegaFS, error) {
+	l, err := ParseLink(link)
+	if err != nil {
+		return nil, err
+	}
+	if !l.Folder || l.Key == nil {
+		return nil, fmt.Errorf("%q isn't a link to a folder with its key: %w", link, EBADLINK)
+	}
+	block, err := aes.NewCipher(l.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg [1]FilesMsg
+	var res [1]FilesResp
+
+	msg[0].Cmd = "f"
+	msg[0].C = 1
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.folderAPIRequest(ctx, l.Handle, req)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(result, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := newMegaFS()
+	fs.folder = l.Handle
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// the keys are encrypted with the share key of the folder, which
+	// is the node without a parent in the folder
+	hashes := make(map[string]bool, len(res[0].F))
+	for _, itm := range res[0].F {
+		hashes[itm.Hash] = true
+	}
+	var share string
+	for _, itm := range res[0].F {
+		if !hashes[itm.Parent] {
+			share = itm.Hash
+			break
+		}
+	}
+
+	// add all the nodes then link them as they may come in any order
+	items := make(map[*Node]FSNode, len(res[0].F))
+	for _, itm := range res[0].F {
+		node, err := fs.addLinkNode(itm, share, block)
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			items[node] = itm
+		}
+	}
+	for node, itm := range items {
+		parent, ok := fs.lookup[itm.Parent]
+		switch {
+		case ok:
+			node.parent = parent
+			parent.addChild(node)
+		case fs.root != nil:
+			return nil, fmt.Errorf("more than one root in folder %q: %w", link, EBADRESP)
+		default:
+			fs.root = node
+		}
+	}
+	if fs.root == nil || fs.root.ntype != FOLDER {
+		return nil, fmt.Errorf("no folder in %q: %w", link, EBADRESP)
+	}
+	_, err = decryptAttr(fs.root.meta.key, items[fs.root].Attr)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt %q with the key in the link: %w", link, EKEY)
+	}
+	return fs, nil
+}
+
+// addLinkNode adds a node of a public folder whose key is encrypted
+// with the share key in block of the folder with handle share,
+// returning nil if it is ignored
+//
+// Call with fs.mutex held
+func (fs *MegaFS) addLinkNode(itm FSNode, share string, block cipher.Block) (*Node, error) {
+	if itm.T != FILE && itm.T != FOLDER {
+		return nil, nil
+	}
+	// the key is a list of keys separated by / each prefixed by the
+	// handle of the share it is encrypted with, as nodes in nested
+	// shares have one for each
+	var itemKey string
+	for _, k := range strings.Split(itm.Key, "/") {
+		h, key, ok := strings.Cut(k, ":")
+		if ok && h == share {
+			itemKey = key
+			break
+		}
+	}
+	if itemKey == "" {
+		return nil, fmt.Errorf("no key for node %q in folder %q: %w", itm.Hash, share, EKEY)
+	}
+	buf, err := base64urldecode(itemKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 || len(buf)%16 != 0 {
+		return nil, fmt.Errorf("bad key for node %q: %w", itm.Hash, EKEY)
+	}
+	err = blockDecrypt(block, buf, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &Node{
+		fs:    fs,
+		hash:  itm.Hash,
+		ntype: itm.T,
+		size:  itm.Sz,
+		ts:    time.Unix(itm.Ts, 0),
+	}
+	if itm.T == FILE {
+		compkey, err := bytes_to_a32(buf)
+		if err != nil {
+			return nil, err
+		}
+		node.meta, err = fileMeta(compkey)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		node.meta.key = buf
+		node.meta.compkey = buf
+	}
+
+	attr, err := decryptAttr(node.meta.key, itm.Attr)
+	if err != nil {
+		attr = FileAttr{Name: "BAD ATTRIBUTE"}
+	}
+	fs.setAttr(node, attr)
+	fs.lookup[itm.Hash] = node
+	return node, nil
+}
@@ -5,15 +5,18 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const numReplications = 262144
 const tokenSlotSize = 48
-const doneCtxCheckWhenNthIteration = 1000
 
 // Base64ToBytes decodes a base64url-encoded string to a byte slice
 func Base64ToBytes(s string) ([]byte, error) {
@@ -57,93 +60,177 @@ func parseHashcash(header string) (easiness int, token string, valid bool) {
 	return e, parts[3], true
 }
 
-// gencash generates a hashcash value based on the token and easiness
-func gencash(ctx context.Context, token string, easiness int) string {
-	threshold := uint32((((easiness & 63) << 1) + 1) << ((easiness>>6)*7 + 3))
+// HashcashResult is a solved hashcash challenge
+type HashcashResult struct {
+	// Cash is the value sent back to the server
+	Cash string
+	// Attempts is the number of prefixes tried, if known
+	Attempts int64
+	// Elapsed is the time taken to solve the challenge
+	Elapsed time.Duration
+}
+
+// HashcashSolver solves the hashcash challenges the server sends
+// with 402 Payment Required responses.
+//
+// Solve should return promptly with the context error when ctx is
+// done. It may be called concurrently by several Mega.
+type HashcashSolver interface {
+	Solve(ctx context.Context, token string, easiness int) (*HashcashResult, error)
+}
+
+// ParallelHashcashSolver is the default HashcashSolver. It splits
+// the search for a prefix between Workers goroutines.
+type ParallelHashcashSolver struct {
+	// Workers is the number of goroutines to use, at least 1
+	Workers int
+}
+
+// hashcashBufferSize is the size of the buffer hashed for each attempt
+const hashcashBufferSize = 4 + numReplications*tokenSlotSize // 12 MB!
+
+// hashcashBuffers holds buffers for reuse between solves
+var hashcashBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, hashcashBufferSize)
+		return &buf
+	},
+}
+
+// hashcashThreshold returns the largest hash value accepted for easiness
+func hashcashThreshold(easiness int) uint32 {
+	return uint32((((easiness & 63) << 1) + 1) << ((easiness>>6)*7 + 3))
+}
+
+// Solve implements HashcashSolver
+func (s *ParallelHashcashSolver) Solve(ctx context.Context, token string, easiness int) (*HashcashResult, error) {
+	start := time.Now()
 	tokenBytes, err := Base64ToBytes(token)
 	if err != nil {
-		return ""
+		return nil, fmt.Errorf("bad hashcash token: %w", err)
 	}
-
 	tokenBytes = PadToAESBlockSize(tokenBytes)
-	buffer := make([]byte, 4+numReplications*tokenSlotSize) // 12 MB!
-
-	// Replicate token data across the buffer
-	for i := 0; i < numReplications; i++ {
-		copy(buffer[4+i*tokenSlotSize:], tokenBytes)
+	if len(tokenBytes) > tokenSlotSize {
+		return nil, fmt.Errorf("hashcash token too long: %d bytes", len(tokenBytes))
 	}
+	threshold := hashcashThreshold(easiness)
+	workers := max(s.Workers, 1)
 
-	prefix := make([]byte, 4)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	// Try different prefixes until we find one that satisfies the threshold
-	iterations := 0
-	for {
-		// Check context every doneCtxCheckWhenNthIteration iterations
-		if iterations++; iterations%doneCtxCheckWhenNthIteration == 0 {
-			select {
-			case <-ctx.Done():
-				return ""
-			default:
+	var (
+		attempts atomic.Int64
+		wg       sync.WaitGroup
+		found    = make(chan string, workers)
+	)
+	// Worker i tries the prefixes i+1, i+1+workers, ... so each
+	// prefix is only tried once.
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(first uint32) {
+			defer wg.Done()
+			cash, ok := hashcashSearch(ctx, tokenBytes, threshold, first, uint32(workers), &attempts)
+			if ok {
+				found <- cash
+				cancel()
 			}
-		}
+		}(uint32(i + 1))
+	}
+	wg.Wait()
 
-		// Increment prefix
-		prefixSize := 4
-		for j := 0; j < prefixSize; j++ {
-			buffer[j]++
-			if buffer[j] != 0 {
-				break
-			}
-			// last byte overflowed to zero
-			if j == prefixSize-1 {
-				return ""
-			}
-		}
+	select {
+	case cash := <-found:
+		return &HashcashResult{
+			Cash:     cash,
+			Attempts: attempts.Load(),
+			Elapsed:  time.Since(start),
+		}, nil
+	default:
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, errors.New("hashcash prefix space exhausted")
+}
 
-		// Save prefix for later
-		copy(prefix, buffer[:4])
+// hashcashSearch tries the prefixes first, first+step, ... until one
+// hashes to no more than threshold, returning it encoded as the cash
+// value. It returns false if ctx is done or the prefixes run out.
+func hashcashSearch(ctx context.Context, tokenBytes []byte, threshold uint32, first, step uint32, attempts *atomic.Int64) (string, bool) {
+	bufp := hashcashBuffers.Get().(*[]byte)
+	defer hashcashBuffers.Put(bufp)
+	buffer := *bufp
 
-		hash := sha256.Sum256(buffer)
-		hashValue := binary.BigEndian.Uint32(hash[:4])
-		if hashValue <= threshold {
-			return base64.RawURLEncoding.EncodeToString(prefix)
-		}
+	// Replicate token data across the buffer
+	for i := 0; i < numReplications; i++ {
+		slot := buffer[4+i*tokenSlotSize : 4+(i+1)*tokenSlotSize]
+		clear(slot[copy(slot, tokenBytes):])
 	}
-}
 
-func solveHashCashChallenge(token string, easiness int, timeout time.Duration, workers int) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	for prefix := uint64(first); prefix <= math.MaxUint32; prefix += uint64(step) {
+		// Each attempt hashes 12 MB so checking the context every
+		// time costs nothing in comparison
+		if ctx.Err() != nil {
+			return "", false
+		}
+		attempts.Add(1)
 
-	resultChan := make(chan string, workers)
-
-	workerFunc := func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				result := gencash(ctx, token, easiness)
-				if result != "" {
-					select {
-					case resultChan <- result:
-						return
-					case <-ctx.Done():
-						return
-					}
-				}
-			}
+		binary.LittleEndian.PutUint32(buffer, uint32(prefix))
+		hash := sha256.Sum256(buffer)
+		if binary.BigEndian.Uint32(hash[:4]) <= threshold {
+			return base64.RawURLEncoding.EncodeToString(buffer[:4]), true
 		}
 	}
+	return "", false
+}
 
-	for i := 0; i < workers; i++ {
-		go workerFunc()
+// SetHashcashSolver sets the solver for hashcash challenges. Use nil
+// to restore the default ParallelHashcashSolver.
+func (c *config) SetHashcashSolver(s HashcashSolver) {
+	c.hashcashSolver = s
+}
+
+// getHashcashSolver returns the hashcash solver in use
+func (c *config) getHashcashSolver() HashcashSolver {
+	if c.hashcashSolver != nil {
+		return c.hashcashSolver
 	}
+	return &ParallelHashcashSolver{Workers: c.hashcashWorkers}
+}
 
+// solveHashcash solves the hashcash challenge token with the solver
+// in use, returning the cash value.
+//
+// Only one challenge is solved at once as each solve can use many
+// CPUs. Waiting for another solve stops if ctx is cancelled.
+func (m *Mega) solveHashcash(ctx context.Context, token string, easiness int) (string, error) {
 	select {
-	case result := <-resultChan:
-		return result, nil
+	case m.hashcashSem <- struct{}{}:
 	case <-ctx.Done():
 		return "", ctx.Err()
 	}
+	defer func() { <-m.hashcashSem }()
+
+	info := &HashcashInfo{
+		Easiness: easiness,
+		Start:    time.Now(),
+	}
+	solveCtx, cancel := context.WithTimeout(ctx, m.hashcashTimeout)
+	defer cancel()
+	res, err := m.getHashcashSolver().Solve(solveCtx, token, easiness)
+	if err == nil && (res == nil || res.Cash == "") {
+		err = errors.New("empty cash value")
+	}
+	info.Duration = time.Since(info.Start)
+	if res != nil {
+		info.Attempts = res.Attempts
+	}
+	info.Err = err
+	m.getTracer().Hashcash(ctx, info)
+	if err != nil {
+		return "", err
+	}
+	m.debugf("Solved hashcash challenge with easiness %d in %v after %d attempts", easiness, res.Elapsed, res.Attempts)
+	return res.Cash, nil
 }
@@ -0,0 +1,149 @@
+package mega
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testHashcashToken is a 48 byte token as sent by the server
+var testHashcashToken = base64.RawURLEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef0123456789abcdef"))
+
+// checkCash checks that cash solves the challenge
+func checkCash(t *testing.T, token string, easiness int, cash string) {
+	t.Helper()
+	prefix, err := base64.RawURLEncoding.DecodeString(cash)
+	if err != nil || len(prefix) != 4 {
+		t.Fatalf("Bad cash value %q: %v", cash, err)
+	}
+	tokenBytes, err := Base64ToBytes(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, hashcashBufferSize)
+	copy(buffer, prefix)
+	for i := 0; i < numReplications; i++ {
+		copy(buffer[4+i*tokenSlotSize:], tokenBytes)
+	}
+	hash := sha256.Sum256(buffer)
+	if binary.BigEndian.Uint32(hash[:4]) > hashcashThreshold(easiness) {
+		t.Errorf("Cash value %q does not solve the challenge", cash)
+	}
+}
+
+func TestParallelHashcashSolver(t *testing.T) {
+	const easiness = 250
+	for _, workers := range []int{1, 3} {
+		s := &ParallelHashcashSolver{Workers: workers}
+		res, err := s.Solve(context.Background(), testHashcashToken, easiness)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkCash(t, testHashcashToken, easiness, res.Cash)
+		if res.Attempts < 1 {
+			t.Errorf("Expected attempts to be counted, got %d", res.Attempts)
+		}
+		if res.Elapsed <= 0 {
+			t.Errorf("Expected elapsed time, got %v", res.Elapsed)
+		}
+	}
+}
+
+func TestParallelHashcashSolverCancel(t *testing.T) {
+	s := &ParallelHashcashSolver{Workers: 2}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// easiness 0 can't be solved in the time
+	_, err := s.Solve(ctx, testHashcashToken, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Solve took %v to notice the cancel", elapsed)
+	}
+}
+
+// stubSolver returns a fixed cash value
+type stubSolver struct {
+	calls int
+}
+
+func (s *stubSolver) Solve(ctx context.Context, token string, easiness int) (*HashcashResult, error) {
+	s.calls++
+	return &HashcashResult{Cash: "stub"}, nil
+}
+
+func TestHashcashSolverOption(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Hashcash") != "1:"+testHashcashToken+":stub" {
+			w.Header().Set("X-Hashcash", "1:200:1700000000:"+testHashcashToken)
+			w.WriteHeader(http.StatusPaymentRequired)
+			return
+		}
+		_, _ = w.Write([]byte("[0]"))
+	}))
+	defer ts.Close()
+
+	solver := &stubSolver{}
+	m, err := NewWithOptions(WithAPIURL(ts.URL), WithHashcashSolver(solver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.api_request(context.Background(), []byte(`[{"a":"uq"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if solver.calls != 1 {
+		t.Errorf("Expected solver to be called once, got %d", solver.calls)
+	}
+}
+
+// blockingSolver solves nothing until its context is done
+type blockingSolver struct {
+	started chan struct{}
+}
+
+func (s *blockingSolver) Solve(ctx context.Context, token string, easiness int) (*HashcashResult, error) {
+	close(s.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSolveHashcashWaitCancel(t *testing.T) {
+	solver := &blockingSolver{started: make(chan struct{})}
+	m, err := NewWithOptions(WithHashcashSolver(solver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, stop := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := m.solveHashcash(first, testHashcashToken, 200)
+		done <- err
+	}()
+	<-solver.started
+
+	// waiting behind the first solve gives up with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = m.solveHashcash(ctx, testHashcashToken, 200)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Waiting took %v to notice the cancel", elapsed)
+	}
+
+	stop()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package mega
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+)
+
+// Import copies the file or folder a public link is for into parent,
+// as the "Import" of the web client does. The link must include the
+// key. The server makes the copies so the contents aren't transferred.
+//
+// It returns the nodes made, the file or folder first followed by the
+// nodes inside a folder, parents before their children.
+func (m *Mega) Import(link string, parent *Node) ([]*Node, error) {
+	return m.ImportContext(context.Background(), link, parent)
+}
+
+// ImportContext is like Import but with a context
+func (m *Mega) ImportContext(ctx context.Context, link string, parent *Node) ([]*Node, error) {
+	if parent == nil {
+		return nil, EARGS
+	}
+	l, err := ParseLink(link)
+	if err != nil {
+		return nil, err
+	}
+	master_aes, err := aes.NewCipher(m.k)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []PutNode
+	if l.Folder {
+		fs, err := m.PublicFolderContext(ctx, link)
+		if err != nil {
+			return nil, err
+		}
+		fs.mutex.Lock()
+		nodes, err = importNodes(master_aes, fs.root, nil)
+		fs.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		src, err := m.PublicFileContext(ctx, link)
+		if err != nil {
+			return nil, err
+		}
+		src.fs.mutex.Lock()
+		node, err := importNode(master_aes, src)
+		src.fs.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		node.Ph = node.H
+		node.H = ""
+		nodes = []PutNode{node}
+	}
+
+	var msg [1]PutNodesMsg
+	var res [1]UploadCompleteResp
+
+	msg[0].Cmd = "p"
+	msg[0].T = parent.GetHash()
+	msg[0].N = nodes
+	msg[0].I, err = randString(10)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.api_request(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(result, &res)
+	if err != nil {
+		return nil, err
+	}
+	if len(res[0].F) != len(nodes) {
+		return nil, fmt.Errorf("imported %d nodes of %d: %w", len(res[0].F), len(nodes), EBADRESP)
+	}
+
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+	imported := make([]*Node, 0, len(res[0].F))
+	for _, itm := range res[0].F {
+		node, err := m.addFSNode(itm)
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			imported = append(imported, node)
+		}
+	}
+	return imported, nil
+}
+
+// importNodes returns the nodes to make to import n and the nodes
+// below it, parents first
+//
+// Call with n.fs.mutex held
+func importNodes(master_aes cipher.Block, n *Node, parent *Node) ([]PutNode, error) {
+	node, err := importNode(master_aes, n)
+	if err != nil {
+		return nil, err
+	}
+	if parent != nil {
+		node.P = parent.hash
+	}
+	nodes := []PutNode{node}
+	for _, c := range n.children {
+		children, err := importNodes(master_aes, c, n)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, children...)
+	}
+	return nodes, nil
+}
+
+// importNode returns the node to make to import n, with its attributes
+// and its key encrypted with the master key
+//
+// Call with n.fs.mutex held
+func importNode(master_aes cipher.Block, n *Node) (PutNode, error) {
+	attr_data, err := encryptAttr(n.meta.key, n.attr)
+	if err != nil {
+		return PutNode{}, err
+	}
+	key := make([]byte, len(n.meta.compkey))
+	err = blockEncrypt(master_aes, key, n.meta.compkey)
+	if err != nil {
+		return PutNode{}, err
+	}
+	return PutNode{
+		H: n.hash,
+		T: n.ntype,
+		A: attr_data,
+		K: base64urlencode(key),
+	}, nil
+}
@@ -0,0 +1,145 @@
+package mega
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PublicLink is a parsed public link to a file or folder
+type PublicLink struct {
+	// Folder is set for links to folders
+	Folder bool
+	// Handle is the public handle of the file or folder
+	Handle string
+	// Key is the key of the file or folder, nil if the link didn't
+	// include it
+	Key []byte
+}
+
+// handleMatch matches a public handle
+var handleMatch = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ParseLink parses a public link to a file or folder as made by Link
+// or the MEGA clients. These forms are understood, with or without the
+// host, and with or without the key:
+//
+//	https://mega.nz/file/handle#key
+//	https://mega.nz/folder/handle#key
+//	https://mega.nz/#!handle!key
+//	https://mega.nz/#F!handle!key
+//
+// Anything after the key, such as the path of a file within a folder,
+// is ignored.
+func ParseLink(link string) (*PublicLink, error) {
+	var l PublicLink
+	var handle, key string
+	if i := strings.Index(link, "#"); i >= 0 && (strings.HasPrefix(link[i:], "#!") || strings.HasPrefix(link[i:], "#F!")) {
+		// legacy links have it all in the fragment
+		rest := link[i+1:]
+		if strings.HasPrefix(rest, "F!") {
+			l.Folder = true
+			rest = rest[1:]
+		}
+		parts := strings.Split(rest[1:], "!")
+		handle = parts[0]
+		if len(parts) > 1 {
+			key = parts[1]
+		}
+	} else {
+		path, fragment, _ := strings.Cut(link, "#")
+		// folder links may go on to name a file in the folder
+		var ok bool
+		if _, handle, ok = strings.Cut(path, "/folder/"); ok {
+			l.Folder = true
+		} else if _, handle, ok = strings.Cut(path, "/file/"); !ok {
+			return nil, fmt.Errorf("can't parse link %q: %w", link, EBADLINK)
+		}
+		handle, _, _ = strings.Cut(handle, "/")
+		key, _, _ = strings.Cut(fragment, "/")
+	}
+
+	if !handleMatch.MatchString(handle) {
+		return nil, fmt.Errorf("bad handle in link %q: %w", link, EBADLINK)
+	}
+	l.Handle = handle
+	if key != "" {
+		k, err := base64urldecode(key)
+		// files have the key, nonce and MAC, folders just the key
+		if err != nil || (!l.Folder && len(k) != 32) || (l.Folder && len(k) != 16) {
+			return nil, fmt.Errorf("bad key in link %q: %w", link, EBADLINK)
+		}
+		l.Key = k
+	}
+	return &l, nil
+}
+
+// PublicFile returns the node of the file a public link is for, which
+// must include the key. This doesn't need a login.
+//
+// The node has the name and size of the file and can be downloaded or
+// opened like any other, but isn't part of the filesystem.
+func (m *Mega) PublicFile(link string) (*Node, error) {
+	return m.PublicFileContext(context.Background(), link)
+}
+
+// PublicFileContext is like PublicFile but with a context
+func (m *Mega) PublicFileContext(ctx context.Context, link string) (*Node, error) {
+	l, err := ParseLink(link)
+	if err != nil {
+		return nil, err
+	}
+	if l.Folder || l.Key == nil {
+		return nil, fmt.Errorf("%q isn't a link to a file with its key: %w", link, EBADLINK)
+	}
+
+	var msg [1]DownloadMsg
+	var res [1]DownloadResp
+
+	msg[0].Cmd = "g"
+	msg[0].P = l.Handle
+
+	request, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.api_request(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(result, &res)
+	if err != nil {
+		return nil, err
+	}
+	if res[0].Err != 0 {
+		merr := newAPIError(res[0].Err)
+		merr.Cmd = msg[0].Cmd
+		return nil, merr
+	}
+
+	compkey, err := bytes_to_a32(l.Key)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := fileMeta(compkey)
+	if err != nil {
+		return nil, err
+	}
+	attr, err := decryptAttr(meta.key, res[0].Attr)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt %q with the key in the link: %w", link, EKEY)
+	}
+
+	return &Node{
+		fs:     m.FS,
+		name:   attr.Name,
+		hash:   l.Handle,
+		ntype:  FILE,
+		size:   int64(res[0].Size),
+		meta:   meta,
+		attr:   attr,
+		public: true,
+	}, nil
+}
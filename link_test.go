@@ -0,0 +1,54 @@
+package mega
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestParseLink(t *testing.T) {
+	fileKey := bytes.Repeat([]byte{1}, 32)
+	folderKey := bytes.Repeat([]byte{2}, 16)
+	fk, dk := base64urlencode(fileKey), base64urlencode(folderKey)
+	for _, test := range []struct {
+		link   string
+		folder bool
+		key    []byte
+	}{
+		{"https://mega.nz/file/AbC-12_x#" + fk, false, fileKey},
+		{"https://mega.nz/file/AbC-12_x", false, nil},
+		{"mega.nz/file/AbC-12_x#" + fk, false, fileKey},
+		{"https://mega.nz/folder/AbC-12_x#" + dk, true, folderKey},
+		{"https://mega.nz/folder/AbC-12_x#" + dk + "/file/XyZ", true, folderKey},
+		{"https://mega.nz/folder/AbC-12_x/file/XyZ#" + dk, true, folderKey},
+		{"https://mega.co.nz/#!AbC-12_x!" + fk, false, fileKey},
+		{"https://mega.nz/#!AbC-12_x", false, nil},
+		{"#!AbC-12_x!" + fk, false, fileKey},
+		{"https://mega.nz/#F!AbC-12_x!" + dk, true, folderKey},
+		{"https://mega.nz/#F!AbC-12_x!" + dk + "!XyZ", true, folderKey},
+	} {
+		l, err := ParseLink(test.link)
+		if err != nil {
+			t.Errorf("%q: %v", test.link, err)
+			continue
+		}
+		if l.Handle != "AbC-12_x" || l.Folder != test.folder || !bytes.Equal(l.Key, test.key) {
+			t.Errorf("%q: got %+v", test.link, l)
+		}
+	}
+	for _, link := range []string{
+		"",
+		"https://mega.nz/",
+		"https://mega.nz/file/#" + fk,
+		"https://mega.nz/file/a%20b#" + fk,
+		"https://mega.nz/file/AbC#" + dk,
+		"https://mega.nz/folder/AbC#" + fk,
+		"https://mega.nz/#!AbC!" + dk,
+		"https://mega.nz/#F!AbC!" + fk,
+		"https://mega.nz/#!AbC!***",
+	} {
+		if _, err := ParseLink(link); !errors.Is(err, EBADLINK) {
+			t.Errorf("%q: expected EBADLINK, got %v", link, err)
+		}
+	}
+}
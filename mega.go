@@ -2,6 +2,7 @@ package mega
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -10,14 +11,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math/big"
+	"io/fs"
 	mrand "math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/pbkdf2"
@@ -28,6 +31,8 @@ const (
 	API_URL                    = "https://g.api.mega.co.nz"
 	BASE_DOWNLOAD_URL          = "https://mega.co.nz"
 	RETRIES                    = 10
+	API_WORKERS                = 4
+	MAX_API_WORKERS            = 30
 	DOWNLOAD_WORKERS           = 3
 	MAX_DOWNLOAD_WORKERS       = 30
 	UPLOAD_WORKERS             = 1
@@ -38,25 +43,59 @@ const (
 	maxSleepTime               = 5 * time.Second       // for retries
 	X_MEGA_USER_AGENT          = ""                    // custom user agent string. Not set if empty
 	HASHCASH_CHALLENGE_TIMEOUT = time.Minute * 5       // time limit to solve hashcash challenge
+	MAX_HASHCASH_WORKERS       = 256
+	REQUEST_SIZE               = 8 * 1024 * 1024 // most of a file transferred per HTTP request
+	MAX_REQUEST_SIZE           = 64 * 1024 * 1024
 )
 
 type config struct {
-	baseurl    string
-	retries    int
-	dl_workers int
-	ul_workers int
-	timeout    time.Duration
-	https      bool
+	baseurl     string
+	retries     int
+	api_workers int
+	dl_workers  int
+	ul_workers  int
+	timeout     time.Duration
+	https       bool
+	// retryPolicy overrides the default if set
+	retryPolicy RetryPolicy
+	// userAgent is sent with API requests if set
+	userAgent string
+	// limits for solving hashcash challenges
+	hashcashTimeout time.Duration
+	hashcashWorkers int
+	// hashcashSolver overrides the default if set
+	hashcashSolver HashcashSolver
+	// tracer receives callbacks if set
+	tracer Tracer
+	// progress receives the progress of all transfers if set
+	progress Progress
+	// spooling of uploads of unknown size
+	spoolMemory int64
+	spoolDir    string
+	spoolLimit  int64
+	// keep partial downloads to resume
+	resumableDownloads bool
+	// most of a file transferred per HTTP request
+	requestSize int
+	// copy files with the same fingerprint instead of uploading
+	dedup bool
 }
 
 func newConfig() config {
 	return config{
-		baseurl:    getAPIBaseURL(),
-		retries:    RETRIES,
-		dl_workers: DOWNLOAD_WORKERS,
-		ul_workers: UPLOAD_WORKERS,
-		timeout:    TIMEOUT,
-		https:      HTTPSONLY,
+		baseurl:     getAPIBaseURL(),
+		retries:     RETRIES,
+		api_workers: API_WORKERS,
+		dl_workers:  DOWNLOAD_WORKERS,
+		ul_workers:  UPLOAD_WORKERS,
+		timeout:     TIMEOUT,
+		https:       HTTPSONLY,
+
+		userAgent:       getUserAgent(),
+		hashcashTimeout: HASHCASH_CHALLENGE_TIMEOUT,
+		hashcashWorkers: halfCPUCores(),
+		spoolMemory:     SPOOL_MEMORY,
+		requestSize:     REQUEST_SIZE,
 	}
 }
 
@@ -68,11 +107,31 @@ func (c *config) SetAPIUrl(u string) {
 	c.baseurl = u
 }
 
-// Set number of retries for api calls
+// Set number of retries for api calls and chunk transfers. This is
+// ignored if SetRetryPolicy has been used.
 func (c *config) SetRetries(r int) {
 	c.retries = r
 }
 
+// Set the number of API requests which can be in flight at once. It
+// can be changed while requests are being made.
+//
+// Requests made concurrently may be run by the server in any order.
+// Commands which must be run in order should be sent in one Batch.
+func (m *Mega) SetAPIWorkers(w int) error {
+	if w < 1 {
+		return EARGS
+	}
+	if w <= MAX_API_WORKERS {
+		m.apiSemMu.Lock()
+		m.api_workers = w
+		m.apiSemMu.Unlock()
+		return nil
+	}
+
+	return EWORKER_LIMIT_EXCEEDED
+}
+
 // Set concurrent download workers
 func (c *config) SetDownloadWorkers(w int) error {
 	if w <= MAX_DOWNLOAD_WORKERS {
@@ -103,6 +162,53 @@ func (c *config) SetHTTPS(e bool) {
 	c.https = e
 }
 
+// Set the most of a file transferred by each HTTP request of a
+// download or upload. The requests are made of whole MAC chunks, which
+// are up to 1MB, so each is at least one of those.
+func (c *config) SetRequestSize(n int) error {
+	if n < 1 || n > MAX_REQUEST_SIZE {
+		return EARGS
+	}
+	c.requestSize = n
+	return nil
+}
+
+// Set whether UploadFile copies a file already in the Cloud Drive with
+// the same fingerprint and size instead of uploading it again. Files in
+// the Trash, the Inbox and incoming shares are never copied. The
+// default is false.
+func (c *config) SetDeduplication(e bool) {
+	c.dedup = e
+}
+
+// Set the user agent sent with API requests. Not set if empty.
+func (c *config) SetUserAgent(ua string) {
+	c.userAgent = ua
+}
+
+// Set the time limit for solving a hashcash challenge
+func (c *config) SetHashcashTimeout(t time.Duration) error {
+	if t <= 0 {
+		return EARGS
+	}
+	c.hashcashTimeout = t
+	return nil
+}
+
+// Set the number of goroutines used to solve a hashcash challenge by
+// the default solver
+func (c *config) SetHashcashWorkers(w int) error {
+	if w < 1 {
+		return EARGS
+	}
+	if w <= MAX_HASHCASH_WORKERS {
+		c.hashcashWorkers = w
+		return nil
+	}
+
+	return EWORKER_LIMIT_EXCEEDED
+}
+
 type Mega struct {
 	config
 	// Version of the account
@@ -110,7 +216,7 @@ type Mega struct {
 	// Salt for the account if accountVersion > 1
 	accountSalt []byte
 	// Sequence number
-	sn int64
+	sn atomic.Int64
 	// Server state sn
 	ssn string
 	// Session ID
@@ -126,8 +232,14 @@ type Mega struct {
 	// Loggers
 	logf   func(format string, v ...any)
 	debugf func(format string, v ...any)
-	// serialize the API requests
-	apiMu sync.Mutex
+	// limits the API requests in flight
+	apiSemMu sync.Mutex
+	apiSem   chan struct{}
+	// serialize the hashcash solving, holds a value while solving
+	hashcashSem chan struct{}
+	// bandwidth limits for chunk transfers
+	dlLimiter *RateLimiter
+	ulLimiter *RateLimiter
 	// mutex to protext waitEvents
 	waitEventsMu sync.Mutex
 	// Outstanding channels to close to indicate events all received
@@ -154,6 +266,10 @@ type Node struct {
 	size     int64
 	ts       time.Time
 	meta     NodeMeta
+	// attributes, including the name
+	attr FileAttr
+	// set if hash is the public handle of a file link
+	public bool
 }
 
 func (n *Node) removeChild(c *Node) bool {
@@ -214,6 +330,22 @@ func (n *Node) GetHash() string {
 	return n.hash
 }
 
+// GetFingerprint returns the fingerprint of a file as computed by
+// Fingerprint, or "" if it wasn't stored when it was uploaded
+func (n *Node) GetFingerprint() string {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	return n.attr.Fingerprint
+}
+
+// GetAttr returns a copy of the attributes of the node. Change them and
+// pass them to SetAttr to update them.
+func (n *Node) GetAttr() FileAttr {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	return n.attr.clone()
+}
+
 type NodeMeta struct {
 	key     []byte
 	compkey []byte
@@ -221,6 +353,28 @@ type NodeMeta struct {
 	mac     []byte
 }
 
+// fileMeta returns the NodeMeta of a file from its key of 8 words,
+// which has the AES key XORed with the nonce and MAC
+func fileMeta(compkey []uint32) (meta NodeMeta, err error) {
+	if len(compkey) < 8 {
+		return meta, EKEY
+	}
+	meta.key, err = a32_to_bytes([]uint32{compkey[0] ^ compkey[4], compkey[1] ^ compkey[5], compkey[2] ^ compkey[6], compkey[3] ^ compkey[7]})
+	if err != nil {
+		return meta, err
+	}
+	meta.iv, err = a32_to_bytes([]uint32{compkey[4], compkey[5], 0, 0})
+	if err != nil {
+		return meta, err
+	}
+	meta.mac, err = a32_to_bytes([]uint32{compkey[6], compkey[7]})
+	if err != nil {
+		return meta, err
+	}
+	meta.compkey, err = a32_to_bytes(compkey)
+	return meta, err
+}
+
 // Mega filesystem object
 type MegaFS struct {
 	root   *Node
@@ -229,6 +383,10 @@ type MegaFS struct {
 	sroots []*Node
 	lookup map[string]*Node
 	skmap  map[string]string
+	// files by fingerprint
+	fingerprints map[string][]*Node
+	// public handle of the folder link this is, "" for an account
+	folder string
 	mutex  sync.Mutex
 }
 
@@ -328,6 +486,66 @@ func (fs *MegaFS) PathLookup(root *Node, ns []string) ([]*Node, error) {
 	return nodepath, err
 }
 
+// FingerprintLookup returns a file with the fingerprint fp and size
+// bytes long, or nil if there is none
+func (fs *MegaFS) FingerprintLookup(fp string, size int64) *Node {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	for _, n := range fs.fingerprints[fp] {
+		if n.size == size {
+			return n
+		}
+	}
+	return nil
+}
+
+// setAttr sets the attributes of n, updating its name and indexing it
+// by fingerprint
+//
+// Call with fs.mutex held
+func (fs *MegaFS) setAttr(n *Node, attr FileAttr) {
+	fs.removeFingerprint(n)
+	n.attr = attr
+	n.name = attr.Name
+	if n.ntype == FILE && attr.Fingerprint != "" {
+		fs.fingerprints[attr.Fingerprint] = append(fs.fingerprints[attr.Fingerprint], n)
+	}
+}
+
+// unindex removes n and the nodes below it from the fingerprint index
+// when they are deleted
+//
+// Call with fs.mutex held
+func (fs *MegaFS) unindex(n *Node) {
+	for _, c := range n.children {
+		fs.unindex(c)
+	}
+	fs.removeFingerprint(n)
+}
+
+// removeFingerprint removes n from the fingerprint index
+//
+// Call with fs.mutex held
+func (fs *MegaFS) removeFingerprint(n *Node) {
+	fp := n.attr.Fingerprint
+	if fp == "" {
+		return
+	}
+	nodes := fs.fingerprints[fp]
+	for i, f := range nodes {
+		if f == n {
+			nodes = append(nodes[:i], nodes[i+1:]...)
+			break
+		}
+	}
+	if len(nodes) == 0 {
+		delete(fs.fingerprints, fp)
+	} else {
+		fs.fingerprints[fp] = nodes
+	}
+}
+
 // Get top level directory nodes shared by other users
 func (fs *MegaFS) GetSharedRoots() []*Node {
 	fs.mutex.Lock()
@@ -337,28 +555,23 @@ func (fs *MegaFS) GetSharedRoots() []*Node {
 
 func newMegaFS() *MegaFS {
 	fs := &MegaFS{
-		lookup: make(map[string]*Node),
-		skmap:  make(map[string]string),
+		lookup:       make(map[string]*Node),
+		skmap:        make(map[string]string),
+		fingerprints: make(map[string][]*Node),
 	}
 	return fs
 }
 
-func New() *Mega {
-	max := big.NewInt(0x100000000)
-	bigx, err := rand.Int(rand.Reader, max)
+// New returns a Mega with the default configuration.
+//
+// Use NewWithOptions to configure it as it is made, which returns an
+// error for an invalid option. New accepts options too but panics
+// with that error instead.
+func New(opts ...Option) *Mega {
+	m, err := NewWithOptions(opts...)
 	if err != nil {
-		panic(err) // this should be returned, but this is a public interface
+		panic(fmt.Errorf("mega.New: %w", err))
 	}
-	cfg := newConfig()
-	mgfs := newMegaFS()
-	m := &Mega{
-		config: cfg,
-		sn:     bigx.Int64(),
-		FS:     mgfs,
-		client: newHttpClient(cfg.timeout),
-	}
-	m.SetLogger(log.Printf)
-	m.SetDebugger(nil)
 	return m
 }
 
@@ -384,9 +597,14 @@ func (m *Mega) GetMasterKey() []byte {
 // "Login" using the session ID (for API auth) and master key (for decryption). Alternative to logging in with username/password
 // This can be used to import back a session exported with GetSessionID and GetMasterKey without requiring the password again
 func (m *Mega) LoginWithKeys(sessionId string, masterKey []byte) error {
+	return m.LoginWithKeysContext(context.Background(), sessionId, masterKey)
+}
+
+// LoginWithKeysContext is like LoginWithKeys but with a context
+func (m *Mega) LoginWithKeysContext(ctx context.Context, sessionId string, masterKey []byte) error {
 	m.sid = sessionId
 	m.k = masterKey
-	return m.postAuthInit()
+	return m.postAuthInit(ctx)
 }
 
 // SetLogger sets the logger for important messages.  By default this
@@ -412,148 +630,219 @@ func (m *Mega) SetDebugger(debugf func(format string, v ...any)) *Mega {
 // backOffSleep sleeps for the time pointed to then adjusts it by
 // doubling it up to a maximum of maxSleepTime.
 //
-// This produces a truncated exponential backoff sleep
-func backOffSleep(pt *time.Duration) {
-	time.Sleep(*pt)
+// This produces a truncated exponential backoff sleep. It returns
+// early with the context error if ctx is cancelled.
+func backOffSleep(ctx context.Context, pt *time.Duration) error {
+	err := sleepContext(ctx, *pt)
+	if err != nil {
+		return err
+	}
 	*pt *= 2
 	if *pt > maxSleepTime {
 		*pt = maxSleepTime
 	}
+	return nil
 }
 
-// API request method
-func (m *Mega) api_request(r []byte) (buf []byte, err error) {
-	var resp *http.Response
-	// serialize the API requests
-	m.apiMu.Lock()
-	defer func() {
-		m.sn++
-		m.apiMu.Unlock()
-	}()
-
-	url := fmt.Sprintf("%s/cs?id=%d", m.baseurl, m.sn)
+// acquireAPI waits until fewer than api_workers API requests are in
+// flight, returning a function to call when the request is done
+func (m *Mega) acquireAPI(ctx context.Context) (release func(), err error) {
+	m.apiSemMu.Lock()
+	workers := max(m.api_workers, 1)
+	if cap(m.apiSem) != workers {
+		// requests in flight release into the old channel
+		m.apiSem = make(chan struct{}, workers)
+	}
+	sem := m.apiSem
+	m.apiSemMu.Unlock()
 
-	if m.sid != "" {
-		url = fmt.Sprintf("%s&sid=%s", url, m.sid)
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
+}
 
-	sleepTime := minSleepTime // initial backoff time
-	for i := 0; i < m.retries+1; i++ {
-		if i != 0 {
-			m.debugf("Retry API request %d/%d: %v", i, m.retries, err)
-			backOffSleep(&sleepTime)
+// requestCommands returns the names of the distinct commands in the
+// API request r for error messages
+func requestCommands(r []byte) string {
+	var msgs []GenericEvent
+	if json.Unmarshal(r, &msgs) != nil {
+		return ""
+	}
+	var cmds []string
+	for _, msg := range msgs {
+		if !slices.Contains(cmds, msg.Cmd) {
+			cmds = append(cmds, msg.Cmd)
 		}
+	}
+	return strings.Join(cmds, ",")
+}
 
-		// Create request
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(r))
-		if err != nil {
-			continue
-		}
-		addRequestHeaders(req)
+// API request method
+//
+// Errors are returned as *MegaError except for context errors. If
+// the server returned an error code the response is returned too.
+func (m *Mega) api_request(ctx context.Context, r []byte) (buf []byte, err error) {
+	return m.folderAPIRequest(ctx, "", r)
+}
 
-		// Send request
-		resp, err = m.client.Do(req)
-		if err != nil {
-			continue
-		}
+// folderAPIRequest is like api_request but acts within the public
+// folder with handle folder rather than the session, unless folder is
+// ""
+func (m *Mega) folderAPIRequest(ctx context.Context, folder string, r []byte) (buf []byte, err error) {
+	release, err := m.acquireAPI(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-		// Handle 402 Payment Required status with hashcash challenge
-		if resp.StatusCode == 402 {
-			sleepTime = minSleepTime // reset exp backoff time
-			hashCashHeader := resp.Header.Get("X-Hashcash")
-			if hashCashHeader == "" {
-				_ = resp.Body.Close()
-				continue
-			}
+	// Each request has its own sequence number which is reused for
+	// its retries so the server can detect duplicates
+	url := fmt.Sprintf("%s/cs?id=%d", m.baseurl, m.sn.Add(1)-1)
+
+	// requests within a public folder don't use the session
+	if folder != "" {
+		url = fmt.Sprintf("%s&n=%s", url, folder)
+	} else if m.sid != "" {
+		url = fmt.Sprintf("%s&sid=%s", url, m.sid)
+	}
 
-			// Parse hashcash header
-			easiness, token, valid := parseHashcash(hashCashHeader)
-			if !valid {
-				_ = resp.Body.Close()
-				continue
+	cmds := requestCommands(r)
+	tracer := m.getTracer()
+	attempt := 0
+	err = m.retryLoop(ctx, "API request "+cmds, nil, func() *MegaError {
+		var merr *MegaError
+		attempt++
+		info := &APIAttemptInfo{
+			Cmd:          cmds,
+			Attempt:      attempt,
+			Start:        time.Now(),
+			Status:       http.StatusOK,
+			RequestBytes: len(r),
+		}
+		buf, merr = m.apiAttempt(ctx, url, r)
+		info.Duration = time.Since(info.Start)
+		info.ResponseBytes = len(buf)
+		if merr != nil {
+			merr.Cmd = cmds
+			info.Status = merr.Status
+			if merr.Code != 0 {
+				info.Status = http.StatusOK
 			}
+			info.Err = merr
+		}
+		tracer.APIAttempt(ctx, info)
+		return merr
+	})
+	if err != nil {
+		var merr *MegaError
+		if errors.As(err, &merr) && merr.Code != 0 {
+			return buf, err
+		}
+		return nil, err
+	}
+	return buf, nil
+}
 
-			// Close the current response before making a new request
-			_ = resp.Body.Close()
+// apiPost sends the API request r to url, adding the hashcash header
+// if cashValue is set
+func (m *Mega) apiPost(ctx context.Context, url string, r []byte, token, cashValue string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(r))
+	if err != nil {
+		return nil, err
+	}
+	if cashValue != "" {
+		m.addHashCashRequestHeaders(req, token, cashValue)
+	} else {
+		m.addRequestHeaders(req)
+	}
+	return m.client.Do(req)
+}
 
-			// Generate hashcash response
-			cashValue, err := solveHashCashChallenge(token, easiness, HASHCASH_CHALLENGE_TIMEOUT, halfCPUCores())
-			if err != nil {
-				m.debugf("Failed to solve hashcash challenge: %v", err)
-				continue
-			}
-			if cashValue == "" {
-				m.debugf("Failed to solve hashcash challenge: empty cash value")
-				continue
-			}
+// apiAttempt makes a single attempt at the API request r, solving a
+// hashcash challenge if the server asks for one.
+//
+// It returns the response body on success, and also if the server
+// returned an error code.
+func (m *Mega) apiAttempt(ctx context.Context, url string, r []byte) (buf []byte, merr *MegaError) {
+	resp, err := m.apiPost(ctx, url, r, "", "")
+	if err != nil {
+		return nil, &MegaError{Err: err, Retryable: true}
+	}
 
-			// Create a new request with the hashcash header
-			req, err = http.NewRequest("POST", url, bytes.NewBuffer(r))
-			if err != nil {
-				continue
-			}
-			addHashCashRequestHeaders(req, token, cashValue)
-			// Send the new request
-			resp, err = m.client.Do(req)
-			if err != nil {
-				continue
-			}
+	// Handle 402 Payment Required status with hashcash challenge
+	if resp.StatusCode == 402 {
+		hashCashHeader := resp.Header.Get("X-Hashcash")
 
-			// If still getting 402, give up this attempt and retry
-			if resp.StatusCode == 402 {
-				_ = resp.Body.Close()
-				continue
-			}
-		}
+		// Close the current response before making a new request
+		_ = resp.Body.Close()
 
-		if resp.StatusCode != 200 {
-			// err must be not-nil on a continue
-			_ = resp.Body.Close()
-			continue
+		// Parse hashcash header
+		easiness, token, valid := parseHashcash(hashCashHeader)
+		if !valid {
+			return nil, newHTTPError(resp)
 		}
 
-		buf, err = io.ReadAll(resp.Body)
+		// Generate hashcash response
+		cashValue, err := m.solveHashcash(ctx, token, easiness)
 		if err != nil {
-			_ = resp.Body.Close()
-			continue
+			m.debugf("Failed to solve hashcash challenge: %v", err)
+			return nil, &MegaError{
+				Status:    resp.StatusCode,
+				Err:       fmt.Errorf("failed to solve hashcash challenge: %w", err),
+				Retryable: true,
+			}
 		}
-		err = resp.Body.Close()
+
+		// Send a new request with the hashcash header. If still
+		// getting 402, give up this attempt and retry
+		resp, err = m.apiPost(ctx, url, r, token, cashValue)
 		if err != nil {
-			continue
+			return nil, &MegaError{Err: err, Retryable: true}
 		}
+	}
 
-		// at this point the body is read and closed
+	if resp.StatusCode != 200 {
+		_ = resp.Body.Close()
+		return nil, newHTTPError(resp)
+	}
 
-		if !bytes.HasPrefix(buf, []byte("[")) && !bytes.HasPrefix(buf, []byte("-")) {
-			return nil, EBADRESP
-		}
+	buf, err = io.ReadAll(resp.Body)
+	closeErr := resp.Body.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, &MegaError{Status: resp.StatusCode, Err: err, Retryable: true}
+	}
 
-		if len(buf) < 6 {
-			var emsg [1]ErrorMsg
-			err = json.Unmarshal(buf, &emsg)
-			if err != nil {
-				err = json.Unmarshal(buf, &emsg[0])
-			}
-			if err != nil {
-				return buf, EBADRESP
-			}
-			err = parseError(emsg[0])
-			if err == EAGAIN {
-				continue
-			}
-			return buf, err
-		}
+	// at this point the body is read and closed
 
-		if err == nil {
-			return buf, nil
+	if !bytes.HasPrefix(buf, []byte("[")) && !bytes.HasPrefix(buf, []byte("-")) {
+		return nil, &MegaError{Status: resp.StatusCode, Err: EBADRESP}
+	}
+
+	if len(buf) < 6 {
+		var emsg [1]ErrorMsg
+		err = json.Unmarshal(buf, &emsg)
+		if err != nil {
+			err = json.Unmarshal(buf, &emsg[0])
+		}
+		if err != nil {
+			return buf, &MegaError{Status: resp.StatusCode, Err: EBADRESP}
+		}
+		if emsg[0] != 0 {
+			return buf, newAPIError(emsg[0])
 		}
 	}
 
-	return nil, err
+	return buf, nil
 }
 
 // prelogin call
-func (m *Mega) prelogin(email string) error {
+func (m *Mega) prelogin(ctx context.Context, email string) error {
 	var msg [1]PreloginMsg
 	var res [1]PreloginResp
 
@@ -566,7 +855,7 @@ func (m *Mega) prelogin(email string) error {
 	if err != nil {
 		return err
 	}
-	result, err := m.api_request(req)
+	result, err := m.api_request(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -595,7 +884,7 @@ func (m *Mega) prelogin(email string) error {
 }
 
 // Authenticate and start a session
-func (m *Mega) login(email string, passwd string, multiFactor string) error {
+func (m *Mega) login(ctx context.Context, email string, passwd string, multiFactor string) error {
 	var msg [1]LoginMsg
 	var res [1]LoginResp
 	var err error
@@ -639,7 +928,7 @@ func (m *Mega) login(email string, passwd string, multiFactor string) error {
 	if err != nil {
 		return err
 	}
-	result, err = m.api_request(req)
+	result, err = m.api_request(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -667,30 +956,40 @@ func (m *Mega) login(email string, passwd string, multiFactor string) error {
 
 // Authenticate and start a session
 func (m *Mega) Login(email string, passwd string) error {
-	return m.MultiFactorLogin(email, passwd, "")
+	return m.LoginContext(context.Background(), email, passwd)
+}
+
+// LoginContext is like Login but with a context
+func (m *Mega) LoginContext(ctx context.Context, email string, passwd string) error {
+	return m.MultiFactorLoginContext(ctx, email, passwd, "")
 }
 
 // MultiFactorLogin - Authenticate and start a session with 2FA
 func (m *Mega) MultiFactorLogin(email, passwd, multiFactor string) error {
-	err := m.prelogin(email)
+	return m.MultiFactorLoginContext(context.Background(), email, passwd, multiFactor)
+}
+
+// MultiFactorLoginContext is like MultiFactorLogin but with a context
+func (m *Mega) MultiFactorLoginContext(ctx context.Context, email, passwd, multiFactor string) error {
+	err := m.prelogin(ctx, email)
 	if err != nil {
 		return err
 	}
 
-	err = m.login(email, passwd, multiFactor)
+	err = m.login(ctx, email, passwd, multiFactor)
 	if err != nil {
 		return err
 	}
 
-	return m.postAuthInit()
+	return m.postAuthInit(ctx)
 }
 
 // Finish initializing the Mega client after Login*()
-func (m *Mega) postAuthInit() error {
+func (m *Mega) postAuthInit(ctx context.Context) error {
 
 	waitEvent := m.WaitEventsStart()
 
-	err := m.getFileSystem()
+	err := m.getFileSystem(ctx)
 	if err != nil {
 		return err
 	}
@@ -747,6 +1046,11 @@ func (m *Mega) waitEventsFire() {
 
 // Get user information
 func (m *Mega) GetUser() (UserResp, error) {
+	return m.GetUserContext(context.Background())
+}
+
+// GetUserContext is like GetUser but with a context
+func (m *Mega) GetUserContext(ctx context.Context) (UserResp, error) {
 	var msg [1]UserMsg
 	var res [1]UserResp
 
@@ -756,7 +1060,7 @@ func (m *Mega) GetUser() (UserResp, error) {
 	if err != nil {
 		return res[0], err
 	}
-	result, err := m.api_request(req)
+	result, err := m.api_request(ctx, req)
 	if err != nil {
 		return res[0], err
 	}
@@ -767,6 +1071,11 @@ func (m *Mega) GetUser() (UserResp, error) {
 
 // Get quota information
 func (m *Mega) GetQuota() (QuotaResp, error) {
+	return m.GetQuotaContext(context.Background())
+}
+
+// GetQuotaContext is like GetQuota but with a context
+func (m *Mega) GetQuotaContext(ctx context.Context) (QuotaResp, error) {
 	var msg [1]QuotaMsg
 	var res [1]QuotaResp
 
@@ -778,7 +1087,7 @@ func (m *Mega) GetQuota() (QuotaResp, error) {
 	if err != nil {
 		return res[0], err
 	}
-	result, err := m.api_request(req)
+	result, err := m.api_request(ctx, req)
 	if err != nil {
 		return res[0], err
 	}
@@ -946,24 +1255,10 @@ func (m *Mega) addFSNode(itm FSNode) (*Node, error) {
 
 	switch {
 	case itm.T == FILE:
-		var meta NodeMeta
-		meta.key, err = a32_to_bytes(key)
-		if err != nil {
-			return nil, err
-		}
-		meta.iv, err = a32_to_bytes([]uint32{compkey[4], compkey[5], 0, 0})
-		if err != nil {
-			return nil, err
-		}
-		meta.mac, err = a32_to_bytes([]uint32{compkey[6], compkey[7]})
-		if err != nil {
-			return nil, err
-		}
-		meta.compkey, err = a32_to_bytes(compkey)
+		node.meta, err = fileMeta(compkey)
 		if err != nil {
 			return nil, err
 		}
-		node.meta = meta
 	case itm.T == FOLDER:
 		var meta NodeMeta
 		meta.key, err = a32_to_bytes(key)
@@ -991,16 +1286,16 @@ func (m *Mega) addFSNode(itm FSNode) (*Node, error) {
 		m.FS.sroots = append(m.FS.sroots, node)
 	}
 
-	node.name = attr.Name
 	node.hash = itm.Hash
 	node.parent = parent
 	node.ntype = itm.T
+	m.FS.setAttr(node, attr)
 
 	return node, nil
 }
 
 // Get all nodes from filesystem
-func (m *Mega) getFileSystem() error {
+func (m *Mega) getFileSystem(ctx context.Context) error {
 	m.FS.mutex.Lock()
 	defer m.FS.mutex.Unlock()
 
@@ -1014,7 +1309,7 @@ func (m *Mega) getFileSystem() error {
 	if err != nil {
 		return err
 	}
-	result, err := m.api_request(req)
+	result, err := m.api_request(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -1050,10 +1345,11 @@ type Download struct {
 	resourceUrl string
 	aes_block   cipher.Block
 	iv          []byte
-	mac_enc     cipher.BlockMode
+	requestSize int        // chunks are made of MAC chunks up to this
 	mutex       sync.Mutex // to protect the following
 	chunks      []chunkSize
 	chunk_macs  [][]byte
+	limiter     *RateLimiter
 }
 
 // an all nil IV for mac calculations
@@ -1065,6 +1361,11 @@ var zero_iv = make([]byte, 16)
 // 0..chunks-1 call DownloadChunk.  Finally call Finish() to receive
 // the error status.
 func (m *Mega) NewDownload(src *Node) (*Download, error) {
+	return m.NewDownloadContext(context.Background(), src)
+}
+
+// NewDownloadContext is like NewDownload but with a context
+func (m *Mega) NewDownloadContext(ctx context.Context, src *Node) (*Download, error) {
 	if src == nil {
 		return nil, EARGS
 	}
@@ -1072,21 +1373,26 @@ func (m *Mega) NewDownload(src *Node) (*Download, error) {
 	var msg [1]DownloadMsg
 	var res [1]DownloadResp
 
-	m.FS.mutex.Lock()
+	src.fs.mutex.Lock()
 	msg[0].Cmd = "g"
 	msg[0].G = 1
-	msg[0].N = src.hash
+	if src.public {
+		msg[0].P = src.hash
+	} else {
+		msg[0].N = src.hash
+	}
 	if m.config.https {
 		msg[0].SSL = 2
 	}
 	key := src.meta.key
-	m.FS.mutex.Unlock()
+	folder := src.fs.folder
+	src.fs.mutex.Unlock()
 
 	request, err := json.Marshal(msg)
 	if err != nil {
 		return nil, err
 	}
-	result, err := m.api_request(request)
+	result, err := m.folderAPIRequest(ctx, folder, request)
 	if err != nil {
 		return nil, err
 	}
@@ -1098,7 +1404,9 @@ func (m *Mega) NewDownload(src *Node) (*Download, error) {
 
 	// DownloadResp has an embedded error in it for some reason
 	if res[0].Err != 0 {
-		return nil, parseError(res[0].Err)
+		merr := newAPIError(res[0].Err)
+		merr.Cmd = msg[0].Cmd
+		return nil, merr
 	}
 
 	_, err = decryptAttr(key, res[0].Attr)
@@ -1106,17 +1414,17 @@ func (m *Mega) NewDownload(src *Node) (*Download, error) {
 		return nil, err
 	}
 
-	chunks := getChunkSizes(int64(res[0].Size))
+	requestSize := m.requestSize
+	chunks := getRequestChunks(int64(res[0].Size), requestSize)
 
 	aes_block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	mac_enc := cipher.NewCBCEncrypter(aes_block, zero_iv)
-	m.FS.mutex.Lock()
+	src.fs.mutex.Lock()
 	t, err := bytes_to_a32(src.meta.iv)
-	m.FS.mutex.Unlock()
+	src.fs.mutex.Unlock()
 	if err != nil {
 		return nil, err
 	}
@@ -1136,7 +1444,7 @@ func (m *Mega) NewDownload(src *Node) (*Download, error) {
 		resourceUrl: downloadUrl,
 		aes_block:   aes_block,
 		iv:          iv,
-		mac_enc:     mac_enc,
+		requestSize: requestSize,
 		chunks:      chunks,
 		chunk_macs:  make([][]byte, len(chunks)),
 	}
@@ -1161,145 +1469,299 @@ func (d *Download) ChunkLocation(id int) (position int64, size int, err error) {
 // DownloadChunk gets a chunk with the given number and update the
 // mac, returning the position in the file of the chunk
 func (d *Download) DownloadChunk(id int) (chunk []byte, err error) {
-	if id < 0 || id >= len(d.chunks) {
-		return nil, EARGS
-	}
+	return d.DownloadChunkContext(context.Background(), id)
+}
 
-	chk_start, chk_size, err := d.ChunkLocation(id)
+// DownloadChunkContext is like DownloadChunk but with a context
+func (d *Download) DownloadChunkContext(ctx context.Context, id int) (chunk []byte, err error) {
+	_, chk_size, err := d.ChunkLocation(id)
 	if err != nil {
 		return nil, err
 	}
-
-	var resp *http.Response
-	chunk_url := fmt.Sprintf("%s/%d-%d", d.resourceUrl, chk_start, chk_start+int64(chk_size)-1)
-	sleepTime := minSleepTime // initial backoff time
-	for retry := 0; retry < d.m.retries+1; retry++ {
-		resp, err = d.m.client.Get(chunk_url)
-		if err == nil {
-			if resp.StatusCode == 200 {
-				break
-			}
-			err = errors.New("Http Status: " + resp.Status)
-			_ = resp.Body.Close()
-		}
-		d.m.debugf("%s: Retry download chunk %d/%d: %v", d.src.name, retry, d.m.retries, err)
-		backOffSleep(&sleepTime)
-	}
+	chunk = make([]byte, chk_size)
+	err = d.downloadChunkInto(ctx, id, chunk, nil)
 	if err != nil {
 		return nil, err
 	}
-	if resp == nil {
-		return nil, errors.New("retries exceeded")
-	}
+	return chunk, nil
+}
 
-	chunk, err = io.ReadAll(resp.Body)
+// downloadChunkInto is like DownloadChunkContext but downloads into
+// buf, which must be the size of the chunk, calling notify, if not
+// nil, before each retry
+func (d *Download) downloadChunkInto(ctx context.Context, id int, buf []byte, notify retryNotify) (err error) {
+	chk_start, chk_size, err := d.ChunkLocation(id)
 	if err != nil {
-		_ = resp.Body.Close()
-		return nil, err
+		return err
 	}
-
-	err = resp.Body.Close()
-	if err != nil {
-		return nil, err
+	if len(buf) != chk_size {
+		return EARGS
 	}
 
-	// body is read and closed here
-
-	if len(chunk) != chk_size {
-		return nil, errors.New("wrong size for downloaded chunk")
+	info := &ChunkTransferInfo{
+		Name:   d.src.GetName(),
+		Chunk:  id,
+		Offset: chk_start,
+		Bytes:  chk_size,
+		Start:  time.Now(),
 	}
+	defer func() {
+		info.Duration = time.Since(info.Start)
+		info.Err = err
+		d.m.getTracer().ChunkTransfer(ctx, info)
+	}()
 
-	// Decrypt the block
-	ctr_iv, err := bytes_to_a32(d.src.meta.iv)
-	if err != nil {
-		return nil, err
-	}
-	ctr_iv[2] = uint32(uint64(chk_start) / 0x1000000000)
-	ctr_iv[3] = uint32(chk_start / 0x10)
-	bctr_iv, err := a32_to_bytes(ctr_iv)
+	mac := newMACWriter(d.aes_block, d.iv, chk_start)
+	err = d.fetchRangeInto(ctx, info.Name+": download chunk", chk_start, buf, mac, &info.Attempts, notify)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	ctr_aes := cipher.NewCTR(d.aes_block, bctr_iv)
-	ctr_aes.XORKeyStream(chunk, chunk)
 
 	// Update the chunk_macs
-	enc := cipher.NewCBCEncrypter(d.aes_block, d.iv)
-	i := 0
-	block := make([]byte, 16)
-	paddedChunk := paddnull(chunk, 16)
-	for i = 0; i < len(paddedChunk); i += 16 {
-		enc.CryptBlocks(block, paddedChunk[i:i+16])
-	}
+	block := mac.Sum()
 
 	d.mutex.Lock()
 	if len(d.chunk_macs) > 0 {
-		d.chunk_macs[id] = make([]byte, 16)
-		copy(d.chunk_macs[id], block)
+		d.chunk_macs[id] = block
 	}
 	d.mutex.Unlock()
 
-	return chunk, nil
+	return nil
 }
 
-// Finish checks the accumulated MAC for each block.
-//
-// If all the chunks weren't downloaded then it will just return nil
-func (d *Download) Finish() (err error) {
-	// Can't check a 0 sized file
-	if len(d.chunk_macs) == 0 {
-		return nil
-	}
-	mac_data := make([]byte, 16)
-	for _, v := range d.chunk_macs {
-		// If a chunk_macs hasn't been set then the whole file
-		// wasn't downloaded and we can't check it
-		if v == nil {
-			return nil
-		}
-		d.mac_enc.CryptBlocks(mac_data, v)
-	}
+// chunkMAC returns the MACs of the MAC chunks in the decrypted chunk
+// at chk_start
+func (d *Download) chunkMAC(chk_start int64, chunk []byte) []byte {
+	return chunkMACs(d.aes_block, d.iv, chk_start, chunk)
+}
 
-	tmac, err := bytes_to_a32(mac_data)
-	if err != nil {
-		return err
-	}
-	btmac, err := a32_to_bytes([]uint32{tmac[0] ^ tmac[1], tmac[2] ^ tmac[3]})
+// fetchRange downloads size bytes of the file from start and
+// decrypts them. attempts is incremented for each HTTP request made.
+func (d *Download) fetchRange(ctx context.Context, what string, start int64, size int, attempts *int) (data []byte, err error) {
+	data = make([]byte, size)
+	err = d.fetchRangeInto(ctx, what, start, data, nil, attempts, nil)
 	if err != nil {
-		return err
-	}
-	if !bytes.Equal(btmac, d.src.meta.mac) {
-		return EMACMISMATCH
+		return nil, err
 	}
-
-	return nil
+	return data, nil
 }
 
-// Download file from filesystem reporting progress if not nil
-func (m *Mega) DownloadFile(src *Node, dstpath string, progress *chan int) error {
-	defer func() {
-		if progress != nil {
-			close(*progress)
+// fetchRangeInto downloads len(buf) bytes of the file from start into
+// buf, decrypting them and adding them to mac, if set, as they stream
+// in. attempts is incremented for each HTTP request made and notify,
+// if not nil, is called before each retry.
+func (d *Download) fetchRangeInto(ctx context.Context, what string, start int64, buf []byte, mac *macWriter, attempts *int, notify retryNotify) (err error) {
+	limiter := d.getRateLimiter()
+	url := fmt.Sprintf("%s/%d-%d", d.resourceUrl, start, start+int64(len(buf))-1)
+	n := 0
+	err = d.m.retryLoop(ctx, what, notify, func() *MegaError {
+		*attempts++
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return &MegaError{URL: url, Err: err}
 		}
-	}()
+		resp, err := d.m.client.Do(req)
+		if err != nil {
+			return newTransferError(url, resp, err)
+		}
+		if resp.StatusCode != 200 {
+			_ = resp.Body.Close()
+			return newTransferError(url, resp, nil)
+		}
+		// start again on a retry - the first two words of d.iv
+		// are the nonce
+		if mac != nil {
+			mac.reset(d.aes_block, d.iv, start)
+		}
+		stream := ctrStream(d.aes_block, d.iv, start)
+		n, err = readChunk(newRateLimitedReader(ctx, resp.Body, limiter), buf, stream, mac)
+		if err == nil && n == len(buf) {
+			// anything more is the wrong size too
+			var extra [1]byte
+			more, _ := resp.Body.Read(extra[:])
+			n += more
+		}
+		closeErr := resp.Body.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return newTransferError(url, nil, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-	d, err := m.NewDownload(src)
+	// body is read and closed here
+
+	if n != len(buf) {
+		return errors.New("wrong size for downloaded chunk")
+	}
+	return nil
+}
+
+// Finish checks the accumulated MAC for each block.
+//
+// If all the chunks weren't downloaded then it will just return nil
+func (d *Download) Finish() (err error) {
+	// Can't check a 0 sized file
+	if len(d.chunk_macs) == 0 {
+		return nil
+	}
+	btmac, err := d.fileMAC()
 	if err != nil {
 		return err
 	}
+	// If a chunk_macs hasn't been set then the whole file wasn't
+	// downloaded and we can't check it
+	if btmac == nil {
+		return nil
+	}
+	d.src.fs.mutex.Lock()
+	mac := d.src.meta.mac
+	d.src.fs.mutex.Unlock()
+	if !bytes.Equal(btmac, mac) {
+		return EMACMISMATCH
+	}
 
-	_, err = os.Stat(dstpath)
-	if os.IsExist(err) {
-		err = os.Remove(dstpath)
-		if err != nil {
+	return nil
+}
+
+// fileMAC returns the MAC of the file made from the chunk MACs, or nil
+// if any chunk hasn't been downloaded
+func (d *Download) fileMAC() ([]byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, v := range d.chunk_macs {
+		if v == nil {
+			return nil, nil
+		}
+	}
+	mac_data := metaMAC(cipher.NewCBCEncrypter(d.aes_block, zero_iv), d.chunk_macs)
+	tmac, err := bytes_to_a32(mac_data)
+	if err != nil {
+		return nil, err
+	}
+	return a32_to_bytes([]uint32{tmac[0] ^ tmac[1], tmac[2] ^ tmac[3]})
+}
+
+// Download file from filesystem reporting progress if not nil
+func (m *Mega) DownloadFile(src *Node, dstpath string, progress *chan int) error {
+	return m.DownloadFileContext(context.Background(), src, dstpath, progress)
+}
+
+// DownloadFileContext is like DownloadFile but with a context. If
+// the context is cancelled the workers are stopped and the partial
+// file is removed, unless resumable downloads are enabled with
+// SetResumableDownloads.
+func (m *Mega) DownloadFileContext(ctx context.Context, src *Node, dstpath string, progress *chan int) error {
+	return m.DownloadFileWithOptions(ctx, src, dstpath, &DownloadFileOptions{Progress: progress})
+}
+
+// IfExists says what DownloadFileWithOptions does when the
+// destination exists
+type IfExists int
+
+// IfExists values
+const (
+	Overwrite IfExists = iota // replace the existing file
+	Skip                      // leave the existing file and don't download
+	Fail                      // return an error wrapping fs.ErrExist
+)
+
+// DownloadFileOptions are the options for DownloadFileWithOptions
+type DownloadFileOptions struct {
+	// IfExists says what to do if the destination exists
+	IfExists IfExists
+	// Mode is the permissions of the file. If 0 a file being replaced
+	// keeps its permissions and a new file has 0600.
+	Mode os.FileMode
+	// SetModTime sets the modification time of the file to the
+	// timestamp of the node
+	SetModTime bool
+	// Progress is sent the size of each chunk as it is downloaded
+	// if not nil. It is closed when the download finishes.
+	Progress *chan int
+	// Reporter receives the progress of the download if not nil, as
+	// well as the Progress set with SetProgress
+	Reporter Progress
+	// RateLimiter limits the download instead of the download limit
+	// of the Mega if not nil
+	RateLimiter *RateLimiter
+}
+
+// Suffixes of the files made next to the destination while downloading
+const (
+	downloadPartialSuffix = ".mega-partial" // partial file of a resumable download
+	downloadTempPattern   = ".*.mega-tmp"   // partial file otherwise
+)
+
+// DownloadFileWithOptions downloads src to dstpath.
+//
+// The file is downloaded to a temporary file in the same directory
+// which is synced to disk, checked against the MAC of the node and
+// then renamed to dstpath, so dstpath never holds a partial or
+// corrupt file. If the download fails the temporary file is removed,
+// unless resumable downloads are enabled with SetResumableDownloads
+// in which case it is kept, with the suffix ".mega-partial", to carry
+// on from next time.
+func (m *Mega) DownloadFileWithOptions(ctx context.Context, src *Node, dstpath string, opts *DownloadFileOptions) (err error) {
+	if src == nil {
+		return EARGS
+	}
+	if opts == nil {
+		opts = &DownloadFileOptions{}
+	}
+	tracker := m.newProgressTracker(opts.Reporter, opts.Progress, src.GetName(), false)
+	defer func() {
+		tracker.done(err)
+	}()
+
+	if opts.IfExists != Overwrite {
+		_, err = os.Lstat(dstpath)
+		if err == nil {
+			if opts.IfExists == Skip {
+				return nil
+			}
+			return &fs.PathError{Op: "download", Path: dstpath, Err: fs.ErrExist}
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
 			return err
 		}
 	}
 
-	outfile, err := os.OpenFile(dstpath, os.O_RDWR|os.O_CREATE, 0600)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	d, err := m.NewDownloadContext(ctx, src)
+	if err != nil {
+		return err
+	}
+	d.SetRateLimiter(opts.RateLimiter)
+
+	var outfile *os.File
+	var state *downloadState
+	if m.resumableDownloads {
+		outfile, state, err = d.openResumable(dstpath+downloadPartialSuffix, dstpath+downloadStateSuffix)
+	} else {
+		dir, base := filepath.Split(dstpath)
+		outfile, err = os.CreateTemp(dir, "."+base+downloadTempPattern)
+	}
 	if err != nil {
 		return err
 	}
+	tmppath := outfile.Name()
+
+	var resumed int64
+	for id := 0; id < d.Chunks(); id++ {
+		if d.ChunkDone(id) {
+			_, chk_size, _ := d.ChunkLocation(id)
+			resumed += int64(chk_size)
+		}
+	}
+	tracker.start(src.GetSize(), resumed)
 
 	workch := make(chan int)
 	errch := make(chan error, m.dl_workers)
@@ -1314,54 +1776,133 @@ func (m *Mega) DownloadFile(src *Node, dstpath string, progress *chan int) error
 
 			// Wait for work blocked on channel
 			for id := range workch {
-				chunk, err := d.DownloadChunk(id)
+				chk_start, chk_size, err := d.ChunkLocation(id)
 				if err != nil {
 					errch <- err
 					return
 				}
 
-				chk_start, _, err := d.ChunkLocation(id)
-				if err != nil {
-					errch <- err
-					return
+				chunk := getBuffer(chk_size)
+				err = d.downloadChunkInto(ctx, id, *chunk, tracker.chunkRetry(id, chk_size))
+				if err == nil {
+					_, err = outfile.WriteAt(*chunk, chk_start)
 				}
-
-				_, err = outfile.WriteAt(chunk, chk_start)
+				putBuffer(chunk)
 				if err != nil {
 					errch <- err
 					return
 				}
 
-				if progress != nil {
-					*progress <- len(chunk)
+				if state != nil {
+					err = state.chunkDone(outfile, d, id)
+					if err != nil {
+						errch <- err
+						return
+					}
 				}
+
+				tracker.chunkDone(id, chk_size)
 			}
 		}()
 	}
 
 	// Place chunk download jobs to chan
-	err = nil
 	for id := 0; id < d.Chunks() && err == nil; {
+		if d.ChunkDone(id) {
+			id++
+			continue
+		}
 		select {
 		case workch <- id:
 			id++
 		case err = <-errch:
+		case <-ctx.Done():
+			err = ctx.Err()
 		}
 	}
 	close(workch)
+	if err != nil {
+		cancel()
+	}
 
 	wg.Wait()
 
+	// a worker may have failed after the last job was placed
+	if err == nil {
+		select {
+		case err = <-errch:
+		default:
+		}
+	}
+
+	if err != nil && state != nil {
+		// keep the partial file to carry on with later
+		saveErr := state.save(outfile)
+		closeErr := outfile.Close()
+		if saveErr != nil || closeErr != nil {
+			m.logf("Failed to save download state for %q: %v, %v", dstpath, saveErr, closeErr)
+		}
+		return err
+	}
+	if err == nil {
+		err = outfile.Sync()
+	}
 	closeErr := outfile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = d.Finish()
+	}
+	if err == nil {
+		err = finishDownloadFile(tmppath, dstpath, src, opts)
+	}
 	if err != nil {
-		_ = os.Remove(dstpath)
-		return err
+		_ = os.Remove(tmppath)
 	}
-	if closeErr != nil {
-		return closeErr
+	if state != nil {
+		// the state is no use if the file is complete or corrupt
+		removeErr := state.remove()
+		if err == nil {
+			err = removeErr
+		}
 	}
+	return err
+}
 
-	return d.Finish()
+// finishDownloadFile sets the mode and time of the downloaded file
+// tmppath then renames it to dstpath
+func finishDownloadFile(tmppath, dstpath string, src *Node, opts *DownloadFileOptions) error {
+	mode := opts.Mode
+	if mode == 0 {
+		// keep the permissions of a file being replaced
+		mode = 0600
+		if info, err := os.Stat(dstpath); err == nil && info.Mode().IsRegular() {
+			mode = info.Mode().Perm()
+		}
+	}
+	err := os.Chmod(tmppath, mode)
+	if err != nil {
+		return err
+	}
+	if opts.SetModTime {
+		ts := src.GetTimeStamp()
+		err = os.Chtimes(tmppath, ts, ts)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.IfExists != Overwrite {
+		// check again as the download takes a while
+		_, err = os.Lstat(dstpath)
+		if err == nil {
+			if opts.IfExists == Skip {
+				return os.Remove(tmppath)
+			}
+			return &fs.PathError{Op: "download", Path: dstpath, Err: fs.ErrExist}
+		}
+	}
+	return os.Rename(tmppath, dstpath)
 }
 
 // Upload contains the internal state of a upload
@@ -1376,10 +1917,14 @@ type Upload struct {
 	mac_enc           cipher.BlockMode
 	kbytes            []byte
 	ukey              []uint32
+	size              int64
+	requestSize       int        // chunks are made of MAC chunks up to this
 	mutex             sync.Mutex // to protect the following
 	chunks            []chunkSize
 	chunk_macs        [][]byte
 	completion_handle []byte
+	limiter           *RateLimiter
+	fingerprint       string
 }
 
 // Create a new Upload of name into parent of fileSize
@@ -1388,6 +1933,11 @@ type Upload struct {
 // 0..chunks-1 Call ChunkLocation then UploadChunk.  Finally call
 // Finish() to receive the error status and the *Node.
 func (m *Mega) NewUpload(parent *Node, name string, fileSize int64) (*Upload, error) {
+	return m.NewUploadContext(context.Background(), parent, name, fileSize)
+}
+
+// NewUploadContext is like NewUpload but with a context
+func (m *Mega) NewUploadContext(ctx context.Context, parent *Node, name string, fileSize int64) (*Upload, error) {
 	if parent == nil {
 		return nil, EARGS
 	}
@@ -1406,7 +1956,7 @@ func (m *Mega) NewUpload(parent *Node, name string, fileSize int64) (*Upload, er
 	if err != nil {
 		return nil, err
 	}
-	result, err := m.api_request(request)
+	result, err := m.api_request(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -1422,6 +1972,17 @@ func (m *Mega) NewUpload(parent *Node, name string, fileSize int64) (*Upload, er
 
 	}
 
+	uploadUrl := res[0].P
+	if m.config.https && strings.HasPrefix(uploadUrl, "http://") {
+		uploadUrl = "https://" + strings.TrimPrefix(uploadUrl, "http://")
+	}
+
+	return m.newUpload(parenthash, name, uploadUrl, ukey, fileSize, m.requestSize)
+}
+
+// newUpload makes the Upload of fileSize bytes to uploadUrl with the
+// file key ukey, in chunks of up to requestSize
+func (m *Mega) newUpload(parenthash, name, uploadUrl string, ukey []uint32, fileSize int64, requestSize int) (*Upload, error) {
 	kbytes, err := a32_to_bytes(ukey[:4])
 	if err != nil {
 		return nil, err
@@ -1441,7 +2002,7 @@ func (m *Mega) NewUpload(parent *Node, name string, fileSize int64) (*Upload, er
 		return nil, err
 	}
 
-	chunks := getChunkSizes(fileSize)
+	chunks := getRequestChunks(fileSize, requestSize)
 
 	// File size is zero
 	// Do one empty request to get the completion handle
@@ -1449,11 +2010,6 @@ func (m *Mega) NewUpload(parent *Node, name string, fileSize int64) (*Upload, er
 		chunks = append(chunks, chunkSize{position: 0, size: 0})
 	}
 
-	uploadUrl := res[0].P
-	if m.config.https && strings.HasPrefix(uploadUrl, "http://") {
-		uploadUrl = "https://" + strings.TrimPrefix(uploadUrl, "http://")
-	}
-
 	u := &Upload{
 		m:                 m,
 		parenthash:        parenthash,
@@ -1465,6 +2021,8 @@ func (m *Mega) NewUpload(parent *Node, name string, fileSize int64) (*Upload, er
 		mac_enc:           mac_enc,
 		kbytes:            kbytes,
 		ukey:              ukey,
+		size:              fileSize,
+		requestSize:       requestSize,
 		chunks:            chunks,
 		chunk_macs:        make([][]byte, len(chunks)),
 		completion_handle: []byte{},
@@ -1472,6 +2030,13 @@ func (m *Mega) NewUpload(parent *Node, name string, fileSize int64) (*Upload, er
 	return u, nil
 }
 
+// SetFingerprint sets the fingerprint stored with the file, as computed
+// by Fingerprint, so later uploads of the same file can be copied from
+// it instead. Call it before Finish.
+func (u *Upload) SetFingerprint(fp string) {
+	u.fingerprint = fp
+}
+
 // Chunks returns The number of chunks in the upload.
 func (u *Upload) Chunks() int {
 	return len(u.chunks)
@@ -1487,6 +2052,17 @@ func (u *Upload) ChunkLocation(id int) (position int64, size int, err error) {
 
 // UploadChunk uploads the chunk of id
 func (u *Upload) UploadChunk(id int, chunk []byte) (err error) {
+	return u.UploadChunkContext(context.Background(), id, chunk)
+}
+
+// UploadChunkContext is like UploadChunk but with a context
+func (u *Upload) UploadChunkContext(ctx context.Context, id int, chunk []byte) (err error) {
+	return u.uploadChunk(ctx, id, chunk, nil)
+}
+
+// uploadChunk is like UploadChunkContext but calls notify, if not nil,
+// before each retry
+func (u *Upload) uploadChunk(ctx context.Context, id int, chunk []byte, notify retryNotify) (err error) {
 	chk_start, chk_size, err := u.ChunkLocation(id)
 	if err != nil {
 		return err
@@ -1494,65 +2070,70 @@ func (u *Upload) UploadChunk(id int, chunk []byte) (err error) {
 	if len(chunk) != chk_size {
 		return errors.New("upload chunk is wrong size")
 	}
-	ctr_iv, err := bytes_to_a32(u.kiv)
-	if err != nil {
-		return err
-	}
-	ctr_iv[2] = uint32(uint64(chk_start) / 0x1000000000)
-	ctr_iv[3] = uint32(chk_start / 0x10)
-	bctr_iv, err := a32_to_bytes(ctr_iv)
-	if err != nil {
-		return err
-	}
-	ctr_aes := cipher.NewCTR(u.aes_block, bctr_iv)
-
-	enc := cipher.NewCBCEncrypter(u.aes_block, u.iv)
-
-	i := 0
-	block := make([]byte, 16)
-	paddedchunk := paddnull(chunk, 16)
-	for i = 0; i < len(paddedchunk); i += 16 {
-		copy(block[0:16], paddedchunk[i:i+16])
-		enc.CryptBlocks(block, block)
+	info := &ChunkTransferInfo{
+		Upload: true,
+		Name:   u.name,
+		Chunk:  id,
+		Offset: chk_start,
+		Bytes:  chk_size,
+		Start:  time.Now(),
 	}
-
-	var rsp *http.Response
-	var req *http.Request
-	ctr_aes.XORKeyStream(chunk, chunk)
+	defer func() {
+		info.Duration = time.Since(info.Start)
+		info.Err = err
+		u.m.getTracer().ChunkTransfer(ctx, info)
+	}()
+	// Encrypt into a buffer of our own leaving chunk alone - the
+	// first two words of u.kiv are the nonce
+	encrypted := getBuffer(len(chunk))
+	defer putBuffer(encrypted)
+	block := encryptChunk(*encrypted, chunk, ctrStream(u.aes_block, u.kiv, chk_start), newMACWriter(u.aes_block, u.iv, chk_start))
 	chk_url := fmt.Sprintf("%s/%d", u.uploadUrl, chk_start)
 
-	sleepTime := minSleepTime // initial backoff time
-	for retry := 0; retry < u.m.retries+1; retry++ {
-		reader := bytes.NewBuffer(chunk)
-		req, err = http.NewRequest("POST", chk_url, reader)
+	var chunk_resp []byte
+	limiter := u.getRateLimiter()
+	err = u.m.retryLoop(ctx, u.name+": upload chunk", notify, func() *MegaError {
+		info.Attempts++
+		var body io.ReadCloser = http.NoBody
+		if len(chunk) > 0 {
+			tracked := newTrackedBody(newRateLimitedReader(ctx, bytes.NewReader(*encrypted), limiter))
+			// the buffer is reused once the client is done with it
+			defer func() {
+				<-tracked.closed
+			}()
+			body = tracked
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", chk_url, body)
 		if err != nil {
-			return err
+			_ = body.Close()
+			return &MegaError{URL: chk_url, Err: err}
 		}
-		rsp, err = u.m.client.Do(req)
-		if err == nil {
-			if rsp.StatusCode == 200 {
-				break
-			}
-			err = errors.New("Http Status: " + rsp.Status)
+		req.ContentLength = int64(len(chunk))
+		rsp, err := u.m.client.Do(req)
+		if err != nil {
+			return newTransferError(chk_url, rsp, err)
+		}
+		if rsp.StatusCode != 200 {
 			_ = rsp.Body.Close()
+			return newTransferError(chk_url, rsp, nil)
+		}
+		chunk_resp, err = io.ReadAll(rsp.Body)
+		closeErr := rsp.Body.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return newTransferError(chk_url, nil, err)
 		}
-		u.m.debugf("%s: Retry upload chunk %d/%d: %v", u.name, retry, u.m.retries, err)
-		backOffSleep(&sleepTime)
-	}
-	if err != nil {
-		return err
-	}
-	if rsp == nil {
-		return errors.New("retries exceeded")
-	}
-
-	chunk_resp, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		_ = rsp.Body.Close()
-		return err
-	}
 
-	err = rsp.Body.Close()
+		// A negative number is an error code rather than the completion handle
+		if errno, err := strconv.Atoi(string(chunk_resp)); err == nil && errno < 0 {
+			merr := newAPIError(ErrorMsg(errno))
+			merr.URL = chk_url
+			return merr
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -1566,8 +2147,7 @@ func (u *Upload) UploadChunk(id int, chunk []byte) (err error) {
 	// Update chunk MACs on success only
 	u.mutex.Lock()
 	if len(u.chunk_macs) > 0 {
-		u.chunk_macs[id] = make([]byte, 16)
-		copy(u.chunk_macs[id], block)
+		u.chunk_macs[id] = block
 	}
 	u.mutex.Unlock()
 
@@ -1576,10 +2156,12 @@ func (u *Upload) UploadChunk(id int, chunk []byte) (err error) {
 
 // Finish completes the upload and returns the created node
 func (u *Upload) Finish() (node *Node, err error) {
-	mac_data := make([]byte, 16)
-	for _, v := range u.chunk_macs {
-		u.mac_enc.CryptBlocks(mac_data, v)
-	}
+	return u.FinishContext(context.Background())
+}
+
+// FinishContext is like Finish but with a context
+func (u *Upload) FinishContext(ctx context.Context) (node *Node, err error) {
+	mac_data := metaMAC(u.mac_enc, u.chunk_macs)
 
 	t, err := bytes_to_a32(mac_data)
 	if err != nil {
@@ -1587,7 +2169,7 @@ func (u *Upload) Finish() (node *Node, err error) {
 	}
 	meta_mac := []uint32{t[0] ^ t[1], t[2] ^ t[3]}
 
-	attr := FileAttr{u.name}
+	attr := FileAttr{Name: u.name, Fingerprint: u.fingerprint}
 
 	attr_data, err := encryptAttr(u.kbytes, attr)
 	if err != nil {
@@ -1625,7 +2207,7 @@ func (u *Upload) Finish() (node *Node, err error) {
 	if err != nil {
 		return nil, err
 	}
-	result, err := u.m.api_request(request)
+	result, err := u.m.api_request(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -1640,20 +2222,62 @@ func (u *Upload) Finish() (node *Node, err error) {
 	return u.m.addFSNode(cres[0].F[0])
 }
 
-// Upload a file to the filesystem
+// Upload a file to the filesystem.
+//
+// The fingerprint of the file is stored with it. If deduplication is
+// turned on with SetDeduplication and a file in the Cloud Drive has the
+// same fingerprint and size, that file is copied by the server instead
+// of uploading this one.
 func (m *Mega) UploadFile(srcpath string, parent *Node, name string, progress *chan int) (node *Node, err error) {
+	return m.UploadFileContext(context.Background(), srcpath, parent, name, progress)
+}
+
+// UploadFileContext is like UploadFile but with a context. If the
+// context is cancelled the workers are stopped and the upload is
+// abandoned.
+func (m *Mega) UploadFileContext(ctx context.Context, srcpath string, parent *Node, name string, progress *chan int) (node *Node, err error) {
+	return m.UploadFileWithOptions(ctx, srcpath, parent, name, &UploadFileOptions{Progress: progress})
+}
+
+// UploadFileOptions are the options for UploadFileWithOptions and
+// UploadReaderWithOptions
+type UploadFileOptions struct {
+	// Progress is sent the size of each chunk as it is uploaded if
+	// not nil. It is closed when the upload finishes.
+	Progress *chan int
+	// Reporter receives the progress of the upload if not nil, as
+	// well as the Progress set with SetProgress
+	Reporter Progress
+	// RateLimiter limits the upload instead of the upload limit of
+	// the Mega if not nil
+	RateLimiter *RateLimiter
+}
+
+// UploadFileWithOptions is like UploadFileContext with the options in
+// opts, which may be nil.
+func (m *Mega) UploadFileWithOptions(ctx context.Context, srcpath string, parent *Node, name string, opts *UploadFileOptions) (node *Node, err error) {
+	if opts == nil {
+		opts = &UploadFileOptions{}
+	}
+	if name == "" {
+		name = filepath.Base(srcpath)
+	}
+	tracker := m.newProgressTracker(opts.Reporter, opts.Progress, name, true)
 	defer func() {
-		if progress != nil {
-			close(*progress)
-		}
+		tracker.done(err)
 	}()
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	var infile *os.File
 	var fileSize int64
+	var mtime time.Time
 
 	info, err := os.Stat(srcpath)
 	if err == nil {
 		fileSize = info.Size()
+		mtime = info.ModTime()
 	}
 
 	infile, err = os.OpenFile(srcpath, os.O_RDONLY, 0666)
@@ -1667,16 +2291,164 @@ func (m *Mega) UploadFile(srcpath string, parent *Node, name string, progress *c
 		}
 	}()
 
-	if name == "" {
-		name = filepath.Base(srcpath)
+	fp, src, err := m.fingerprintFile(infile, fileSize, mtime)
+	if err != nil {
+		return nil, err
+	}
+	if src != nil {
+		node, err = m.CopyContext(ctx, src, parent, name)
+		// upload it after all if the file has just been deleted
+		if !errors.Is(err, ENOENT) {
+			if err == nil {
+				tracker.start(fileSize, fileSize)
+			}
+			return node, err
+		}
 	}
 
-	u, err := m.NewUpload(parent, name, fileSize)
+	u, err := m.NewUploadContext(ctx, parent, name, fileSize)
 	if err != nil {
 		return nil, err
 	}
+	u.SetFingerprint(fp)
+	u.SetRateLimiter(opts.RateLimiter)
 
-	workch := make(chan int)
+	return m.uploadChunks(ctx, u, func(chk_start int64, chunk []byte) error {
+		n, err := infile.ReadAt(chunk, chk_start)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n != len(chunk) {
+			return errors.New("chunk too short")
+		}
+		return nil
+	}, tracker)
+}
+
+// UploadReader uploads size bytes read from r as name into parent.
+//
+// If size is negative r is read to the end and spooled first, in
+// memory up to the limit set by SetSpoolMemory and then in a
+// temporary file, as the size must be known before uploading.
+func (m *Mega) UploadReader(ctx context.Context, r io.Reader, size int64, parent *Node, name string) (node *Node, err error) {
+	return m.UploadReaderWithOptions(ctx, r, size, parent, name, nil)
+}
+
+// UploadReaderWithOptions is like UploadReader with the options in
+// opts, which may be nil.
+func (m *Mega) UploadReaderWithOptions(ctx context.Context, r io.Reader, size int64, parent *Node, name string, opts *UploadFileOptions) (node *Node, err error) {
+	if r == nil || name == "" {
+		return nil, EARGS
+	}
+	if opts == nil {
+		opts = &UploadFileOptions{}
+	}
+	if size < 0 {
+		sp, err := m.spool(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			e := sp.Close()
+			if err == nil {
+				err = e
+			}
+		}()
+		return m.uploadReaderAt(ctx, sp, sp.Size(), parent, name, opts)
+	}
+
+	tracker := m.newProgressTracker(opts.Reporter, opts.Progress, name, true)
+	defer func() {
+		tracker.done(err)
+	}()
+	u, err := m.NewUploadContext(ctx, parent, name, size)
+	if err != nil {
+		return nil, err
+	}
+	u.SetRateLimiter(opts.RateLimiter)
+	r = &contextReader{ctx: ctx, r: r}
+	return m.uploadChunks(ctx, u, func(chk_start int64, chunk []byte) error {
+		_, err := io.ReadFull(r, chunk)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("upload stream shorter than %d bytes: %w", size, err)
+		}
+		if err != nil {
+			return err
+		}
+		if chk_start+int64(len(chunk)) == size {
+			// check there is no more data
+			n, _ := io.ReadFull(r, make([]byte, 1))
+			if n != 0 {
+				return fmt.Errorf("upload stream longer than %d bytes: %w", size, EARGS)
+			}
+		}
+		return nil
+	}, tracker)
+}
+
+// uploadReaderAt uploads size bytes from r as name into parent
+func (m *Mega) uploadReaderAt(ctx context.Context, r io.ReaderAt, size int64, parent *Node, name string, opts *UploadFileOptions) (node *Node, err error) {
+	tracker := m.newProgressTracker(opts.Reporter, opts.Progress, name, true)
+	defer func() {
+		tracker.done(err)
+	}()
+	u, err := m.NewUploadContext(ctx, parent, name, size)
+	if err != nil {
+		return nil, err
+	}
+	u.SetRateLimiter(opts.RateLimiter)
+	return u.uploadReaderAt(ctx, r, tracker)
+}
+
+// UploadReaderAt uploads the chunks of u which haven't been
+// acknowledged by the server, reading them from r, then finishes the
+// upload and returns the new node.
+//
+// Use this to complete an Upload made by ResumeUpload.
+func (u *Upload) UploadReaderAt(ctx context.Context, r io.ReaderAt) (node *Node, err error) {
+	tracker := u.m.newProgressTracker(nil, nil, u.name, true)
+	defer func() {
+		tracker.done(err)
+	}()
+	return u.uploadReaderAt(ctx, r, tracker)
+}
+
+// uploadReaderAt uploads the chunks of u from r reporting the progress
+// to tracker
+func (u *Upload) uploadReaderAt(ctx context.Context, r io.ReaderAt, tracker *progressTracker) (*Node, error) {
+	return u.m.uploadChunks(ctx, u, func(chk_start int64, chunk []byte) error {
+		n, err := r.ReadAt(chunk, chk_start)
+		if err == io.EOF && n == len(chunk) {
+			err = nil
+		}
+		return err
+	}, tracker)
+}
+
+// uploadChunks uploads the chunks of u using the upload workers and
+// finishes it, returning the new node.
+//
+// The chunks are read in order by calling read with the position and
+// a buffer of the size of each. Chunks already acknowledged are
+// skipped. The progress is reported to tracker, which may be nil.
+func (m *Mega) uploadChunks(ctx context.Context, u *Upload, read func(chk_start int64, chunk []byte) error, tracker *progressTracker) (*Node, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var resumed int64
+	for id := 0; id < u.Chunks(); id++ {
+		if u.ChunkDone(id) {
+			_, chk_size, _ := u.ChunkLocation(id)
+			resumed += int64(chk_size)
+		}
+	}
+	tracker.start(u.size, resumed)
+
+	type job struct {
+		id    int
+		chunk *[]byte
+	}
+	workch := make(chan job)
 	errch := make(chan error, m.ul_workers)
 	wg := sync.WaitGroup{}
 
@@ -1687,242 +2459,147 @@ func (m *Mega) UploadFile(srcpath string, parent *Node, name string, progress *c
 		go func() {
 			defer wg.Done()
 
-			for id := range workch {
-				chk_start, chk_size, err := u.ChunkLocation(id)
+			for j := range workch {
+				size := len(*j.chunk)
+				err := u.uploadChunk(ctx, j.id, *j.chunk, tracker.chunkRetry(j.id, size))
+				putBuffer(j.chunk)
 				if err != nil {
 					errch <- err
 					return
 				}
-				chunk := make([]byte, chk_size)
-				n, err := infile.ReadAt(chunk, chk_start)
-				if err != nil && err != io.EOF {
-					errch <- err
-					return
-				}
-				if n != len(chunk) {
-					errch <- errors.New("chunk too short")
-					return
-				}
 
-				err = u.UploadChunk(id, chunk)
-				if err != nil {
-					errch <- err
-					return
-				}
-
-				if progress != nil {
-					*progress <- chk_size
-				}
+				tracker.chunkDone(j.id, size)
 			}
 		}()
 	}
 
-	// Place chunk download jobs to chan
-	err = nil
+	// Read the chunks and place upload jobs to chan
+	var err error
 	for id := 0; id < u.Chunks() && err == nil; {
+		if u.ChunkDone(id) {
+			id++
+			continue
+		}
+		var chk_start int64
+		var chk_size int
+		chk_start, chk_size, err = u.ChunkLocation(id)
+		if err != nil {
+			break
+		}
+		chunk := getBuffer(chk_size)
+		err = read(chk_start, *chunk)
+		if err != nil {
+			putBuffer(chunk)
+			break
+		}
 		select {
-		case workch <- id:
+		case workch <- job{id, chunk}:
 			id++
 		case err = <-errch:
+			putBuffer(chunk)
+		case <-ctx.Done():
+			err = ctx.Err()
+			putBuffer(chunk)
 		}
 	}
 
 	close(workch)
+	if err != nil {
+		cancel()
+	}
 
 	wg.Wait()
 
+	// a worker may have failed after the last job was placed
+	if err == nil {
+		select {
+		case err = <-errch:
+		default:
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return u.Finish()
+	return u.FinishContext(ctx)
 }
 
 // Move a file from one location to another
 func (m *Mega) Move(src *Node, parent *Node) error {
-	m.FS.mutex.Lock()
-	defer m.FS.mutex.Unlock()
-
-	if src == nil || parent == nil {
-		return EARGS
-	}
-	var msg [1]MoveFileMsg
-	var err error
-
-	msg[0].Cmd = "m"
-	msg[0].N = src.hash
-	msg[0].T = parent.hash
-	msg[0].I, err = randString(10)
-	if err != nil {
-		return err
-	}
-
-	request, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
-	_, err = m.api_request(request)
-	if err != nil {
-		return err
-	}
-
-	if src.parent != nil {
-		src.parent.removeChild(src)
-	}
-
-	parent.addChild(src)
-	src.parent = parent
+	return m.MoveContext(context.Background(), src, parent)
+}
 
-	return nil
+// MoveContext is like Move but with a context
+func (m *Mega) MoveContext(ctx context.Context, src *Node, parent *Node) error {
+	b := m.NewBatch()
+	return b.execOne(ctx, b.Move(src, parent))
 }
 
 // Rename a file or folder
 func (m *Mega) Rename(src *Node, name string) error {
-	m.FS.mutex.Lock()
-	defer m.FS.mutex.Unlock()
-
-	if src == nil {
-		return EARGS
-	}
-	var msg [1]FileAttrMsg
-
-	master_aes, err := aes.NewCipher(m.k)
-	if err != nil {
-		return err
-	}
-	attr := FileAttr{name}
-	attr_data, err := encryptAttr(src.meta.key, attr)
-	if err != nil {
-		return err
-	}
-	key := make([]byte, len(src.meta.compkey))
-	err = blockEncrypt(master_aes, key, src.meta.compkey)
-	if err != nil {
-		return err
-	}
-
-	msg[0].Cmd = "a"
-	msg[0].Attr = attr_data
-	msg[0].Key = base64urlencode(key)
-	msg[0].N = src.hash
-	msg[0].I, err = randString(10)
-	if err != nil {
-		return err
-	}
+	return m.RenameContext(context.Background(), src, name)
+}
 
-	req, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
-	_, err = m.api_request(req)
-	if err != nil {
-		return err
-	}
+// RenameContext is like Rename but with a context
+func (m *Mega) RenameContext(ctx context.Context, src *Node, name string) error {
+	b := m.NewBatch()
+	return b.execOne(ctx, b.Rename(src, name))
+}
 
-	src.name = name
+// SetAttr replaces the attributes of src with attr, which should come
+// from its GetAttr so the attributes not being changed are kept
+func (m *Mega) SetAttr(src *Node, attr FileAttr) error {
+	return m.SetAttrContext(context.Background(), src, attr)
+}
 
-	return nil
+// SetAttrContext is like SetAttr but with a context
+func (m *Mega) SetAttrContext(ctx context.Context, src *Node, attr FileAttr) error {
+	b := m.NewBatch()
+	return b.execOne(ctx, b.SetAttr(src, attr))
 }
 
 // Create a directory in the filesystem
 func (m *Mega) CreateDir(name string, parent *Node) (*Node, error) {
-	m.FS.mutex.Lock()
-	defer m.FS.mutex.Unlock()
-
-	if parent == nil {
-		return nil, EARGS
-	}
-	var msg [1]UploadCompleteMsg
-	var res [1]UploadCompleteResp
-
-	compkey := []uint32{0, 0, 0, 0, 0, 0}
-	for i := range compkey {
-		compkey[i] = uint32(mrand.Int31())
-	}
-
-	master_aes, err := aes.NewCipher(m.k)
-	if err != nil {
-		return nil, err
-	}
-	attr := FileAttr{name}
-	ukey, err := a32_to_bytes(compkey[:4])
-	if err != nil {
-		return nil, err
-	}
-	attr_data, err := encryptAttr(ukey, attr)
-	if err != nil {
-		return nil, err
-	}
-	key := make([]byte, len(ukey))
-	err = blockEncrypt(master_aes, key, ukey)
-	if err != nil {
-		return nil, err
-	}
+	return m.CreateDirContext(context.Background(), name, parent)
+}
 
-	msg[0].Cmd = "p"
-	msg[0].T = parent.hash
-	msg[0].N[0].H = "xxxxxxxx"
-	msg[0].N[0].T = FOLDER
-	msg[0].N[0].A = attr_data
-	msg[0].N[0].K = base64urlencode(key)
-	msg[0].I, err = randString(10)
+// CreateDirContext is like CreateDir but with a context
+func (m *Mega) CreateDirContext(ctx context.Context, name string, parent *Node) (*Node, error) {
+	b := m.NewBatch()
+	r := b.CreateDir(name, parent)
+	err := b.execOne(ctx, r)
 	if err != nil {
 		return nil, err
 	}
+	return r.Node, nil
+}
 
-	req, err := json.Marshal(msg)
-	if err != nil {
-		return nil, err
-	}
-	result, err := m.api_request(req)
-	if err != nil {
-		return nil, err
-	}
+// Copy copies the file src into parent as name, or with the name of src
+// if name is empty, without transferring its contents
+func (m *Mega) Copy(src *Node, parent *Node, name string) (*Node, error) {
+	return m.CopyContext(context.Background(), src, parent, name)
+}
 
-	err = json.Unmarshal(result, &res)
+// CopyContext is like Copy but with a context
+func (m *Mega) CopyContext(ctx context.Context, src *Node, parent *Node, name string) (*Node, error) {
+	b := m.NewBatch()
+	r := b.Copy(src, parent, name)
+	err := b.execOne(ctx, r)
 	if err != nil {
 		return nil, err
 	}
-	node, err := m.addFSNode(res[0].F[0])
-
-	return node, err
+	return r.Node, nil
 }
 
 // Delete a file or directory from filesystem
 func (m *Mega) Delete(node *Node, destroy bool) error {
-	if node == nil {
-		return EARGS
-	}
-	if !destroy {
-		return m.Move(node, m.FS.trash)
-	}
-
-	m.FS.mutex.Lock()
-	defer m.FS.mutex.Unlock()
-
-	var msg [1]FileDeleteMsg
-	var err error
-	msg[0].Cmd = "d"
-	msg[0].N = node.hash
-	msg[0].I, err = randString(10)
-	if err != nil {
-		return err
-	}
-
-	req, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
-	_, err = m.api_request(req)
-	if err != nil {
-		return err
-	}
-
-	parent := m.FS.lookup[node.hash]
-	parent.removeChild(node)
-	delete(m.FS.lookup, node.hash)
+	return m.DeleteContext(context.Background(), node, destroy)
+}
 
-	return nil
+// DeleteContext is like Delete but with a context
+func (m *Mega) DeleteContext(ctx context.Context, node *Node, destroy bool) error {
+	b := m.NewBatch()
+	return b.execOne(ctx, b.Delete(node, destroy))
 }
 
 // process an add node event
@@ -1961,11 +2638,10 @@ func (m *Mega) processUpdateNode(evRaw []byte) error {
 		return ENOENT
 	}
 	attr, err := decryptAttr(node.meta.key, ev.Attr)
-	if err == nil {
-		node.name = attr.Name
-	} else {
-		node.name = "BAD ATTRIBUTE"
+	if err != nil {
+		attr = FileAttr{Name: "BAD ATTRIBUTE"}
 	}
+	m.FS.setAttr(node, attr)
 
 	node.ts = time.Unix(ev.Ts, 0)
 	return nil
@@ -1986,202 +2662,203 @@ func (m *Mega) processDeleteNode(evRaw []byte) error {
 	if node != nil && node.parent != nil {
 		node.parent.removeChild(node)
 		delete(m.FS.lookup, node.hash)
+		m.FS.unindex(node)
 	}
 	return nil
 }
 
 // Listen for server event notifications and play actions
 func (m *Mega) pollEvents() {
-	var err error
-	var resp *http.Response
+	ctx := context.Background()
 	sleepTime := minSleepTime // initial backoff time
 	for {
+		start := time.Now()
+		events, err := m.pollEventsOnce()
+		m.getTracer().PollEvents(ctx, &PollEventsInfo{
+			Start:    start,
+			Duration: time.Since(start),
+			Events:   events,
+			Err:      err,
+		})
 		if err != nil {
-			m.debugf("pollEvents: error from server", err)
-			backOffSleep(&sleepTime)
+			m.debugf("pollEvents: error from server: %v", err)
+			_ = backOffSleep(ctx, &sleepTime)
 		} else {
 			// reset sleep time to minimum on success
 			sleepTime = minSleepTime
 		}
+	}
+}
+
+// pollEventsOnce fetches and plays one set of server events,
+// returning the number of events received. An error means the next
+// fetch should be delayed.
+func (m *Mega) pollEventsOnce() (n int, err error) {
+	url := fmt.Sprintf("%s/sc?sn=%s&sid=%s", m.baseurl, m.ssn, m.sid)
+	resp, err := m.client.Post(url, "application/xml", nil)
+	if err != nil {
+		m.logf("pollEvents: Error fetching status: %s", err)
+		return 0, err
+	}
 
-		url := fmt.Sprintf("%s/sc?sn=%s&sid=%s", m.baseurl, m.ssn, m.sid)
-		resp, err = m.client.Post(url, "application/xml", nil)
+	if resp.StatusCode != 200 {
+		m.logf("pollEvents: Error from server: %s", resp.Status)
+		_ = resp.Body.Close()
+		return 0, newHTTPError(resp)
+	}
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		m.logf("pollEvents: Error reading body: %v", err)
+		_ = resp.Body.Close()
+		return 0, err
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		m.logf("pollEvents: Error closing body: %v", err)
+		return 0, err
+	}
+
+	// body is read and closed here
+
+	// First attempt to parse an array
+	var events Events
+	err = json.Unmarshal(buf, &events)
+	if err != nil {
+		// Try parsing as a lone error message
+		var emsg ErrorMsg
+		err = json.Unmarshal(buf, &emsg)
 		if err != nil {
-			m.logf("pollEvents: Error fetching status: %s", err)
-			continue
+			m.logf("pollEvents: Bad response received from server: %s", buf)
+			return 0, EBADRESP
 		}
-
-		if resp.StatusCode != 200 {
-			m.logf("pollEvents: Error from server: %s", resp.Status)
-			_ = resp.Body.Close()
-			continue
+		err = parseError(emsg)
+		if err != nil && err != EAGAIN {
+			m.logf("pollEvents: Error received from server: %v", err)
 		}
+		return 0, err
+	}
 
-		buf, err := io.ReadAll(resp.Body)
-		if err != nil {
-			m.logf("pollEvents: Error reading body: %v", err)
-			_ = resp.Body.Close()
-			continue
+	// if wait URL is set, then fetch it and return - we
+	// don't expect anything else if we have a wait URL.
+	if events.W != "" {
+		m.waitEventsFire()
+		if len(events.E) > 0 {
+			m.logf("pollEvents: Unexpected event with w set: %s", buf)
 		}
-		err = resp.Body.Close()
+		resp, err = m.client.Get(events.W)
 		if err != nil {
-			m.logf("pollEvents: Error closing body: %v", err)
-			continue
+			return 0, err
 		}
+		_ = resp.Body.Close()
+		return 0, nil
+	}
+	m.ssn = events.Sn
 
-		// body is read and closed here
-
-		// First attempt to parse an array
-		var events Events
-		err = json.Unmarshal(buf, &events)
-		if err != nil {
-			// Try parsing as a lone error message
-			var emsg ErrorMsg
-			err = json.Unmarshal(buf, &emsg)
+	// For each event in the array, parse it
+	for _, evRaw := range events.E {
+		// First attempt to unmarshal as an error message
+		var emsg ErrorMsg
+		err = json.Unmarshal(evRaw, &emsg)
+		if err == nil {
+			m.logf("pollEvents: Error message received %s", evRaw)
+			err = parseError(emsg)
 			if err != nil {
-				m.logf("pollEvents: Bad response received from server: %s", buf)
-			} else {
-				err = parseError(emsg)
-				if err == EAGAIN {
-				} else if err != nil {
-					m.logf("pollEvents: Error received from server: %v", err)
-				}
+				m.logf("pollEvents: Event from server was error: %v", err)
 			}
 			continue
 		}
 
-		// if wait URL is set, then fetch it and continue - we
-		// don't expect anything else if we have a wait URL.
-		if events.W != "" {
-			m.waitEventsFire()
-			if len(events.E) > 0 {
-				m.logf("pollEvents: Unexpected event with w set: %s", buf)
-			}
-			resp, err = m.client.Get(events.W)
-			if err == nil {
-				_ = resp.Body.Close()
-			}
+		// Now unmarshal as a generic event
+		var gev GenericEvent
+		err = json.Unmarshal(evRaw, &gev)
+		if err != nil {
+			m.logf("pollEvents: Couldn't parse event from server: %v: %s", err, evRaw)
 			continue
 		}
-		m.ssn = events.Sn
-
-		// For each event in the array, parse it
-		for _, evRaw := range events.E {
-			// First attempt to unmarshal as an error message
-			var emsg ErrorMsg
-			err = json.Unmarshal(evRaw, &emsg)
-			if err == nil {
-				m.logf("pollEvents: Error message received %s", evRaw)
-				err = parseError(emsg)
-				if err != nil {
-					m.logf("pollEvents: Event from server was error: %v", err)
-				}
-				continue
-			}
+		m.debugf("pollEvents: Parsing event %q: %s", gev.Cmd, evRaw)
+
+		// Work out what to do with the event
+		var process func([]byte) error
+		switch gev.Cmd {
+		case "t": // node addition
+			process = m.processAddNode
+		case "u": // node update
+			process = m.processUpdateNode
+		case "d": // node deletion
+			process = m.processDeleteNode
+		case "s", "s2": // share addition/update/revocation
+		case "c": // contact addition/update
+		case "k": // crypto key request
+		case "fa": // file attribute update
+		case "ua": // user attribute update
+		case "psts": // account updated
+		case "ipc": // incoming pending contact request (to us)
+		case "opc": // outgoing pending contact request (from us)
+		case "upci": // incoming pending contact request update (accept/deny/ignore)
+		case "upco": // outgoing pending contact request update (from them, accept/deny/ignore)
+		case "ph": // public links handles
+		case "se": // set email
+		case "mcc": // chat creation / peer's invitation / peer's removal
+		case "mcna": // granted / revoked access to a node
+		case "uac": // user access control
+		default:
+			m.debugf("pollEvents: Unknown message %q received: %s", gev.Cmd, evRaw)
+		}
 
-			// Now unmarshal as a generic event
-			var gev GenericEvent
-			err = json.Unmarshal(evRaw, &gev)
+		// process the event if we can
+		if process != nil {
+			err := process(evRaw)
 			if err != nil {
-				m.logf("pollEvents: Couldn't parse event from server: %v: %s", err, evRaw)
-				continue
-			}
-			m.debugf("pollEvents: Parsing event %q: %s", gev.Cmd, evRaw)
-
-			// Work out what to do with the event
-			var process func([]byte) error
-			switch gev.Cmd {
-			case "t": // node addition
-				process = m.processAddNode
-			case "u": // node update
-				process = m.processUpdateNode
-			case "d": // node deletion
-				process = m.processDeleteNode
-			case "s", "s2": // share addition/update/revocation
-			case "c": // contact addition/update
-			case "k": // crypto key request
-			case "fa": // file attribute update
-			case "ua": // user attribute update
-			case "psts": // account updated
-			case "ipc": // incoming pending contact request (to us)
-			case "opc": // outgoing pending contact request (from us)
-			case "upci": // incoming pending contact request update (accept/deny/ignore)
-			case "upco": // outgoing pending contact request update (from them, accept/deny/ignore)
-			case "ph": // public links handles
-			case "se": // set email
-			case "mcc": // chat creation / peer's invitation / peer's removal
-			case "mcna": // granted / revoked access to a node
-			case "uac": // user access control
-			default:
-				m.debugf("pollEvents: Unknown message %q received: %s", gev.Cmd, evRaw)
-			}
-
-			// process the event if we can
-			if process != nil {
-				err := process(evRaw)
-				if err != nil {
-					m.logf("pollEvents: Error processing event %q '%s': %v", gev.Cmd, evRaw, err)
-				}
+				m.logf("pollEvents: Error processing event %q '%s': %v", gev.Cmd, evRaw, err)
 			}
 		}
 	}
+	return len(events.E), nil
 }
 
-func (m *Mega) getLink(n *Node) (string, error) {
-	var msg [1]GetLinkMsg
-	var res [1]string
-
-	msg[0].Cmd = "l"
-	msg[0].N = n.GetHash()
-
-	req, err := json.Marshal(msg)
-	if err != nil {
-		return "", err
-	}
-	result, err := m.api_request(req)
-	if err != nil {
-		return "", err
-	}
-	err = json.Unmarshal(result, &res)
-	if err != nil {
-		return "", err
-	}
-	return res[0], nil
+// Exports public link for node, with or without decryption key included.
+// See Batch.Link for how folders are linked.
+func (m *Mega) Link(n *Node, includeKey bool) (string, error) {
+	return m.LinkContext(context.Background(), n, includeKey)
 }
 
-// Exports public link for node, with or without decryption key included
-func (m *Mega) Link(n *Node, includeKey bool) (string, error) {
-	id, err := m.getLink(n)
+// LinkContext is like Link but with a context
+func (m *Mega) LinkContext(ctx context.Context, n *Node, includeKey bool) (string, error) {
+	b := m.NewBatch()
+	r := b.Link(n, includeKey)
+	err := b.execOne(ctx, r)
 	if err != nil {
 		return "", err
 	}
-	if includeKey {
-		m.FS.mutex.Lock()
-		key := base64urlencode(n.meta.compkey)
-		m.FS.mutex.Unlock()
-		return fmt.Sprintf("%v/#!%v!%v", BASE_DOWNLOAD_URL, id, key), nil
-	} else {
-		return fmt.Sprintf("%v/#!%v", BASE_DOWNLOAD_URL, id), nil
-	}
+	return r.Link, nil
 }
 
 // addRequestHeaders adds standard headers to a request
-func addRequestHeaders(req *http.Request) {
-	userAgent := os.Getenv("X_MEGA_USER_AGENT")
-	if userAgent != "" || X_MEGA_USER_AGENT != "" {
-		req.Header.Set("User-Agent", userAgent)
+func (m *Mega) addRequestHeaders(req *http.Request) {
+	if m.userAgent != "" {
+		req.Header.Set("User-Agent", m.userAgent)
 	}
 	req.Header.Set("Content-Type", "application/json")
 }
 
 // addHashCashRequestHeaders adds standard headers and hashcash headers to a request
-func addHashCashRequestHeaders(req *http.Request, token string, cashValue string) {
-	addRequestHeaders(req)
+func (m *Mega) addHashCashRequestHeaders(req *http.Request, token string, cashValue string) {
+	m.addRequestHeaders(req)
 	if token != "" && cashValue != "" {
 		req.Header.Set("X-Hashcash", fmt.Sprintf("1:%s:%s", token, cashValue))
 	}
 }
 
+// getUserAgent returns the default user agent for API requests
+func getUserAgent() string {
+	userAgent := os.Getenv("X_MEGA_USER_AGENT")
+	if userAgent == "" {
+		return X_MEGA_USER_AGENT
+	}
+	return userAgent
+}
+
 // getAPIBaseURL returns the base URL for API requests
 func getAPIBaseURL() string {
 	url := os.Getenv("X_MEGA_API_URL")
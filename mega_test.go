@@ -1,21 +1,63 @@
 package mega
 
 import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/t3rm1n4l/go-mega/megatest"
 )
 
 var USER string = os.Getenv("X_MEGA_USER")
 var PASSWORD string = os.Getenv("X_MEGA_PASSWORD")
 
+// fakeServer is used instead of the real service if no credentials
+// are supplied
+var fakeServer *megatest.Server
+
+func TestMain(m *testing.M) {
+	if USER == "" || PASSWORD == "" {
+		fakeServer = megatest.NewTLSServer()
+		USER, PASSWORD = "test@example.com", "password"
+		if err := fakeServer.AddUser(USER, PASSWORD); err != nil {
+			panic(err)
+		}
+	}
+	code := m.Run()
+	if fakeServer != nil {
+		fakeServer.Close()
+	}
+	os.Exit(code)
+}
+
+// newMega makes a new client pointing at the fake server if in use
+func newMega() *Mega {
+	if fakeServer == nil {
+		return New()
+	}
+	m, err := NewWithOptions(WithAPIURL(fakeServer.URL), WithHTTPClient(fakeServer.Client()))
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
 // retry runs fn until it succeeds, using what to log and retrying on
 // EAGAIN.  It uses exponential backoff
 func retry(t *testing.T, what string, fn func() error) {
@@ -27,7 +69,7 @@ func retry(t *testing.T, what string, fn func() error) {
 		if err == nil {
 			return
 		}
-		if err != EAGAIN {
+		if !errors.Is(err, EAGAIN) {
 			break
 		}
 		t.Logf("%s failed %d/%d - retrying after %v sleep", what, i, maxTries, sleep)
@@ -37,15 +79,15 @@ func retry(t *testing.T, what string, fn func() error) {
 	t.Fatalf("%s failed: %v", what, err)
 }
 
-func skipIfNoCredentials(t *testing.T) {
-	if USER == "" || PASSWORD == "" {
-		t.Skip("X_MEGA_USER and X_MEGA_PASSWD not set - skipping integration tests")
+// needFakeServer skips tests which need to inject failures
+func needFakeServer(t *testing.T) {
+	if fakeServer == nil {
+		t.Skip("Test needs the fake server")
 	}
 }
 
 func initSession(t *testing.T) *Mega {
-	skipIfNoCredentials(t)
-	m := New()
+	m := newMega()
 	// m.SetDebugger(log.Printf)
 	retry(t, "Login", func() error {
 		return m.Login(USER, PASSWORD)
@@ -134,9 +176,7 @@ func fileMD5(t *testing.T, name string) string {
 }
 
 func TestLogin(t *testing.T) {
-	skipIfNoCredentials(t)
-
-	m := New()
+	m := newMega()
 	retry(t, "Login", func() error {
 		return m.Login(USER, PASSWORD)
 	})
@@ -267,9 +307,7 @@ func TestCreateDir(t *testing.T) {
 }
 
 func TestConfig(t *testing.T) {
-	skipIfNoCredentials(t)
-
-	m := New()
+	m := newMega()
 	m.SetAPIUrl("http://invalid.domain")
 	err := m.Login(USER, PASSWORD)
 	if err == nil {
@@ -433,3 +471,1591 @@ func TestWaitEvents(t *testing.T) {
 	// Check nothing happens if we fire the event with no listeners
 	m.waitEventsFire()
 }
+
+func TestContextCancel(t *testing.T) {
+	m := newMega()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := m.LoginContext(ctx, USER, PASSWORD)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	// The retries against a bad url would take many seconds
+	m.SetAPIUrl("http://invalid.domain")
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = m.LoginContext(ctx, USER, PASSWORD)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Login took too long to be cancelled: %v", elapsed)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	session := initSession(t)
+	root := session.FS.GetRoot()
+	dir := createDir(t, session, "batchdir", root)
+	node1, _, _ := uploadFile(t, session, 31, root)
+	node2, _, _ := uploadFile(t, session, 31, root)
+
+	b := session.NewBatch()
+	rMkdir := b.CreateDir("batchdir2", root)
+	rMove := b.Move(node1, dir)
+	rRename := b.Rename(node2, "batchname.txt")
+	rBad := b.Move(&Node{hash: "notfound"}, dir)
+	rLink := b.Link(node2, true)
+	if b.Len() != 5 {
+		t.Fatalf("Expected 5 queued commands, got %d", b.Len())
+	}
+	err := b.Exec()
+	if err != nil {
+		t.Fatal("Batch exec failed", err)
+	}
+	if b.Len() != 0 {
+		t.Error("Expected batch to be empty after Exec")
+	}
+
+	for i, r := range []*BatchResult{rMkdir, rMove, rRename, rLink} {
+		if r.Err != nil {
+			t.Errorf("Command %d failed: %v", i, r.Err)
+		}
+	}
+	if !errors.Is(rBad.Err, ENOENT) {
+		t.Errorf("Expected ENOENT for missing node, got %v", rBad.Err)
+	}
+	if rMkdir.Node == nil || rMkdir.Node.GetName() != "batchdir2" {
+		t.Error("CreateDir didn't return the new node")
+	}
+	if rLink.Link == "" {
+		t.Error("Link didn't return a link")
+	}
+
+	session.FS.mutex.Lock()
+	if node1.parent != dir {
+		t.Error("Move happened to wrong parent")
+	}
+	if node2.name != "batchname.txt" {
+		t.Error("Renamed to wrong name", node2.name)
+	}
+	session.FS.mutex.Unlock()
+}
+
+func TestMegaError(t *testing.T) {
+	needFakeServer(t)
+	session := initSession(t)
+	node, _, _ := uploadFile(t, session, 31, session.FS.GetRoot())
+
+	fakeServer.FailCommands("m", -17, 1)
+	err := session.Move(node, session.FS.GetTrash())
+	if !errors.Is(err, EOVERQUOTA) {
+		t.Errorf("Expected EOVERQUOTA, got %v", err)
+	}
+	var merr *MegaError
+	if !errors.As(err, &merr) {
+		t.Fatalf("Expected *MegaError, got %T", err)
+	}
+	if merr.Cmd != "m" || merr.Code != -17 || merr.Retryable {
+		t.Errorf("Wrong error details %#v", merr)
+	}
+
+	session.SetRetries(2)
+	fakeServer.FailRequests("/dl/", 503, 3)
+	d, err := session.NewDownload(node)
+	if err != nil {
+		t.Fatal("NewDownload failed", err)
+	}
+	_, err = d.DownloadChunk(0)
+	if !errors.As(err, &merr) {
+		t.Fatalf("Expected *MegaError, got %T: %v", err, err)
+	}
+	if merr.Status != 503 || merr.Attempts != 3 || !merr.Retryable || merr.URL == "" {
+		t.Errorf("Wrong error details %#v", merr)
+	}
+}
+
+// countingPolicy retries everything immediately up to max attempts
+type countingPolicy struct {
+	mu    sync.Mutex
+	max   int
+	calls int
+}
+
+func (p *countingPolicy) Retry(attempts int, elapsed time.Duration, err *MegaError) (bool, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	return attempts < p.max, 0
+}
+
+func TestRetryPolicy(t *testing.T) {
+	needFakeServer(t)
+	session := initSession(t)
+
+	// Rate limiting is retried by the default policy
+	fakeServer.FailCommands("uq", -4, 2)
+	_, err := session.GetQuota()
+	if err != nil {
+		t.Fatal("GetQuota failed", err)
+	}
+
+	policy := &countingPolicy{max: 3}
+	session.SetRetryPolicy(policy)
+	defer session.SetRetryPolicy(nil)
+	fakeServer.FailRequests("/cs", 500, 3)
+	_, err = session.GetQuota()
+	var merr *MegaError
+	if !errors.As(err, &merr) {
+		t.Fatalf("Expected *MegaError, got %T: %v", err, err)
+	}
+	if merr.Status != 500 || merr.Attempts != 3 || policy.calls != 3 {
+		t.Errorf("Wrong retries: %#v, %d calls", merr, policy.calls)
+	}
+}
+
+func TestConcurrentAPIRequests(t *testing.T) {
+	needFakeServer(t)
+	session := initSession(t)
+	if err := session.SetAPIWorkers(0); err != EARGS {
+		t.Errorf("Expected EARGS, got %v", err)
+	}
+	if err := session.SetAPIWorkers(100); err != EWORKER_LIMIT_EXCEEDED {
+		t.Errorf("Expected EWORKER_LIMIT_EXCEEDED, got %v", err)
+	}
+	if err := session.SetAPIWorkers(4); err != nil {
+		t.Fatal(err)
+	}
+
+	const latency = 200 * time.Millisecond
+	fakeServer.SetLatency(latency)
+	defer fakeServer.SetLatency(0)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = session.GetQuota()
+		}()
+	}
+	// the limit can be changed while requests are in flight
+	if err := session.SetAPIWorkers(4); err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal("GetQuota failed", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= 4*latency {
+		t.Errorf("Requests weren't run concurrently, took %v", elapsed)
+	}
+	if n := fakeServer.MaxInflight(); n < 2 {
+		t.Errorf("Expected concurrent requests at the server, max was %d", n)
+	}
+}
+
+// recordingTracer records the callbacks made
+type recordingTracer struct {
+	NopTracer
+	mu       sync.Mutex
+	api      []APIAttemptInfo
+	chunks   []ChunkTransferInfo
+	pollDone chan struct{}
+}
+
+func (r *recordingTracer) APIAttempt(ctx context.Context, info *APIAttemptInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.api = append(r.api, *info)
+}
+
+func (r *recordingTracer) ChunkTransfer(ctx context.Context, info *ChunkTransferInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.chunks = append(r.chunks, *info)
+}
+
+func (r *recordingTracer) PollEvents(ctx context.Context, info *PollEventsInfo) {
+	if info.Err == nil && info.Events > 0 {
+		select {
+		case r.pollDone <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	needFakeServer(t)
+	tracer := &recordingTracer{pollDone: make(chan struct{}, 1)}
+	session, err := NewWithOptions(
+		WithAPIURL(fakeServer.URL),
+		WithHTTPClient(fakeServer.Client()),
+		WithTracer(tracer),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Login(USER, PASSWORD); err != nil {
+		t.Fatal("Login failed", err)
+	}
+
+	fakeServer.FailRequests("/cs", 500, 1)
+	if _, err := session.GetQuota(); err != nil {
+		t.Fatal("GetQuota failed", err)
+	}
+	tracer.mu.Lock()
+	api := tracer.api[len(tracer.api)-2:]
+	tracer.mu.Unlock()
+	if api[0].Cmd != "uq" || api[0].Attempt != 1 || api[0].Status != 500 || api[0].Err == nil {
+		t.Errorf("Wrong failed attempt %+v", api[0])
+	}
+	if api[1].Cmd != "uq" || api[1].Attempt != 2 || api[1].Status != 200 || api[1].Err != nil || api[1].ResponseBytes == 0 {
+		t.Errorf("Wrong retried attempt %+v", api[1])
+	}
+
+	node, name, _ := uploadFile(t, session, 31, session.FS.root)
+	defer func() {
+		_ = os.Remove(name)
+	}()
+	if err := session.DownloadFile(node, name, nil); err != nil {
+		t.Fatal("Download failed", err)
+	}
+	tracer.mu.Lock()
+	chunks := tracer.chunks
+	tracer.mu.Unlock()
+	if len(chunks) != 2 || !chunks[0].Upload || chunks[1].Upload {
+		t.Fatalf("Wrong chunk transfers %+v", chunks)
+	}
+	for _, c := range chunks {
+		if c.Bytes != 31 || c.Attempts != 1 || c.Err != nil {
+			t.Errorf("Wrong chunk transfer %+v", c)
+		}
+	}
+
+	// the upload is sent back as an event
+	select {
+	case <-tracer.pollDone:
+	case <-time.After(10 * time.Second):
+		t.Error("No events polled")
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	needFakeServer(t)
+	const limit = 100 * 1024
+	session, err := NewWithOptions(
+		WithAPIURL(fakeServer.URL),
+		WithHTTPClient(fakeServer.Client()),
+		WithUploadLimit(limit),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Login(USER, PASSWORD); err != nil {
+		t.Fatal("Login failed", err)
+	}
+
+	// The first second's worth is a burst so this takes about 1s
+	start := time.Now()
+	node, name, _ := uploadFile(t, session, 2*limit, session.FS.root)
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("Upload not limited, took %v", elapsed)
+	}
+	defer func() {
+		_ = os.Remove(name)
+	}()
+
+	// A limit in the options overrides the unlimited downloads
+	session.DownloadLimiter().SetLimit(0)
+	start = time.Now()
+	opts := &DownloadFileOptions{RateLimiter: NewRateLimiter(limit)}
+	if err := session.DownloadFileWithOptions(context.Background(), node, name, opts); err != nil {
+		t.Fatal("Download failed", err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("Download not limited, took %v", elapsed)
+	}
+
+	// and the same for uploads
+	session.UploadLimiter().SetLimit(0)
+	start = time.Now()
+	data := bytes.NewReader(make([]byte, 2*limit))
+	_, err = session.UploadReaderWithOptions(context.Background(), data, -1, session.FS.root, "limited.bin", &UploadFileOptions{RateLimiter: NewRateLimiter(limit)})
+	if err != nil {
+		t.Fatal("Upload failed", err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("Upload not limited by the options, took %v", elapsed)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	session := initSession(t)
+
+	// span several blocks with a partial last block
+	data := make([]byte, 2*readerBlockSize+12345)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "open.bin")
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var node *Node
+	retry(t, "Upload", func() (err error) {
+		node, err = session.UploadFile(name, session.FS.root, "", nil)
+		return err
+	})
+
+	r, err := session.Open(node)
+	if err != nil {
+		t.Fatal("Open failed", err)
+	}
+	if r.Size() != int64(len(data)) {
+		t.Errorf("Wrong size %d", r.Size())
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("Read failed", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Data read mismatch")
+	}
+
+	// Seek to an offset which isn't on an AES block boundary and
+	// read across a block of the reader
+	off := int64(readerBlockSize - 7)
+	if pos, err := r.Seek(off, io.SeekStart); err != nil || pos != off {
+		t.Fatalf("Seek failed: %d, %v", pos, err)
+	}
+	buf := make([]byte, 100)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal("Read after seek failed", err)
+	}
+	if !bytes.Equal(buf, data[off:off+100]) {
+		t.Error("Data mismatch after seek")
+	}
+
+	var wg sync.WaitGroup
+	for _, off := range []int64{3, readerBlockSize + 1, int64(len(data)) - 50} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 50)
+			n, err := r.ReadAt(buf, off)
+			if n != len(buf) || (err != nil && err != io.EOF) {
+				t.Errorf("ReadAt %d failed: %d, %v", off, n, err)
+				return
+			}
+			if !bytes.Equal(buf, data[off:off+50]) {
+				t.Errorf("ReadAt %d data mismatch", off)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := r.ReadAt(buf, int64(len(data))); err != io.EOF {
+		t.Errorf("Expected io.EOF reading at the end, got %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Error("Close failed", err)
+	}
+	if _, err := r.Read(buf); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Expected fs.ErrClosed after Close, got %v", err)
+	}
+}
+
+// readNode reads the contents of node
+func readNode(t *testing.T, session *Mega, node *Node) []byte {
+	t.Helper()
+	r, err := session.Open(node)
+	if err != nil {
+		t.Fatal("Open failed", err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("Read failed", err)
+	}
+	return data
+}
+
+func TestUploadReader(t *testing.T) {
+	session := initSession(t)
+	ctx := context.Background()
+	data := make([]byte, 700000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := session.UploadReader(ctx, bytes.NewReader(data), int64(len(data)), session.FS.root, "known.bin")
+	if err != nil {
+		t.Fatal("UploadReader failed", err)
+	}
+	if node.GetSize() != int64(len(data)) || !bytes.Equal(readNode(t, session, node), data) {
+		t.Error("Known size upload mismatch")
+	}
+
+	// Hide the size of the stream and spool it to a file
+	if err := session.SetSpoolMemory(1000); err != nil {
+		t.Fatal(err)
+	}
+	stream := struct{ io.Reader }{bytes.NewReader(data)}
+	node, err = session.UploadReader(ctx, stream, -1, session.FS.root, "unknown.bin")
+	if err != nil {
+		t.Fatal("UploadReader of unknown size failed", err)
+	}
+	if node.GetSize() != int64(len(data)) || !bytes.Equal(readNode(t, session, node), data) {
+		t.Error("Unknown size upload mismatch")
+	}
+
+	_, err = session.UploadReader(ctx, bytes.NewReader(data), int64(len(data))+1, session.FS.root, "short.bin")
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected io.ErrUnexpectedEOF for short stream, got %v", err)
+	}
+	_, err = session.UploadReader(ctx, bytes.NewReader(data), int64(len(data))-1, session.FS.root, "long.bin")
+	if !errors.Is(err, EARGS) {
+		t.Errorf("Expected EARGS for long stream, got %v", err)
+	}
+}
+
+// chunkCounter counts the chunk transfers made
+type chunkCounter struct {
+	NopTracer
+	mu        sync.Mutex
+	uploads   int
+	downloads int
+}
+
+func (c *chunkCounter) ChunkTransfer(ctx context.Context, info *ChunkTransferInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info.Err != nil {
+		return
+	}
+	if info.Upload {
+		c.uploads++
+	} else {
+		c.downloads++
+	}
+}
+
+func TestUploadChunkRepeated(t *testing.T) {
+	needFakeServer(t)
+	session := initSession(t)
+	data := make([]byte, 300000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.SetRequestSize(128 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	u, err := session.NewUpload(session.FS.root, "repeated.bin", int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Chunks() < 2 {
+		t.Fatalf("Expected several chunks, got %d", u.Chunks())
+	}
+	upload := func(id int) {
+		t.Helper()
+		pos, size, _ := u.ChunkLocation(id)
+		if err := u.UploadChunk(id, data[pos:pos+int64(size)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// sending a chunk again doesn't count towards the rest, even when
+	// as many bytes as the file has are sent
+	for sent := int64(0); sent < int64(len(data)); {
+		_, size, _ := u.ChunkLocation(0)
+		upload(0)
+		sent += int64(size)
+	}
+	if _, err := u.Finish(); err == nil {
+		t.Fatal("Expected Finish to fail with chunks missing")
+	}
+	for id := 1; id < u.Chunks(); id++ {
+		upload(id)
+	}
+	node, err := u.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readNode(t, session, node), data) {
+		t.Error("Uploaded data mismatch")
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	needFakeServer(t)
+	session := initSession(t)
+	data := make([]byte, 1000000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Upload the first half of the chunks then "crash". The token
+	// keeps the chunk layout so session2 needn't set the request size.
+	if err := session.SetRequestSize(512 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	u, err := session.NewUpload(session.FS.root, "resumed.bin", int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := u.Chunks() / 2
+	if half == 0 {
+		t.Fatalf("Expected several chunks, got %d", u.Chunks())
+	}
+	for id := 0; id < half; id++ {
+		pos, size, _ := u.ChunkLocation(id)
+		chunk := append([]byte(nil), data[pos:pos+int64(size)]...)
+		if err := u.UploadChunk(id, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := u.ResumeToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The master key isn't used to seal it directly
+	block, _ := aes.NewCipher(session.k)
+	gcm, _ := cipher.NewGCM(block)
+	sealed, _ := base64urldecode(token)
+	if _, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil); err == nil {
+		t.Error("Resume token sealed with the master key")
+	}
+
+	// A new client for the same account picks up where it left off
+	counter := &chunkCounter{}
+	session2, err := NewWithOptions(WithAPIURL(fakeServer.URL), WithHTTPClient(fakeServer.Client()), WithTracer(counter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session2.Login(USER, PASSWORD); err != nil {
+		t.Fatal("Login failed", err)
+	}
+	u2, err := session2.ResumeUpload(token)
+	if err != nil {
+		t.Fatal("ResumeUpload failed", err)
+	}
+	for id := 0; id < u2.Chunks(); id++ {
+		if u2.ChunkDone(id) != (id < half) {
+			t.Errorf("Wrong ChunkDone for chunk %d", id)
+		}
+	}
+	node, err := u2.UploadReaderAt(context.Background(), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Resumed upload failed", err)
+	}
+	if counter.uploads != u2.Chunks()-half {
+		t.Errorf("Expected %d chunks uploaded, got %d", u2.Chunks()-half, counter.uploads)
+	}
+	if !bytes.Equal(readNode(t, session2, node), data) {
+		t.Error("Resumed upload data mismatch")
+	}
+
+	// The token can't be altered
+	bad := []byte(token)
+	bad[len(bad)/2] ^= 1
+	if _, err := session2.ResumeUpload(string(bad)); !errors.Is(err, EARGS) {
+		t.Errorf("Expected EARGS for corrupt token, got %v", err)
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+	needFakeServer(t)
+	counter := &chunkCounter{}
+	session, err := NewWithOptions(
+		WithAPIURL(fakeServer.URL),
+		WithHTTPClient(fakeServer.Client()),
+		WithTracer(counter),
+		WithDownloadWorkers(1),
+		WithResumableDownloads(true),
+		WithRequestSize(1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Login(USER, PASSWORD); err != nil {
+		t.Fatal("Login failed", err)
+	}
+	data := make([]byte, 1500000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	node, err := session.UploadReader(context.Background(), bytes.NewReader(data), int64(len(data)), session.FS.root, "resume.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := session.NewDownload(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := d.Chunks()
+
+	// Interrupt the download after a few chunks
+	dst := filepath.Join(t.TempDir(), "resume.bin")
+	ctx, cancel := context.WithCancel(context.Background())
+	progress := make(chan int)
+	go func() {
+		n := 0
+		for range progress {
+			if n++; n == 3 {
+				cancel()
+			}
+		}
+	}()
+	err = session.DownloadFileContext(ctx, node, dst, &progress)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	buf, err := os.ReadFile(dst + downloadStateSuffix)
+	if err != nil {
+		t.Fatal("No state file", err)
+	}
+	var state downloadState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		t.Fatal(err)
+	}
+	done := len(state.Chunks)
+	if done < 3 || done >= chunks {
+		t.Fatalf("Expected some chunks done, got %d of %d", done, chunks)
+	}
+
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("Partial download visible at destination: %v", err)
+	}
+
+	// Corrupt the first chunk so it is fetched again
+	f, err := os.OpenFile(dst+downloadPartialSuffix, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{data[0] ^ 0xFF}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	counter.mu.Lock()
+	counter.downloads = 0
+	counter.mu.Unlock()
+	if err := session.DownloadFile(node, dst, nil); err != nil {
+		t.Fatal("Resumed download failed", err)
+	}
+	if want := chunks - done + 1; counter.downloads != want {
+		t.Errorf("Expected %d chunks downloaded, got %d", want, counter.downloads)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Resumed download data mismatch")
+	}
+	entries, err := os.ReadDir(filepath.Dir(dst))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Expected only the downloaded file left, got %v, %v", entries, err)
+	}
+}
+
+func TestDownloadFileOptions(t *testing.T) {
+	session := initSession(t)
+	node, _, h1 := uploadFile(t, session, 1000, session.FS.root)
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "file.bin")
+	ctx := context.Background()
+
+	// A larger existing file is replaced completely
+	if err := os.WriteFile(dst, make([]byte, 5000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := session.DownloadFileWithOptions(ctx, node, dst, &DownloadFileOptions{
+		Mode:       0640,
+		SetModTime: true,
+	})
+	if err != nil {
+		t.Fatal("Download failed", err)
+	}
+	if h2 := fileMD5(t, dst); h1 != h2 {
+		t.Error("MD5 mismatch for downloaded file")
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Wrong mode %v", info.Mode())
+	}
+	if !info.ModTime().Equal(node.GetTimeStamp()) {
+		t.Errorf("Wrong modification time %v, expected %v", info.ModTime(), node.GetTimeStamp())
+	}
+
+	// Existing files can be kept
+	if err := os.WriteFile(dst, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = session.DownloadFileWithOptions(ctx, node, dst, &DownloadFileOptions{IfExists: Skip})
+	if err != nil {
+		t.Error("Skip failed", err)
+	}
+	err = session.DownloadFileWithOptions(ctx, node, dst, &DownloadFileOptions{IfExists: Fail})
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Expected fs.ErrExist, got %v", err)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "keep" {
+		t.Errorf("Existing file changed to %q", got)
+	}
+
+	// Without a mode a replaced file keeps its permissions
+	if err := os.Chmod(dst, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.DownloadFile(node, dst, nil); err != nil {
+		t.Fatal("Download failed", err)
+	}
+	info, err = os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("Expected mode 0644 kept, got %v", info.Mode())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Expected no temporary files left, got %v, %v", entries, err)
+	}
+}
+
+func TestDownloadFileNil(t *testing.T) {
+	session := initSession(t)
+	dst := filepath.Join(t.TempDir(), "file.bin")
+	if err := session.DownloadFile(nil, dst, nil); !errors.Is(err, EARGS) {
+		t.Errorf("Expected EARGS, got %v", err)
+	}
+	progress := make(chan int, 1)
+	err := session.DownloadFileWithOptions(context.Background(), nil, dst, &DownloadFileOptions{Progress: &progress})
+	if !errors.Is(err, EARGS) {
+		t.Errorf("Expected EARGS with progress, got %v", err)
+	}
+	if _, err := os.Stat(dst); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected no file, got %v", err)
+	}
+}
+
+// recordingProgress records the progress calls made
+type recordingProgress struct {
+	mu      sync.Mutex
+	starts  []TransferProgress
+	chunks  []TransferProgress
+	retries []TransferProgress
+	dones   []TransferProgress
+}
+
+func (p *recordingProgress) Start(info TransferProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.starts = append(p.starts, info)
+}
+
+func (p *recordingProgress) ChunkDone(info TransferProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.chunks = append(p.chunks, info)
+}
+
+func (p *recordingProgress) Retry(info TransferProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retries = append(p.retries, info)
+}
+
+func (p *recordingProgress) Done(info TransferProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dones = append(p.dones, info)
+}
+
+func TestProgress(t *testing.T) {
+	needFakeServer(t)
+	session := initSession(t)
+
+	const size = 314573
+	src, _ := createFile(t, size)
+	defer func() {
+		_ = os.Remove(src)
+	}()
+
+	check := func(p *recordingProgress, upload bool) {
+		t.Helper()
+		if len(p.starts) != 1 || len(p.dones) != 1 {
+			t.Fatalf("Expected 1 Start and 1 Done, got %d and %d", len(p.starts), len(p.dones))
+		}
+		start, done := p.starts[0], p.dones[0]
+		if start.Upload != upload || start.Total != size || start.Done != 0 || start.ID == 0 {
+			t.Errorf("Wrong Start %+v", start)
+		}
+		if done.ID != start.ID || done.Done != size || done.Err != nil || done.ETA != 0 {
+			t.Errorf("Wrong Done %+v", done)
+		}
+		if len(p.chunks) == 0 {
+			t.Fatal("No ChunkDone calls")
+		}
+		var total int64
+		for _, c := range p.chunks {
+			total += int64(c.ChunkBytes)
+			if c.ID != start.ID || c.Chunk < 0 || c.Done != total {
+				t.Errorf("Wrong ChunkDone %+v", c)
+			}
+		}
+		if total != size {
+			t.Errorf("ChunkDone sizes add up to %d, want %d", total, size)
+		}
+		if last := p.chunks[len(p.chunks)-1]; last.Rate <= 0 {
+			t.Errorf("Expected a positive rate, got %v", last.Rate)
+		}
+	}
+
+	// Upload with a Progress and the old channel together
+	up := &recordingProgress{}
+	ch := make(chan int)
+	var chTotal int
+	chDone := make(chan struct{})
+	go func() {
+		defer close(chDone)
+		for n := range ch {
+			chTotal += n
+		}
+	}()
+	node, err := session.UploadFileWithOptions(context.Background(), src, session.FS.GetRoot(), "", &UploadFileOptions{Progress: &ch, Reporter: up})
+	if err != nil {
+		t.Fatal("Upload failed", err)
+	}
+	<-chDone
+	if chTotal != size {
+		t.Errorf("Channel received %d bytes, want %d", chTotal, size)
+	}
+	check(up, true)
+
+	// Download with a retried chunk, reporting to the Progress of
+	// the Mega too
+	dl, all := &recordingProgress{}, &recordingProgress{}
+	session.SetProgress(all)
+	dst := src + ".download"
+	defer func() {
+		_ = os.Remove(dst)
+	}()
+	fakeServer.FailRequests("/dl/", 503, 1)
+	err = session.DownloadFileWithOptions(context.Background(), node, dst, &DownloadFileOptions{Reporter: dl})
+	if err != nil {
+		t.Fatal("Download failed", err)
+	}
+	session.SetProgress(nil)
+	check(dl, false)
+	check(all, false)
+	if len(dl.retries) != 1 {
+		t.Fatalf("Expected 1 Retry, got %d", len(dl.retries))
+	}
+	if r := dl.retries[0]; r.Attempt != 1 || r.Err == nil || r.Chunk < 0 {
+		t.Errorf("Wrong Retry %+v", r)
+	}
+
+	// A failed transfer still reports Start and Done
+	failed := &recordingProgress{}
+	_, err = session.UploadFileWithOptions(context.Background(), src+".missing", session.FS.GetRoot(), "", &UploadFileOptions{Reporter: failed})
+	if err == nil {
+		t.Fatal("Expected upload of missing file to fail")
+	}
+	if len(failed.starts) != 1 || len(failed.dones) != 1 || failed.dones[0].Err == nil {
+		t.Errorf("Wrong progress for failed upload %+v %+v", failed.starts, failed.dones)
+	}
+}
+
+func TestTransferManager(t *testing.T) {
+	needFakeServer(t)
+	session := initSession(t)
+	tm, err := session.NewTransferManager(2, 4*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = tm.Close()
+	}()
+
+	// Upload several files, pausing one of them before the workers
+	// can start it
+	tm.Pause()
+	sizes := []int64{0, 31, 314573, 2 * 1024 * 1024}
+	var uploads []*Transfer
+	var sums []string
+	for _, size := range sizes {
+		src, sum := createFile(t, size)
+		defer func() {
+			_ = os.Remove(src)
+		}()
+		tr, err := tm.Upload(context.Background(), src, session.FS.GetRoot(), "", 0)
+		if err != nil {
+			t.Fatal("Upload failed", err)
+		}
+		uploads = append(uploads, tr)
+		sums = append(sums, sum)
+	}
+	uploads[3].Pause()
+	tm.Resume()
+	for _, tr := range uploads[:3] {
+		if err := tr.Wait(); err != nil {
+			t.Fatal("Upload failed", err)
+		}
+	}
+	if s := uploads[3].State(); s.Status != TransferPaused {
+		t.Errorf("Expected paused upload, got %+v", s)
+	}
+	uploads[3].Resume()
+	if err := uploads[3].Wait(); err != nil {
+		t.Fatal("Upload failed", err)
+	}
+
+	// Download them all back
+	dir := t.TempDir()
+	var downloads []*Transfer
+	for i, tr := range uploads {
+		node := tr.Node()
+		if node == nil || node.GetSize() != sizes[i] {
+			t.Fatalf("Wrong node for upload %d: %v", i, node)
+		}
+		dl, err := tm.Download(context.Background(), node, filepath.Join(dir, node.GetName()), i)
+		if err != nil {
+			t.Fatal("Download failed", err)
+		}
+		downloads = append(downloads, dl)
+	}
+	for i, dl := range downloads {
+		if err := dl.Wait(); err != nil {
+			t.Fatal("Download failed", err)
+		}
+		s := dl.State()
+		if s.Status != TransferDone || s.Done != sizes[i] || s.Total != sizes[i] {
+			t.Errorf("Wrong state %+v", s)
+		}
+		if h := fileMD5(t, filepath.Join(dir, uploads[i].Node().GetName())); h != sums[i] {
+			t.Errorf("MD5 mismatch for download %d", i)
+		}
+	}
+
+	// A cancelled download leaves nothing behind
+	canceldir := t.TempDir()
+	dl, err := tm.Download(context.Background(), uploads[3].Node(), filepath.Join(canceldir, "cancelled"), 0)
+	if err != nil {
+		t.Fatal("Download failed", err)
+	}
+	dl.Cancel()
+	if err := dl.Wait(); !errors.Is(err, ETRANSFER_CANCELLED) {
+		t.Errorf("Expected ETRANSFER_CANCELLED, got %v", err)
+	}
+	entries, err := os.ReadDir(canceldir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected no files after cancel, got %d", len(entries))
+	}
+	if len(tm.Transfers()) != 0 {
+		t.Errorf("Expected no transfers left, got %+v", tm.Transfers())
+	}
+}
+
+func TestRequestSize(t *testing.T) {
+	needFakeServer(t)
+	data := make([]byte, 6*1024*1024+12345)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		requestSize int
+		requests    int
+	}{
+		{1, 10},               // one MAC chunk each: 8 up to 4.5MB then 1MB each
+		{1024 * 1024, 8},      // the first chunks are grouped
+		{4 * 1024 * 1024, 2},  // up to 4MB of whole MAC chunks
+		{MAX_REQUEST_SIZE, 1}, // all in one
+		{3*1024*1024 + 1, 3},  // not a MAC chunk boundary
+		{REQUEST_SIZE, 1},     // the default
+		{200 * 1024, 10},      // less than some MAC chunks
+		{640 * 1024, 9},       // 128K+256K grouped only
+		{2 * 1024 * 1024, 4},  // a bit of each
+		{5 * 1024 * 1024, 2},  // the first 4.5MB then the rest
+	} {
+		counter := &chunkCounter{}
+		session, err := NewWithOptions(
+			WithAPIURL(fakeServer.URL),
+			WithHTTPClient(fakeServer.Client()),
+			WithTracer(counter),
+			WithRequestSize(test.requestSize),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := session.Login(USER, PASSWORD); err != nil {
+			t.Fatal("Login failed", err)
+		}
+		node, err := session.UploadReader(context.Background(), bytes.NewReader(data), int64(len(data)), session.FS.root, "request.bin")
+		if err != nil {
+			t.Fatalf("Upload with request size %d failed: %v", test.requestSize, err)
+		}
+		dst := filepath.Join(t.TempDir(), "request.bin")
+		err = session.DownloadFile(node, dst, nil)
+		if err != nil {
+			t.Fatalf("Download with request size %d failed: %v", test.requestSize, err)
+		}
+		got, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Data mismatch with request size %d", test.requestSize)
+		}
+		if counter.uploads != test.requests || counter.downloads != test.requests {
+			t.Errorf("Request size %d: expected %d requests each way, got %d uploads and %d downloads", test.requestSize, test.requests, counter.uploads, counter.downloads)
+		}
+	}
+}
+
+func TestUploadChunkKeepsBuffer(t *testing.T) {
+	needFakeServer(t)
+	session := initSession(t)
+	data := make([]byte, 300000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	orig := append([]byte(nil), data...)
+	u, err := session.NewUpload(session.FS.root, "keep.bin", int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 0; id < u.Chunks(); id++ {
+		pos, size, _ := u.ChunkLocation(id)
+		if err := u.UploadChunk(id, data[pos:pos+int64(size)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(data, orig) {
+		t.Fatal("UploadChunk changed the caller's buffer")
+	}
+	node, err := u.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readNode(t, session, node), data) {
+		t.Error("Uploaded data mismatch")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	needFakeServer(t)
+	session := initSession(t)
+	ctx := context.Background()
+	dir := createDir(t, session, "verify", session.FS.GetRoot())
+	sub := createDir(t, session, "sub", dir)
+	good, _, _ := uploadFile(t, session, 1500000, dir)
+	bad, _, _ := uploadFile(t, session, 300000, sub)
+	empty, _, _ := uploadFile(t, session, 0, sub)
+
+	report, err := session.Verify(ctx, good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Bytes != 1500000 || report.Chunks != 1 ||
+		!bytes.Equal(report.ComputedMAC, report.ExpectedMAC) || len(report.ChunkErrors) != 0 {
+		t.Errorf("Wrong report %+v", report)
+	}
+	if report, err := session.Verify(ctx, empty); err != nil || report.Bytes != 0 {
+		t.Errorf("Verify of empty file gave %+v, %v", report, err)
+	}
+	if _, err := session.Verify(ctx, dir); !errors.Is(err, EARGS) {
+		t.Errorf("Expected EARGS verifying a folder, got %v", err)
+	}
+
+	// unreadable chunks are listed
+	session.SetRetries(0)
+	fakeServer.FailRequests("/dl/", 503, 1)
+	report, err = session.Verify(ctx, good)
+	if err == nil || len(report.ChunkErrors) != 1 || report.ComputedMAC != nil {
+		t.Errorf("Expected one chunk error, got %+v, %v", report, err)
+	}
+	var merr *MegaError
+	if !errors.As(err, &merr) || merr.Status != 503 {
+		t.Errorf("Expected the chunk's *MegaError, got %v", err)
+	}
+
+	// corrupted contents fail the MAC check
+	if err := fakeServer.CorruptFile(bad.GetHash(), 200000); err != nil {
+		t.Fatal(err)
+	}
+	report, err = session.Verify(ctx, bad)
+	if !errors.Is(err, EMACMISMATCH) || report.OK() || bytes.Equal(report.ComputedMAC, report.ExpectedMAC) {
+		t.Errorf("Expected EMACMISMATCH, got %+v, %v", report, err)
+	}
+
+	reports, err := session.VerifyFolder(ctx, dir, 2)
+	if !errors.Is(err, EMACMISMATCH) {
+		t.Errorf("Expected EMACMISMATCH from VerifyFolder, got %v", err)
+	}
+	var paths []string
+	for _, r := range reports {
+		paths = append(paths, r.Path)
+	}
+	want := []string{good.GetName(), "sub/" + bad.GetName(), "sub/" + empty.GetName()}
+	sort.Strings(want)
+	if strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Fatalf("Got paths %v, want %v", paths, want)
+	}
+	for _, r := range reports {
+		if r.OK() == (r.Node == bad) {
+			t.Errorf("Wrong result for %q: %v", r.Path, r.Err)
+		}
+	}
+	if _, err := session.VerifyFolder(ctx, sub, 0); !errors.Is(err, EARGS) {
+		t.Errorf("Expected EARGS for no workers, got %v", err)
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	needFakeServer(t)
+	counter := &chunkCounter{}
+	session, err := NewWithOptions(WithAPIURL(fakeServer.URL), WithHTTPClient(fakeServer.Client()), WithTracer(counter), WithDeduplication(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry(t, "Login", func() error {
+		return session.Login(USER, PASSWORD)
+	})
+	if newMega().dedup {
+		t.Error("Deduplication on by default")
+	}
+	ctx := context.Background()
+	dir := createDir(t, session, "dedup", session.FS.GetRoot())
+	name, _ := createFile(t, 1500000)
+	defer func() {
+		_ = os.Remove(name)
+	}()
+	uploads := func() int {
+		counter.mu.Lock()
+		defer counter.mu.Unlock()
+		n := counter.uploads
+		counter.uploads = 0
+		return n
+	}
+
+	first, err := session.UploadFile(name, session.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := first.GetFingerprint()
+	if fp == "" || uploads() == 0 {
+		t.Fatalf("Expected an upload with a fingerprint, got %q", fp)
+	}
+	if session.FS.FingerprintLookup(fp, first.GetSize()) != first {
+		t.Error("Uploaded file not found by fingerprint")
+	}
+	if session.FS.FingerprintLookup(fp, first.GetSize()+1) != nil {
+		t.Error("File found with the wrong size")
+	}
+
+	// the same file again is a copy
+	second, err := session.UploadFile(name, dir, "again.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := uploads(); n != 0 {
+		t.Errorf("Expected no chunks uploaded for a copy, got %d", n)
+	}
+	if second.GetHash() == first.GetHash() || second.GetName() != "again.bin" || second.GetFingerprint() != fp {
+		t.Errorf("Wrong copy %q %q %q", second.GetHash(), second.GetName(), second.GetFingerprint())
+	}
+	if !bytes.Equal(readNode(t, session, second), readNode(t, session, first)) {
+		t.Error("Copy has different contents")
+	}
+
+	// renaming keeps the fingerprint
+	if err := session.Rename(second, "renamed.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if second.GetFingerprint() != fp {
+		t.Error("Rename lost the fingerprint")
+	}
+
+	// through the transfer manager too
+	tm, err := session.NewTransferManager(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = tm.Close()
+	}()
+	tr, err := tm.Upload(ctx, name, dir, "managed.bin", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if n := uploads(); n != 0 || tr.Node() == nil || tr.Node().GetFingerprint() != fp {
+		t.Errorf("Expected a copy from the transfer manager, got %d chunks", n)
+	}
+
+	// once all the copies are deleted it is uploaded again
+	for _, n := range []*Node{first, dir} {
+		if err := session.Delete(n, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := session.FS.FingerprintLookup(fp, first.GetSize()); n != nil {
+		t.Fatalf("Deleted file %q still found by fingerprint", n.GetName())
+	}
+	third, err := session.UploadFile(name, session.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploads() == 0 || third.GetFingerprint() != fp {
+		t.Error("Expected the file to be uploaded again")
+	}
+
+	// files in the trash aren't copied
+	if err := session.Move(third, session.FS.GetTrash()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.UploadFile(name, session.FS.GetRoot(), "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if uploads() == 0 {
+		t.Error("Expected an upload instead of a copy from the trash")
+	}
+
+	// nor is anything with deduplication off
+	session.SetDeduplication(false)
+	if _, err := session.UploadFile(name, session.FS.GetRoot(), "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if uploads() == 0 {
+		t.Error("Expected an upload with deduplication off")
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	needFakeServer(t)
+	session := initSession(t)
+	node, _, _ := uploadFile(t, session, 100, session.FS.GetRoot())
+	fp := node.GetFingerprint()
+
+	attr := node.GetAttr()
+	if attr.Name != node.GetName() || attr.Fingerprint == "" {
+		t.Fatalf("Wrong attributes %+v", attr)
+	}
+	// add attributes including one from another client
+	if err := json.Unmarshal([]byte(`{"n":"attrs.bin","other":{"k":"v"}}`), &attr); err != nil {
+		t.Fatal(err)
+	}
+	attr.Fingerprint = fp
+	attr.Label = LABEL_GREEN
+	attr.Favourite = true
+	attr.Description = "described"
+	attr.Tags = []string{"one", "two"}
+	if err := session.SetAttr(node, attr); err != nil {
+		t.Fatal(err)
+	}
+	if node.GetName() != "attrs.bin" || !reflect.DeepEqual(node.GetAttr(), attr) {
+		t.Errorf("Got %+v, want %+v", node.GetAttr(), attr)
+	}
+
+	if err := session.Rename(node, "renamed.bin"); err != nil {
+		t.Fatal(err)
+	}
+	attr.Name = "renamed.bin"
+
+	// read them back from the server
+	session2 := initSession(t)
+	got := session2.FS.HashLookup(node.GetHash()).GetAttr()
+	if !reflect.DeepEqual(got, attr) {
+		t.Errorf("After rename got %+v, want %+v", got, attr)
+	}
+	if string(got.Extra()["other"]) != `{"k":"v"}` {
+		t.Errorf("Lost unknown attribute %v", got.Extra())
+	}
+
+	if err := session.SetAttr(nil, attr); !errors.Is(err, EARGS) {
+		t.Errorf("Expected EARGS, got %v", err)
+	}
+}
+
+func TestPublicFile(t *testing.T) {
+	needFakeServer(t)
+	session := initSession(t)
+	node, _, md5sum := uploadFile(t, session, 1500000, session.FS.GetRoot())
+	link, err := session.Link(node, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ParseLink(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without logging in, from either form of link
+	anon := newMega()
+	for _, link := range []string{link, "https://mega.nz/file/" + l.Handle + "#" + base64urlencode(l.Key)} {
+		public, err := anon.PublicFile(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if public.GetName() != node.GetName() || public.GetSize() != node.GetSize() {
+			t.Errorf("Got %q %d, want %q %d", public.GetName(), public.GetSize(), node.GetName(), node.GetSize())
+		}
+
+		dir := t.TempDir()
+		dst := filepath.Join(dir, "public.bin")
+		if err := anon.DownloadFile(public, dst, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := fileMD5(t, dst); got != md5sum {
+			t.Errorf("Downloaded MD5 %s, want %s", got, md5sum)
+		}
+		if !bytes.Equal(readNode(t, anon, public), readNode(t, session, node)) {
+			t.Error("Streamed contents differ")
+		}
+	}
+
+	// a link with the wrong key can't be read
+	wrong := append([]byte(nil), l.Key...)
+	wrong[0] ^= 1
+	_, err = anon.PublicFile("#!" + l.Handle + "!" + base64urlencode(wrong))
+	if !errors.Is(err, EKEY) {
+		t.Errorf("Expected EKEY for the wrong key, got %v", err)
+	}
+	if _, err = anon.PublicFile("#!" + l.Handle); !errors.Is(err, EBADLINK) {
+		t.Errorf("Expected EBADLINK without a key, got %v", err)
+	}
+	if _, err = anon.PublicFile("#!NoSuchHd!" + base64urlencode(l.Key)); !errors.Is(err, ENOENT) {
+		t.Errorf("Expected ENOENT, got %v", err)
+	}
+}
+
+func TestPublicFolder(t *testing.T) {
+	needFakeServer(t)
+	session := initSession(t)
+	dir := createDir(t, session, "public", session.FS.GetRoot())
+	sub := createDir(t, session, "sub", dir)
+	top, _, _ := uploadFile(t, session, 1000, dir)
+	inner, _, md5sum := uploadFile(t, session, 1500000, sub)
+	link, err := session.Link(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ParseLink(link)
+	if err != nil || !l.Folder {
+		t.Fatalf("Bad folder link %q: %v", link, err)
+	}
+	// the key is the share key rather than the key of the folder, and
+	// is kept when linking again, including from another session
+	if bytes.Equal(l.Key, dir.meta.compkey) {
+		t.Error("Link has the folder key rather than a share key")
+	}
+	for _, s := range []*Mega{session, initSession(t)} {
+		again, err := s.Link(s.FS.HashLookup(dir.GetHash()), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != link {
+			t.Errorf("Linking again gave %q, want %q", again, link)
+		}
+	}
+
+	// without logging in, from either form of link
+	anon := newMega()
+	for _, link := range []string{link, "https://mega.nz/folder/" + l.Handle + "#" + base64urlencode(l.Key) + "/file/x"} {
+		fs, err := anon.PublicFolder(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := fs.GetRoot()
+		if root.GetName() != "public" || root.GetType() != FOLDER {
+			t.Fatalf("Wrong root %q", root.GetName())
+		}
+		children, err := fs.GetChildren(root)
+		if err != nil || len(children) != 2 {
+			t.Fatalf("Expected 2 children, got %d: %v", len(children), err)
+		}
+		nodes, err := fs.PathLookup(root, []string{"sub", inner.GetName()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := nodes[1]
+		if file.GetSize() != inner.GetSize() || file.GetHash() != inner.GetHash() {
+			t.Errorf("Wrong file %q", file.GetName())
+		}
+
+		dst := filepath.Join(t.TempDir(), "public.bin")
+		if err := anon.DownloadFile(file, dst, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := fileMD5(t, dst); got != md5sum {
+			t.Errorf("Downloaded MD5 %s, want %s", got, md5sum)
+		}
+		if fs.HashLookup(top.GetHash()) == nil {
+			t.Fatal("Top file not found")
+		}
+		if !bytes.Equal(readNode(t, anon, fs.HashLookup(top.GetHash())), readNode(t, session, top)) {
+			t.Error("Streamed contents differ")
+		}
+		reports, err := anon.VerifyFolder(context.Background(), root, 2)
+		if err != nil || len(reports) != 2 {
+			t.Errorf("VerifyFolder gave %d reports: %v", len(reports), err)
+		}
+	}
+
+	// files added later are seen once it is linked again
+	later, _, _ := uploadFile(t, session, 100, dir)
+	for _, relink := range []bool{false, true} {
+		if relink {
+			if _, err := session.Link(dir, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fs, err := anon.PublicFolder(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found := fs.HashLookup(later.GetHash()) != nil; found != relink {
+			t.Errorf("Relinked %v: found file added later %v", relink, found)
+		}
+	}
+
+	// the nodes of a folder shared inside it have a key for each share
+	subLink, err := session.Link(sub, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{link, subLink} {
+		fs, err := anon.PublicFolder(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := fs.HashLookup(inner.GetHash()); n == nil || n.GetName() != inner.GetName() {
+			t.Errorf("File in nested share not found through %q", link)
+		}
+	}
+
+	// files outside the folder can't be read through it
+	outside, _, _ := uploadFile(t, session, 100, session.FS.GetRoot())
+	fs, err := anon.PublicFolder(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsideNode := &Node{fs: fs, hash: outside.GetHash(), ntype: FILE}
+	if _, err := anon.NewDownload(outsideNode); !errors.Is(err, ENOENT) {
+		t.Errorf("Expected ENOENT outside the folder, got %v", err)
+	}
+
+	wrong := append([]byte(nil), l.Key...)
+	wrong[0] ^= 1
+	if _, err := anon.PublicFolder("#F!" + l.Handle + "!" + base64urlencode(wrong)); !errors.Is(err, EKEY) {
+		t.Errorf("Expected EKEY for the wrong key, got %v", err)
+	}
+	if _, err := anon.PublicFolder("#F!NoSuchHd!" + base64urlencode(l.Key)); !errors.Is(err, ENOENT) {
+		t.Errorf("Expected ENOENT, got %v", err)
+	}
+	if _, err := anon.PublicFolder("#!" + l.Handle); !errors.Is(err, EBADLINK) {
+		t.Errorf("Expected EBADLINK for a file link, got %v", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	needFakeServer(t)
+	session := initSession(t)
+	file, _, md5sum := uploadFile(t, session, 1000, session.FS.GetRoot())
+	fileLink, err := session.Link(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := createDir(t, session, "shared", session.FS.GetRoot())
+	sub := createDir(t, session, "sub", dir)
+	uploadFile(t, session, 100, dir)
+	inner, _, _ := uploadFile(t, session, 2000, sub)
+	folderLink, err := session.Link(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const email, password = "import@example.com", "importer"
+	if err := fakeServer.AddUser(email, password); err != nil {
+		t.Fatal(err)
+	}
+	other := newMega()
+	if err := other.Login(email, password); err != nil {
+		t.Fatal(err)
+	}
+	root := other.FS.GetRoot()
+
+	nodes, err := other.Import(fileLink, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].GetName() != file.GetName() || nodes[0].GetSize() != file.GetSize() {
+		t.Fatalf("Wrong nodes imported %v", nodes)
+	}
+	dst := filepath.Join(t.TempDir(), "imported.bin")
+	if err := other.DownloadFile(nodes[0], dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := fileMD5(t, dst); got != md5sum {
+		t.Errorf("Downloaded MD5 %s, want %s", got, md5sum)
+	}
+
+	nodes, err = other.Import(folderLink, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 4 || nodes[0].GetName() != "shared" || nodes[0].GetType() != FOLDER {
+		t.Fatalf("Wrong nodes imported %v", nodes)
+	}
+	path, err := other.FS.PathLookup(root, []string{"shared", "sub", inner.GetName()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readNode(t, other, path[2]), readNode(t, session, inner)) {
+		t.Error("Imported contents differ")
+	}
+
+	// the keys are the account's own so a new login can read them
+	again := newMega()
+	if err := again.Login(email, password); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := again.FS.PathLookup(again.FS.GetRoot(), []string{"shared", "sub", inner.GetName()}); err != nil {
+		t.Errorf("Imported folder not found after login: %v", err)
+	}
+	if _, err := again.FS.PathLookup(again.FS.GetRoot(), []string{file.GetName()}); err != nil {
+		t.Errorf("Imported file not found after login: %v", err)
+	}
+
+	if _, err := other.Import(fileLink, nil); !errors.Is(err, EARGS) {
+		t.Errorf("Expected EARGS without a parent, got %v", err)
+	}
+	l, _ := ParseLink(fileLink)
+	if _, err := other.Import("#!"+l.Handle, root); !errors.Is(err, EBADLINK) {
+		t.Errorf("Expected EBADLINK without a key, got %v", err)
+	}
+}
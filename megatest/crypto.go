@@ -0,0 +1,219 @@
+package megatest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"strings"
+)
+
+// an all nil IV for CBC operations
+var zeroIV = make([]byte, 16)
+
+// base64urlencode encodes b using unpadded base64 url encoding.
+func base64urlencode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// base64urldecode decodes s accepting the characters from both the
+// url and standard base64 alphabets, as the mega servers do.
+func base64urldecode(s string) ([]byte, error) {
+	s = strings.ReplaceAll(s, "+", "-")
+	s = strings.ReplaceAll(s, "/", "_")
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// randBytes returns n cryptographically random bytes.
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// randHandle returns a random handle of n bytes base64 encoded.
+func randHandle(n int) string {
+	return base64urlencode(randBytes(n))
+}
+
+// paddnull pads b with zeros to a multiple of q bytes.
+func paddnull(b []byte, q int) []byte {
+	if rem := len(b) % q; rem != 0 {
+		b = append(b, make([]byte, q-rem)...)
+	}
+	return b
+}
+
+// ecbEncrypt encrypts src with key in ECB mode. src must be a
+// multiple of the block size.
+func ecbEncrypt(key, src []byte) []byte {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	dst := make([]byte, len(src))
+	for i := 0; i < len(src); i += aes.BlockSize {
+		blk.Encrypt(dst[i:], src[i:])
+	}
+	return dst
+}
+
+// ecbDecrypt decrypts src with key in ECB mode. src must be a
+// multiple of the block size.
+func ecbDecrypt(key, src []byte) []byte {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	dst := make([]byte, len(src))
+	for i := 0; i < len(src); i += aes.BlockSize {
+		blk.Decrypt(dst[i:], src[i:])
+	}
+	return dst
+}
+
+// encryptAttr encrypts the attribute object attr with key the way
+// the mega clients do.
+func encryptAttr(key []byte, attr map[string]any) string {
+	data, err := json.Marshal(attr)
+	if err != nil {
+		panic(err)
+	}
+	buf := paddnull(append([]byte("MEGA"), data...), 16)
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	cipher.NewCBCEncrypter(blk, zeroIV).CryptBlocks(buf, buf)
+	return base64urlencode(buf)
+}
+
+// mpi encodes x as a length prefixed multi precision integer.
+func mpi(x *big.Int) []byte {
+	b := make([]byte, 2, 2+len(x.Bytes()))
+	binary.BigEndian.PutUint16(b, uint16(x.BitLen()))
+	return append(b, x.Bytes()...)
+}
+
+// rsaKey is a minimal RSA key used to hand out session ids.
+type rsaKey struct {
+	p, q, d, u, n *big.Int
+}
+
+var rsaExponent = big.NewInt(65537)
+
+// newRSAKey generates a small RSA key. It is only strong enough to
+// exercise the client side decryption.
+func newRSAKey() *rsaKey {
+	one := big.NewInt(1)
+	for {
+		p, err := rand.Prime(rand.Reader, 512)
+		if err != nil {
+			panic(err)
+		}
+		q, err := rand.Prime(rand.Reader, 512)
+		if err != nil {
+			panic(err)
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+		phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		d := new(big.Int).ModInverse(rsaExponent, phi)
+		if d == nil {
+			continue
+		}
+		return &rsaKey{
+			p: p,
+			q: q,
+			d: d,
+			u: new(big.Int).ModInverse(p, q),
+			n: new(big.Int).Mul(p, q),
+		}
+	}
+}
+
+// encrypt returns m^e mod n
+func (k *rsaKey) encrypt(m []byte) *big.Int {
+	return new(big.Int).Exp(new(big.Int).SetBytes(m), rsaExponent, k.n)
+}
+
+// privk returns the encoded private key encrypted with the master key
+func (k *rsaKey) privk(masterKey []byte) string {
+	var b []byte
+	for _, x := range []*big.Int{k.p, k.q, k.d, k.u} {
+		b = append(b, mpi(x)...)
+	}
+	return base64urlencode(ecbEncrypt(masterKey, paddnull(b, 16)))
+}
+
+// chunkSizes returns the sizes of the MAC chunks of a file of size
+func chunkSizes(size int64) (sizes []int) {
+	for i := 1; size > 0; i++ {
+		chunk := int64(1048576)
+		if i <= 8 {
+			chunk = int64(i) * 131072
+		}
+		chunk = min(chunk, size)
+		sizes = append(sizes, int(chunk))
+		size -= chunk
+	}
+	return sizes
+}
+
+// encryptFile encrypts data with a fresh file key returning the
+// ciphertext and the 32 byte node key including the nonce and meta
+// MAC.
+func encryptFile(data []byte) (ciphertext []byte, compkey []byte) {
+	ukey := randBytes(24)
+	key, nonce := ukey[:16], ukey[16:]
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+
+	ctrIV := make([]byte, 16)
+	copy(ctrIV, nonce)
+	ciphertext = make([]byte, len(data))
+	cipher.NewCTR(blk, ctrIV).XORKeyStream(ciphertext, data)
+
+	macIV := append(append([]byte{}, nonce...), nonce...)
+	sizes := chunkSizes(int64(len(data)))
+	if len(sizes) == 0 {
+		// empty files still have a single empty chunk
+		sizes = []int{0}
+	}
+	metaMAC := make([]byte, 16)
+	metaEnc := cipher.NewCBCEncrypter(blk, zeroIV)
+	pos := 0
+	for _, size := range sizes {
+		chunk := paddnull(append([]byte{}, data[pos:pos+size]...), 16)
+		mac := make([]byte, 16)
+		enc := cipher.NewCBCEncrypter(blk, macIV)
+		for i := 0; i < len(chunk); i += 16 {
+			enc.CryptBlocks(mac, chunk[i:i+16])
+		}
+		metaEnc.CryptBlocks(metaMAC, mac)
+		pos += size
+	}
+
+	mm := make([]byte, 8)
+	for i := 0; i < 4; i++ {
+		mm[i] = metaMAC[i] ^ metaMAC[i+4]
+		mm[i+4] = metaMAC[i+8] ^ metaMAC[i+12]
+	}
+
+	compkey = make([]byte, 32)
+	for i := 0; i < 8; i++ {
+		compkey[i] = key[i] ^ nonce[i]
+		compkey[i+8] = key[i+8] ^ mm[i]
+	}
+	copy(compkey[16:], nonce)
+	copy(compkey[24:], mm)
+	return ciphertext, compkey
+}
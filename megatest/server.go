@@ -0,0 +1,1189 @@
+// Package megatest provides an in-process fake MEGA server for
+// testing clients without a real account.
+//
+// The server speaks enough of the `/cs` API, the `/sc` event channel
+// and the chunk transfer endpoints for the go-mega client to log in,
+// upload, download, move, rename and delete nodes and receive events.
+// All the key handling and file encryption is done the same way as
+// the real service so the client crypto is exercised end to end.
+package megatest
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Error codes returned by the API
+const (
+	eARGS   = -2
+	eRANGE  = -7
+	eNOENT  = -9
+	eACCESS = -11
+	eSID    = -15
+)
+
+// Node types
+const (
+	nodeFile   = 0
+	nodeFolder = 1
+	nodeRoot   = 2
+	nodeInbox  = 3
+	nodeTrash  = 4
+)
+
+// Total storage reported by the uq command
+const storageQuota = 20 << 30
+
+// How long a client is kept waiting on the wait URL before it is
+// told to poll again.
+const maxEventWait = 30 * time.Second
+
+// Server is a fake MEGA API server listening on a local address.
+type Server struct {
+	// URL is the base url to pass to SetAPIUrl
+	URL string
+
+	srv    *httptest.Server
+	closed chan struct{}
+
+	mu          sync.Mutex
+	users       map[string]*user    // by email
+	sessions    map[string]*user    // by sid
+	nodes       map[string]*node    // by handle
+	uploads     map[string]*upload  // by upload id
+	completions map[string]*upload  // by completion handle
+	links       map[string]string   // node handles by public handle
+	shares      map[string]*share   // shared folders by handle
+	notify      map[*user]chan bool // closed when the user has new events
+	failures    []*failure          // injected failures
+	latency     time.Duration       // delay before running commands
+	inflight    int                 // command requests in progress
+	maxInflight int                 // most command requests seen at once
+}
+
+// failure is an injected failure for requests matching a path
+// prefix or API command
+type failure struct {
+	prefix string
+	cmd    string
+	status int
+	code   int
+	n      int
+}
+
+type user struct {
+	handle    string
+	email     string
+	name      string
+	password  string
+	salt      []byte
+	masterKey []byte
+	rsa       *rsaKey
+	root      string
+	inbox     string
+	trash     string
+	events    []json.RawMessage
+}
+
+type node struct {
+	handle string
+	parent string
+	owner  *user
+	ntype  int
+	attr   string
+	key    string
+	ts     int64
+	data   []byte
+}
+
+// share is a folder shared for export
+type share struct {
+	// ok is the share key encrypted with the owner's master key
+	ok string
+	// keys of the nodes in the share encrypted with the share key, by
+	// their handles
+	keys map[string]string
+}
+
+// keyFor returns the key of the node h in the share, which may be nil
+func (sh *share) keyFor(h string) (string, bool) {
+	if sh == nil {
+		return "", false
+	}
+	key, ok := sh.keys[h]
+	return key, ok
+}
+
+type upload struct {
+	data []byte
+	// lengths of the chunks received by their offsets
+	chunks map[int64]int64
+	handle string
+}
+
+// complete reports whether every byte of the upload has been received
+func (ul *upload) complete() bool {
+	var end int64
+	for _, offset := range slices.Sorted(maps.Keys(ul.chunks)) {
+		if offset > end {
+			return false
+		}
+		end = max(end, offset+ul.chunks[offset])
+	}
+	return end >= int64(len(ul.data))
+}
+
+// NewServer starts a fake MEGA server over plain HTTP.
+func NewServer() *Server {
+	s := newServer()
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+// NewTLSServer starts a fake MEGA server over HTTPS. Use Client to
+// get an *http.Client which trusts its certificate.
+func NewTLSServer() *Server {
+	s := newServer()
+	s.srv = httptest.NewTLSServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+func newServer() *Server {
+	return &Server{
+		closed:      make(chan struct{}),
+		users:       make(map[string]*user),
+		sessions:    make(map[string]*user),
+		nodes:       make(map[string]*node),
+		uploads:     make(map[string]*upload),
+		completions: make(map[string]*upload),
+		links:       make(map[string]string),
+		shares:      make(map[string]*share),
+		notify:      make(map[*user]chan bool),
+	}
+}
+
+// Client returns an HTTP client configured to talk to the server.
+func (s *Server) Client() *http.Client {
+	return s.srv.Client()
+}
+
+// Close shuts down the server, releasing any clients waiting for
+// events.
+func (s *Server) Close() {
+	close(s.closed)
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+}
+
+// AddUser creates an account which can log in with email and
+// password.
+func (s *Server) AddUser(email, password string) error {
+	email = strings.ToLower(email)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[email]; ok {
+		return fmt.Errorf("megatest: user %q already exists", email)
+	}
+	u := &user{
+		handle:    randHandle(8),
+		email:     email,
+		name:      email,
+		password:  password,
+		salt:      randBytes(32),
+		masterKey: randBytes(16),
+		rsa:       newRSAKey(),
+	}
+	u.root = s.addNode(u, "", nodeRoot, "", "", nil)
+	u.inbox = s.addNode(u, "", nodeInbox, "", "", nil)
+	u.trash = s.addNode(u, "", nodeTrash, "", "", nil)
+	s.users[email] = u
+	s.notify[u] = make(chan bool)
+	return nil
+}
+
+// Root returns the handle of the root node of the user's cloud drive.
+func (s *Server) Root(email string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[strings.ToLower(email)]
+	if !ok {
+		return "", fmt.Errorf("megatest: no such user %q", email)
+	}
+	return u.root, nil
+}
+
+// AddFile encrypts data and stores it as a file called name in the
+// parent folder owned by email, returning the new node handle.
+//
+// Clients which are logged in are notified with an event.
+func (s *Server) AddFile(email, parent, name string, data []byte) (string, error) {
+	ciphertext, compkey := encryptFile(data)
+	fileKey := make([]byte, 16)
+	for i := range fileKey {
+		fileKey[i] = compkey[i] ^ compkey[i+16]
+	}
+	attr := encryptAttr(fileKey, map[string]any{"n": name})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[strings.ToLower(email)]
+	if !ok {
+		return "", fmt.Errorf("megatest: no such user %q", email)
+	}
+	if p, ok := s.nodes[parent]; !ok || p.owner != u || p.ntype == nodeFile {
+		return "", fmt.Errorf("megatest: bad parent %q", parent)
+	}
+	key := base64urlencode(ecbEncrypt(u.masterKey, compkey))
+	h := s.addNode(u, parent, nodeFile, attr, key, ciphertext)
+	s.addEvent(u, newNodesEvent(u, s.nodes[h]))
+	return h, nil
+}
+
+// addNode creates a new node returning its handle
+//
+// Call with s.mu held
+func (s *Server) addNode(u *user, parent string, ntype int, attr, key string, data []byte) string {
+	h := randHandle(6)
+	s.nodes[h] = &node{
+		handle: h,
+		parent: parent,
+		owner:  u,
+		ntype:  ntype,
+		attr:   attr,
+		key:    key,
+		ts:     time.Now().Unix(),
+		data:   data,
+	}
+	return h
+}
+
+// removeNode deletes the node and all its descendants
+//
+// Call with s.mu held
+func (s *Server) removeNode(h string) {
+	for _, n := range s.nodes {
+		if n.parent == h {
+			s.removeNode(n.handle)
+		}
+	}
+	delete(s.nodes, h)
+	delete(s.shares, h)
+}
+
+// isAncestor returns true if a is h or one of its ancestors
+//
+// Call with s.mu held
+func (s *Server) isAncestor(a, h string) bool {
+	for h != "" {
+		if h == a {
+			return true
+		}
+		n, ok := s.nodes[h]
+		if !ok {
+			break
+		}
+		h = n.parent
+	}
+	return false
+}
+
+// addEvent appends an event to the user's event stream and wakes up
+// any waiting clients
+//
+// Call with s.mu held
+func (s *Server) addEvent(u *user, ev any) {
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		panic(err)
+	}
+	u.events = append(u.events, raw)
+	close(s.notify[u])
+	s.notify[u] = make(chan bool)
+}
+
+// CorruptFile flips a bit of the stored ciphertext of file h at
+// offset, so downloads of it fail their integrity check.
+func (s *Server) CorruptFile(h string, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[h]
+	if !ok || n.ntype != nodeFile {
+		return fmt.Errorf("megatest: no such file %q", h)
+	}
+	if offset < 0 || offset >= int64(len(n.data)) {
+		return fmt.Errorf("megatest: offset %d out of range", offset)
+	}
+	n.data[offset] ^= 1
+	return nil
+}
+
+// FailRequests makes the next n requests to paths starting with
+// prefix, eg "/cs", "/ul/" or "/dl/", fail with the HTTP status.
+func (s *Server) FailRequests(prefix string, status, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure{prefix: prefix, status: status, n: n})
+}
+
+// FailCommands makes the next n API commands called cmd, eg "m",
+// return the API error code instead of running.
+func (s *Server) FailCommands(cmd string, code, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure{cmd: cmd, code: code, n: n})
+}
+
+// SetLatency delays each API request by d before the commands in it
+// are run.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// MaxInflight returns the largest number of API requests which have
+// been in progress at the same time.
+func (s *Server) MaxInflight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxInflight
+}
+
+// injected returns the first active failure matching path or cmd,
+// using it up
+//
+// Call with s.mu held
+func (s *Server) injected(path, cmd string) *failure {
+	for _, f := range s.failures {
+		if f.n <= 0 {
+			continue
+		}
+		if (f.prefix != "" && strings.HasPrefix(path, f.prefix)) || (f.cmd != "" && f.cmd == cmd) {
+			f.n--
+			return f
+		}
+	}
+	return nil
+}
+
+// ServeHTTP routes the API, event and transfer requests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	f := s.injected(r.URL.Path, "")
+	s.mu.Unlock()
+	if f != nil {
+		http.Error(w, http.StatusText(f.status), f.status)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/cs":
+		s.serveCommands(w, r)
+	case r.URL.Path == "/sc":
+		s.serveEvents(w, r)
+	case strings.HasPrefix(r.URL.Path, "/wsc/"):
+		s.serveWait(w, r)
+	case strings.HasPrefix(r.URL.Path, "/ul/"):
+		s.serveUpload(w, r)
+	case strings.HasPrefix(r.URL.Path, "/dl/"):
+		s.serveDownload(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeJSON writes v as the response body
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// serveCommands runs each command in the posted array and returns an
+// array with a result for each one.
+func (s *Server) serveCommands(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var cmds []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&cmds); err != nil {
+		writeJSON(w, eARGS)
+		return
+	}
+
+	s.mu.Lock()
+	s.inflight++
+	s.maxInflight = max(s.maxInflight, s.inflight)
+	latency := s.latency
+	s.mu.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight--
+
+	u := s.sessions[r.URL.Query().Get("sid")]
+	folder := r.URL.Query().Get("n")
+	results := make([]any, len(cmds))
+	for i, raw := range cmds {
+		if folder != "" {
+			results[i] = s.runFolderCommand(folder, raw)
+		} else {
+			results[i] = s.runCommand(u, raw)
+		}
+	}
+	writeJSON(w, results)
+}
+
+// runFolderCommand runs a single command within the public folder
+// link with handle ph
+//
+// Call with s.mu held
+func (s *Server) runFolderCommand(ph string, raw json.RawMessage) any {
+	var cmd struct {
+		A string `json:"a"`
+		N string `json:"n"`
+	}
+	if err := json.Unmarshal(raw, &cmd); err != nil {
+		return eARGS
+	}
+	if f := s.injected("", cmd.A); f != nil {
+		return f.code
+	}
+	root, ok := s.nodes[s.links[ph]]
+	if !ok || root.ntype != nodeFolder {
+		return eNOENT
+	}
+	switch cmd.A {
+	case "f":
+		return s.cmdFolderFiles(root)
+	case "g":
+		n, ok := s.nodes[cmd.N]
+		if !ok || n.ntype != nodeFile || !s.isAncestor(root.handle, n.handle) {
+			return eNOENT
+		}
+		return s.downloadResult(n)
+	}
+	return eACCESS
+}
+
+// readableNode finds a node u can read, either its own with handle h,
+// one inside a public folder, or the file with public handle ph
+//
+// Call with s.mu held
+func (s *Server) readableNode(u *user, h, ph string) (*node, bool) {
+	if ph != "" {
+		n, ok := s.nodes[s.links[ph]]
+		return n, ok
+	}
+	if n, ok := s.lookupNode(u, h); ok {
+		return n, true
+	}
+	for _, root := range s.links {
+		if r, ok := s.nodes[root]; ok && r.ntype == nodeFolder && s.isAncestor(root, h) {
+			return s.nodes[h], true
+		}
+	}
+	return nil, false
+}
+
+// cmdFolderFiles returns the nodes of the public folder root with their
+// keys encrypted with the share key. Nodes the owner hasn't sent a
+// share key for are left out.
+//
+// Nodes in nested shares have a key for each share, innermost first.
+//
+// Call with s.mu held
+func (s *Server) cmdFolderFiles(root *node) any {
+	sh := s.shares[root.handle]
+	var files []fsNode
+	var add func(n *node)
+	add = func(n *node) {
+		if _, ok := sh.keys[n.handle]; !ok {
+			return
+		}
+		f := n.fsNode()
+		var keys []string
+		for h := n.handle; h != ""; h = s.nodes[h].parent {
+			if key, ok := s.shares[h].keyFor(n.handle); ok {
+				keys = append(keys, h+":"+key)
+			}
+			if h == root.handle {
+				break
+			}
+		}
+		f.Key = strings.Join(keys, "/")
+		files = append(files, f)
+		for _, c := range s.nodes {
+			if c.parent == n.handle {
+				add(c)
+			}
+		}
+	}
+	add(root)
+	return map[string]any{
+		"f":  files,
+		"ok": []any{},
+		"s":  []any{},
+		"u":  []any{},
+		"sn": snString(0),
+	}
+}
+
+// runCommand dispatches a single command
+//
+// Call with s.mu held
+func (s *Server) runCommand(u *user, raw json.RawMessage) any {
+	var cmd struct {
+		A string `json:"a"`
+	}
+	if err := json.Unmarshal(raw, &cmd); err != nil {
+		return eARGS
+	}
+	if f := s.injected("", cmd.A); f != nil {
+		return f.code
+	}
+
+	// commands which don't need a session
+	switch cmd.A {
+	case "us0":
+		return s.cmdPrelogin(raw)
+	case "us":
+		return s.cmdLogin(raw)
+	case "g":
+		return s.cmdDownload(u, raw)
+	}
+
+	if u == nil {
+		return eSID
+	}
+	switch cmd.A {
+	case "ug":
+		return s.cmdGetUser(u)
+	case "uq":
+		return s.cmdQuota(u)
+	case "f":
+		return s.cmdFiles(u)
+	case "u":
+		return s.cmdUpload(raw)
+	case "p":
+		return s.cmdPutNodes(u, raw)
+	case "m":
+		return s.cmdMove(u, raw)
+	case "a":
+		return s.cmdSetAttr(u, raw)
+	case "d":
+		return s.cmdDelete(u, raw)
+	case "l":
+		return s.cmdLink(u, raw)
+	case "s2":
+		return s.cmdShare(u, raw)
+	}
+	return eARGS
+}
+
+// fsNode is a node as sent to the client
+type fsNode struct {
+	Hash   string `json:"h"`
+	Parent string `json:"p"`
+	User   string `json:"u"`
+	T      int    `json:"t"`
+	Attr   string `json:"a,omitempty"`
+	Key    string `json:"k,omitempty"`
+	Ts     int64  `json:"ts"`
+	Sz     int64  `json:"s,omitempty"`
+}
+
+func (n *node) fsNode() fsNode {
+	f := fsNode{
+		Hash:   n.handle,
+		Parent: n.parent,
+		User:   n.owner.handle,
+		T:      n.ntype,
+		Attr:   n.attr,
+		Ts:     n.ts,
+		Sz:     int64(len(n.data)),
+	}
+	if n.key != "" {
+		f.Key = n.owner.handle + ":" + n.key
+	}
+	return f
+}
+
+// newNodesEvent makes a node addition event
+func newNodesEvent(u *user, ns ...*node) any {
+	var ev struct {
+		A string `json:"a"`
+		T struct {
+			F []fsNode `json:"f"`
+		} `json:"t"`
+		Ou string `json:"ou"`
+	}
+	ev.A = "t"
+	ev.Ou = u.handle
+	for _, n := range ns {
+		ev.T.F = append(ev.T.F, n.fsNode())
+	}
+	return ev
+}
+
+// lookupNode finds a node owned by u
+//
+// Call with s.mu held
+func (s *Server) lookupNode(u *user, h string) (*node, bool) {
+	n, ok := s.nodes[h]
+	if !ok || n.owner != u {
+		return nil, false
+	}
+	return n, true
+}
+
+func (s *Server) cmdPrelogin(raw json.RawMessage) any {
+	var msg struct {
+		User string `json:"user"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return eARGS
+	}
+	u, ok := s.users[strings.ToLower(msg.User)]
+	if !ok {
+		return eNOENT
+	}
+	return map[string]any{"v": 2, "s": base64urlencode(u.salt)}
+}
+
+func (s *Server) cmdLogin(raw json.RawMessage) any {
+	var msg struct {
+		User   string `json:"user"`
+		Handle string `json:"uh"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return eARGS
+	}
+	u, ok := s.users[strings.ToLower(msg.User)]
+	if !ok {
+		return eNOENT
+	}
+	derivedKey := pbkdf2.Key([]byte(u.password), u.salt, 100000, 32, sha512.New)
+	if msg.Handle != base64urlencode(derivedKey[16:]) {
+		return eNOENT
+	}
+
+	// The session id is RSA encrypted with the user's public key
+	sidBytes := randBytes(43)
+	sidBytes[0] |= 0x80
+	sid := base64urlencode(sidBytes)
+	s.sessions[sid] = u
+
+	return map[string]any{
+		"csid":  base64urlencode(mpi(u.rsa.encrypt(sidBytes))),
+		"privk": u.rsa.privk(u.masterKey),
+		"k":     base64urlencode(ecbEncrypt(derivedKey[:16], u.masterKey)),
+		"u":     u.handle,
+		"ach":   1,
+	}
+}
+
+func (s *Server) cmdGetUser(u *user) any {
+	return map[string]any{
+		"u":     u.handle,
+		"s":     1,
+		"email": u.email,
+		"name":  u.name,
+		"k":     base64urlencode(ecbEncrypt(u.masterKey, u.masterKey)),
+		"c":     1,
+		"privk": u.rsa.privk(u.masterKey),
+		"ts":    "",
+	}
+}
+
+func (s *Server) cmdQuota(u *user) any {
+	var used int64
+	for _, n := range s.nodes {
+		if n.owner == u {
+			used += int64(len(n.data))
+		}
+	}
+	return map[string]any{"mstrg": storageQuota, "cstrg": used}
+}
+
+func (s *Server) cmdFiles(u *user) any {
+	var files []fsNode
+	// send the nodes parents first
+	var add func(parent string)
+	add = func(parent string) {
+		for _, n := range s.nodes {
+			if n.owner == u && n.parent == parent {
+				files = append(files, n.fsNode())
+				add(n.handle)
+			}
+		}
+	}
+	add("")
+	oks := []any{}
+	for h, sh := range s.shares {
+		if n, ok := s.nodes[h]; ok && n.owner == u {
+			oks = append(oks, map[string]any{"h": h, "k": sh.ok, "ha": handleAuth(u, h)})
+		}
+	}
+	return map[string]any{
+		"f":  files,
+		"ok": oks,
+		"s":  []any{},
+		"u":  []any{},
+		"sn": snString(len(u.events)),
+	}
+}
+
+// cmdDownload gets a download URL for a file, which may be given by its
+// public handle without a session
+func (s *Server) cmdDownload(u *user, raw json.RawMessage) any {
+	var msg struct {
+		N string `json:"n"`
+		P string `json:"p"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return eARGS
+	}
+	var n *node
+	var ok bool
+	switch {
+	case msg.P != "":
+		n, ok = s.nodes[s.links[msg.P]]
+	case u == nil:
+		return eSID
+	default:
+		n, ok = s.lookupNode(u, msg.N)
+	}
+	if !ok || n.ntype != nodeFile {
+		return eNOENT
+	}
+	return s.downloadResult(n)
+}
+
+// downloadResult is the result of a "g" command for the file n
+func (s *Server) downloadResult(n *node) any {
+	return map[string]any{
+		"g":  s.URL + "/dl/" + n.handle,
+		"s":  len(n.data),
+		"at": n.attr,
+	}
+}
+
+func (s *Server) cmdUpload(raw json.RawMessage) any {
+	var msg struct {
+		S int64 `json:"s"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil || msg.S < 0 {
+		return eARGS
+	}
+	id := randHandle(12)
+	s.uploads[id] = &upload{data: make([]byte, msg.S), chunks: make(map[int64]int64)}
+	return map[string]any{"p": s.URL + "/ul/" + id}
+}
+
+func (s *Server) cmdPutNodes(u *user, raw json.RawMessage) any {
+	var msg struct {
+		T string `json:"t"`
+		N []struct {
+			H  string `json:"h"`
+			Ph string `json:"ph"`
+			P  string `json:"p"`
+			T  int    `json:"t"`
+			A  string `json:"a"`
+			K  string `json:"k"`
+		} `json:"n"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil || len(msg.N) == 0 {
+		return eARGS
+	}
+	parent, ok := s.lookupNode(u, msg.T)
+	if !ok || parent.ntype == nodeFile {
+		return eNOENT
+	}
+
+	var added []*node
+	// the handles of the new nodes by their h in the request
+	handles := make(map[string]string)
+	for _, nn := range msg.N {
+		p := parent.handle
+		if nn.P != "" {
+			if p, ok = handles[nn.P]; !ok {
+				return eARGS
+			}
+		}
+		var data []byte
+		switch nn.T {
+		case nodeFile:
+			// a completed upload or a copy of a file, which may be
+			// public
+			if ul, ok := s.completions[nn.H]; ok {
+				delete(s.completions, nn.H)
+				data = ul.data
+			} else if src, ok := s.readableNode(u, nn.H, nn.Ph); ok && src.ntype == nodeFile {
+				data = append([]byte(nil), src.data...)
+			} else {
+				return eNOENT
+			}
+		case nodeFolder:
+		default:
+			return eARGS
+		}
+		h := s.addNode(u, p, nn.T, nn.A, nn.K, data)
+		handles[nn.H] = h
+		added = append(added, s.nodes[h])
+	}
+	s.addEvent(u, newNodesEvent(u, added...))
+
+	files := make([]fsNode, len(added))
+	for i, n := range added {
+		files[i] = n.fsNode()
+	}
+	return map[string]any{"f": files}
+}
+
+func (s *Server) cmdMove(u *user, raw json.RawMessage) any {
+	var msg struct {
+		N string `json:"n"`
+		T string `json:"t"`
+		I string `json:"i"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return eARGS
+	}
+	n, ok := s.lookupNode(u, msg.N)
+	if !ok {
+		return eNOENT
+	}
+	parent, ok := s.lookupNode(u, msg.T)
+	if !ok || parent.ntype == nodeFile {
+		return eNOENT
+	}
+	if n.parent == "" {
+		return eACCESS
+	}
+	if s.isAncestor(n.handle, parent.handle) {
+		return eARGS
+	}
+	n.parent = parent.handle
+	s.addEvent(u, newNodesEvent(u, n))
+	return 0
+}
+
+func (s *Server) cmdSetAttr(u *user, raw json.RawMessage) any {
+	var msg struct {
+		Attr string `json:"attr"`
+		N    string `json:"n"`
+		I    string `json:"i"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return eARGS
+	}
+	n, ok := s.lookupNode(u, msg.N)
+	if !ok {
+		return eNOENT
+	}
+	if n.key == "" {
+		return eACCESS
+	}
+	n.attr = msg.Attr
+	s.addEvent(u, map[string]any{
+		"a":  "u",
+		"n":  n.handle,
+		"u":  u.handle,
+		"at": n.attr,
+		"ts": n.ts,
+		"i":  msg.I,
+	})
+	return 0
+}
+
+func (s *Server) cmdDelete(u *user, raw json.RawMessage) any {
+	var msg struct {
+		N string `json:"n"`
+		I string `json:"i"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return eARGS
+	}
+	n, ok := s.lookupNode(u, msg.N)
+	if !ok {
+		return eNOENT
+	}
+	if n.parent == "" {
+		return eACCESS
+	}
+	s.removeNode(n.handle)
+	s.addEvent(u, map[string]any{"a": "d", "n": n.handle, "i": msg.I})
+	return 0
+}
+
+func (s *Server) cmdLink(u *user, raw json.RawMessage) any {
+	var msg struct {
+		N string `json:"n"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return eARGS
+	}
+	n, ok := s.lookupNode(u, msg.N)
+	if !ok {
+		return eNOENT
+	}
+	if n.ntype != nodeFile && n.ntype != nodeFolder {
+		return eACCESS
+	}
+	// folders must be shared for export first
+	if _, ok := s.shares[n.handle]; n.ntype == nodeFolder && !ok {
+		return eACCESS
+	}
+	// Use a handle derived from the node so repeated calls agree
+	ph := "P" + n.handle[1:]
+	s.links[ph] = n.handle
+	return ph
+}
+
+// cmdShare shares a folder for export, storing the share key and the
+// keys of the nodes in it encrypted with the share key
+func (s *Server) cmdShare(u *user, raw json.RawMessage) any {
+	var msg struct {
+		N string `json:"n"`
+		S []struct {
+			U string `json:"u"`
+			R int    `json:"r"`
+		} `json:"s"`
+		Ok string   `json:"ok"`
+		Ha string   `json:"ha"`
+		Cr [3][]any `json:"cr"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil || len(msg.S) != 1 || msg.S[0].U != "EXP" {
+		return eARGS
+	}
+	n, ok := s.lookupNode(u, msg.N)
+	if !ok || n.ntype != nodeFolder {
+		return eNOENT
+	}
+	if msg.Ha != handleAuth(u, n.handle) {
+		return eACCESS
+	}
+	// the share key can't be changed once set
+	sh, ok := s.shares[n.handle]
+	if !ok {
+		sh = &share{ok: msg.Ok, keys: make(map[string]string)}
+	} else if sh.ok != msg.Ok {
+		return eACCESS
+	}
+
+	shareHandles, nodeHandles, keys := msg.Cr[0], msg.Cr[1], msg.Cr[2]
+	if len(keys)%3 != 0 {
+		return eARGS
+	}
+	newKeys := make(map[string]string)
+	for i := 0; i < len(keys); i += 3 {
+		si, ok1 := keys[i].(float64)
+		ni, ok2 := keys[i+1].(float64)
+		key, ok3 := keys[i+2].(string)
+		if !ok1 || !ok2 || !ok3 || int(si) >= len(shareHandles) || int(ni) >= len(nodeHandles) {
+			return eARGS
+		}
+		shareHandle, _ := shareHandles[int(si)].(string)
+		h, _ := nodeHandles[int(ni)].(string)
+		if shareHandle != n.handle || !s.isAncestor(n.handle, h) {
+			return eARGS
+		}
+		newKeys[h] = key
+	}
+	for h, key := range newKeys {
+		sh.keys[h] = key
+	}
+	s.shares[n.handle] = sh
+	return 0
+}
+
+// handleAuth returns the handle h twice encrypted with the master key
+// of u, which proves u owns h
+func handleAuth(u *user, h string) string {
+	return base64urlencode(ecbEncrypt(u.masterKey, []byte(h+h)))
+}
+
+// snString encodes an event sequence number
+func snString(sn int) string {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(sn))
+	return base64urlencode(b)
+}
+
+// parseSn decodes an event sequence number
+func parseSn(s string) (int, error) {
+	b, err := base64urldecode(s)
+	if err != nil || len(b) != 8 {
+		return 0, errors.New("bad sn")
+	}
+	return int(binary.BigEndian.Uint64(b)), nil
+}
+
+// serveEvents returns the events after sn or a wait url if there are
+// none.
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.sessions[q.Get("sid")]
+	if u == nil {
+		writeJSON(w, eSID)
+		return
+	}
+	sn, err := parseSn(q.Get("sn"))
+	if err != nil || sn > len(u.events) {
+		writeJSON(w, eARGS)
+		return
+	}
+	if sn == len(u.events) {
+		writeJSON(w, map[string]any{
+			"w":  s.URL + "/wsc/" + q.Get("sid") + "/" + strconv.Itoa(sn),
+			"sn": snString(sn),
+		})
+		return
+	}
+	writeJSON(w, map[string]any{
+		"a":  u.events[sn:],
+		"sn": snString(len(u.events)),
+	})
+}
+
+// serveWait blocks until there are events after the sequence number
+// in the url.
+func (s *Server) serveWait(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/wsc/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	sn, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	u := s.sessions[parts[0]]
+	if u == nil {
+		s.mu.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	pending := sn < len(u.events)
+	notify := s.notify[u]
+	s.mu.Unlock()
+
+	if !pending {
+		timer := time.NewTimer(maxEventWait)
+		defer timer.Stop()
+		select {
+		case <-notify:
+		case <-timer.C:
+		case <-s.closed:
+		case <-r.Context().Done():
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveUpload stores a chunk of ciphertext posted to /ul/<id>/<offset>
+//
+// When the last byte of the file has been received the response
+// contains the completion handle to pass to the p command.
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/ul/"), "/")
+	if r.Method != http.MethodPost || len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	offset, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "bad offset", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ul, ok := s.uploads[parts[0]]
+	if !ok {
+		_, _ = fmt.Fprint(w, eNOENT)
+		return
+	}
+	if offset+int64(len(body)) > int64(len(ul.data)) {
+		_, _ = fmt.Fprint(w, eRANGE)
+		return
+	}
+	copy(ul.data[offset:], body)
+	// chunks sent again are only counted once
+	ul.chunks[offset] = max(ul.chunks[offset], int64(len(body)))
+	if ul.complete() && ul.handle == "" {
+		ul.handle = randHandle(27)
+		s.completions[ul.handle] = ul
+		delete(s.uploads, parts[0])
+		_, _ = fmt.Fprint(w, ul.handle)
+	}
+}
+
+// serveDownload returns the ciphertext for /dl/<handle>/<start>-<end>
+func (s *Server) serveDownload(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/dl/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	var start, end int64
+	if _, err := fmt.Sscanf(parts[1], "%d-%d", &start, &end); err != nil || start < 0 || end < start {
+		http.Error(w, "bad range", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	// copy the data as CorruptFile may change it once unlocked
+	s.mu.Lock()
+	n, ok := s.nodes[parts[0]]
+	var data []byte
+	if ok && end < int64(len(n.data)) {
+		data = append([]byte(nil), n.data[start:end+1]...)
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if data == nil {
+		http.Error(w, "bad range", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,60 @@
+package megatest_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mega "github.com/t3rm1n4l/go-mega"
+	"github.com/t3rm1n4l/go-mega/megatest"
+)
+
+func TestServerEncryptedFile(t *testing.T) {
+	const email, password = "test@example.com", "password"
+	s := megatest.NewServer()
+	defer s.Close()
+	if err := s.AddUser(email, password); err != nil {
+		t.Fatal(err)
+	}
+	root, err := s.Root(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// span several chunks so the MAC chaining is checked
+	data := make([]byte, 1500000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	h, err := s.AddFile(email, root, "file.bin", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := mega.New().SetClient(s.Client())
+	m.SetAPIUrl(s.URL)
+	if err := m.Login(email, password); err != nil {
+		t.Fatal("Login failed", err)
+	}
+	node := m.FS.HashLookup(h)
+	if node == nil {
+		t.Fatal("File not found in FS")
+	}
+	if node.GetName() != "file.bin" {
+		t.Errorf("Wrong name %q", node.GetName())
+	}
+
+	dst := filepath.Join(t.TempDir(), "file.bin")
+	if err := m.DownloadFile(node, dst, nil); err != nil {
+		t.Fatal("Download failed", err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Downloaded data mismatch")
+	}
+}
@@ -103,15 +103,34 @@ type FilesResp struct {
 	Sn string `json:"sn"`
 }
 
-type FileAttr struct {
-	Name string `json:"n"`
-}
-
 type GetLinkMsg struct {
 	Cmd string `json:"a"`
 	N   string `json:"n"`
 }
 
+// ShareMsg shares the folder N with the users in S.
+//
+// Ok is the share key encrypted with the master key and Ha the handle
+// of the folder twice encrypted with the master key. Cr holds the
+// handles of the shares, the handles of the nodes in them, then the
+// index of the share, the index of the node and the node key encrypted
+// with the share key for each node.
+type ShareMsg struct {
+	Cmd string      `json:"a"`
+	N   string      `json:"n"`
+	S   []ShareUser `json:"s"`
+	Ok  string      `json:"ok"`
+	Ha  string      `json:"ha"`
+	Cr  [3][]any    `json:"cr"`
+	I   string      `json:"i,omitempty"`
+}
+
+// ShareUser is a user a folder is shared with and their access level
+type ShareUser struct {
+	U string `json:"u"`
+	R int    `json:"r"`
+}
+
 type DownloadMsg struct {
 	Cmd string `json:"a"`
 	G   int    `json:"g"`
@@ -153,6 +172,28 @@ type UploadCompleteResp struct {
 	F []FSNode `json:"f"`
 }
 
+// PutNodesMsg makes several nodes at once
+type PutNodesMsg struct {
+	Cmd string    `json:"a"`
+	T   string    `json:"t"`
+	N   []PutNode `json:"n"`
+	I   string    `json:"i,omitempty"`
+}
+
+// PutNode is a node made by PutNodesMsg
+//
+// H is the handle of the node copied, or a temporary handle for a
+// folder. P is the H of its parent if that is being made too and Ph
+// the public handle of a file link to copy instead of H.
+type PutNode struct {
+	H  string `json:"h,omitempty"`
+	Ph string `json:"ph,omitempty"`
+	P  string `json:"p,omitempty"`
+	T  int    `json:"t"`
+	A  string `json:"a"`
+	K  string `json:"k"`
+}
+
 type FileInfoMsg struct {
 	Cmd string `json:"a"`
 	F   int    `json:"f"`
@@ -0,0 +1,315 @@
+package mega
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Option configures a Mega made by New or NewWithOptions
+type Option func(m *Mega) error
+
+// NewWithOptions returns a Mega configured by opts, which are applied
+// in order. Options not given keep their defaults.
+//
+// It is the same as New except that an error is returned if any of the
+// options is invalid.
+func NewWithOptions(opts ...Option) (*Mega, error) {
+	max := big.NewInt(0x100000000)
+	bigx, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mega{
+		config:      newConfig(),
+		FS:          newMegaFS(),
+		hashcashSem: make(chan struct{}, 1),
+		dlLimiter:   NewRateLimiter(0),
+		ulLimiter:   NewRateLimiter(0),
+	}
+	m.sn.Store(bigx.Int64())
+	m.SetLogger(log.Printf)
+	m.SetDebugger(nil)
+	for _, opt := range opts {
+		err = opt(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m.client == nil {
+		m.client = newHttpClient(m.timeout)
+	}
+	return m, nil
+}
+
+// optionError returns an error for an invalid option
+func optionError(option string, value any, err error) error {
+	return fmt.Errorf("mega: invalid %s %v: %w", option, value, err)
+}
+
+// WithAPIURL sets the mega service base url. It must be an absolute
+// http or https url.
+func WithAPIURL(u string) Option {
+	return func(m *Mega) error {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return optionError("API URL", fmt.Sprintf("%q", u), err)
+		}
+		if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return optionError("API URL", fmt.Sprintf("%q", u), EARGS)
+		}
+		m.SetAPIUrl(u)
+		return nil
+	}
+}
+
+// WithUserAgent sets the user agent sent with API requests. Not set
+// if empty.
+func WithUserAgent(ua string) Option {
+	return func(m *Mega) error {
+		m.SetUserAgent(ua)
+		return nil
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for all requests. The
+// connection timeout set by WithTimeout is not applied to it.
+func WithHTTPClient(client *http.Client) Option {
+	return func(m *Mega) error {
+		if client == nil {
+			return optionError("HTTP client", nil, EARGS)
+		}
+		m.client = client
+		return nil
+	}
+}
+
+// WithTimeout sets the connection timeout of the default HTTP client
+func WithTimeout(t time.Duration) Option {
+	return func(m *Mega) error {
+		if t <= 0 {
+			return optionError("timeout", t, EARGS)
+		}
+		m.SetTimeOut(t)
+		return nil
+	}
+}
+
+// WithRetries sets the number of retries for api calls and chunk
+// transfers
+func WithRetries(r int) Option {
+	return func(m *Mega) error {
+		if r < 0 {
+			return optionError("retries", r, EARGS)
+		}
+		m.SetRetries(r)
+		return nil
+	}
+}
+
+// WithRetryPolicy sets the policy for retrying API requests and chunk
+// transfers
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(m *Mega) error {
+		m.SetRetryPolicy(p)
+		return nil
+	}
+}
+
+// workersOption returns an Option setting a worker count with set
+func workersOption(name string, w int, set func(*Mega, int) error) Option {
+	return func(m *Mega) error {
+		if w < 1 {
+			return optionError(name, w, EARGS)
+		}
+		err := set(m, w)
+		if err != nil {
+			return optionError(name, w, err)
+		}
+		return nil
+	}
+}
+
+// WithAPIWorkers sets the number of API requests which can be in
+// flight at once
+func WithAPIWorkers(w int) Option {
+	return workersOption("API workers", w, (*Mega).SetAPIWorkers)
+}
+
+// WithDownloadWorkers sets the number of concurrent download workers
+func WithDownloadWorkers(w int) Option {
+	return workersOption("download workers", w, (*Mega).SetDownloadWorkers)
+}
+
+// WithUploadWorkers sets the number of concurrent upload workers
+func WithUploadWorkers(w int) Option {
+	return workersOption("upload workers", w, (*Mega).SetUploadWorkers)
+}
+
+// WithHTTPS sets whether https is used for transfers
+func WithHTTPS(e bool) Option {
+	return func(m *Mega) error {
+		m.SetHTTPS(e)
+		return nil
+	}
+}
+
+// WithDownloadLimit limits the total bandwidth of the downloads to
+// bytesPerSecond. 0 is unlimited.
+func WithDownloadLimit(bytesPerSecond int64) Option {
+	return func(m *Mega) error {
+		if bytesPerSecond < 0 {
+			return optionError("download limit", bytesPerSecond, EARGS)
+		}
+		m.dlLimiter.SetLimit(bytesPerSecond)
+		return nil
+	}
+}
+
+// WithUploadLimit limits the total bandwidth of the uploads to
+// bytesPerSecond. 0 is unlimited.
+func WithUploadLimit(bytesPerSecond int64) Option {
+	return func(m *Mega) error {
+		if bytesPerSecond < 0 {
+			return optionError("upload limit", bytesPerSecond, EARGS)
+		}
+		m.ulLimiter.SetLimit(bytesPerSecond)
+		return nil
+	}
+}
+
+// WithSpoolMemory sets how much of an upload of unknown size is held
+// in memory. Anything larger is spooled to a temporary file.
+func WithSpoolMemory(n int64) Option {
+	return func(m *Mega) error {
+		err := m.SetSpoolMemory(n)
+		if err != nil {
+			return optionError("spool memory", n, err)
+		}
+		return nil
+	}
+}
+
+// WithSpoolDir sets the directory for the temporary files of uploads
+// of unknown size
+func WithSpoolDir(dir string) Option {
+	return func(m *Mega) error {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return optionError("spool directory", fmt.Sprintf("%q", dir), err)
+		}
+		if !info.IsDir() {
+			return optionError("spool directory", fmt.Sprintf("%q", dir), EARGS)
+		}
+		m.SetSpoolDir(dir)
+		return nil
+	}
+}
+
+// WithSpoolLimit sets the largest upload of unknown size which can be
+// spooled. 0 is unlimited.
+func WithSpoolLimit(n int64) Option {
+	return func(m *Mega) error {
+		err := m.SetSpoolLimit(n)
+		if err != nil {
+			return optionError("spool limit", n, err)
+		}
+		return nil
+	}
+}
+
+// WithResumableDownloads sets whether DownloadFile keeps partial
+// files to carry on with later. See SetResumableDownloads.
+func WithResumableDownloads(e bool) Option {
+	return func(m *Mega) error {
+		m.SetResumableDownloads(e)
+		return nil
+	}
+}
+
+// WithRequestSize sets the most of a file transferred by each HTTP
+// request of a download or upload
+func WithRequestSize(n int) Option {
+	return func(m *Mega) error {
+		err := m.SetRequestSize(n)
+		if err != nil {
+			return optionError("request size", n, err)
+		}
+		return nil
+	}
+}
+
+// WithDeduplication sets whether uploads of files already in the
+// Cloud Drive are copied instead. See SetDeduplication.
+func WithDeduplication(e bool) Option {
+	return func(m *Mega) error {
+		m.SetDeduplication(e)
+		return nil
+	}
+}
+
+// WithHashcashTimeout sets the time limit for solving a hashcash
+// challenge
+func WithHashcashTimeout(t time.Duration) Option {
+	return func(m *Mega) error {
+		err := m.SetHashcashTimeout(t)
+		if err != nil {
+			return optionError("hashcash timeout", t, err)
+		}
+		return nil
+	}
+}
+
+// WithHashcashWorkers sets the number of goroutines used to solve a
+// hashcash challenge
+func WithHashcashWorkers(w int) Option {
+	return workersOption("hashcash workers", w, (*Mega).SetHashcashWorkers)
+}
+
+// WithHashcashSolver sets the solver for hashcash challenges
+func WithHashcashSolver(s HashcashSolver) Option {
+	return func(m *Mega) error {
+		m.SetHashcashSolver(s)
+		return nil
+	}
+}
+
+// WithTracer sets the Tracer to receive callbacks about the
+// operations made
+func WithTracer(t Tracer) Option {
+	return func(m *Mega) error {
+		m.SetTracer(t)
+		return nil
+	}
+}
+
+// WithProgress sets the Progress to receive the progress of all the
+// file transfers made
+func WithProgress(p Progress) Option {
+	return func(m *Mega) error {
+		m.SetProgress(p)
+		return nil
+	}
+}
+
+// WithLogger sets the logger for important messages. nil discards
+// them.
+func WithLogger(logf func(format string, v ...any)) Option {
+	return func(m *Mega) error {
+		m.SetLogger(logf)
+		return nil
+	}
+}
+
+// WithDebugger sets the logger for debug messages. nil discards them.
+func WithDebugger(debugf func(format string, v ...any)) Option {
+	return func(m *Mega) error {
+		m.SetDebugger(debugf)
+		return nil
+	}
+}
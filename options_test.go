@@ -0,0 +1,120 @@
+package mega
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOptionsInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opt  Option
+		want error
+	}{
+		{"api url", WithAPIURL("not a url"), EARGS},
+		{"api url scheme", WithAPIURL("ftp://example.com"), EARGS},
+		{"http client", WithHTTPClient(nil), EARGS},
+		{"timeout", WithTimeout(0), EARGS},
+		{"retries", WithRetries(-1), EARGS},
+		{"api workers", WithAPIWorkers(0), EARGS},
+		{"download workers", WithDownloadWorkers(MAX_DOWNLOAD_WORKERS + 1), EWORKER_LIMIT_EXCEEDED},
+		{"upload workers", WithUploadWorkers(-1), EARGS},
+		{"download limit", WithDownloadLimit(-1), EARGS},
+		{"upload limit", WithUploadLimit(-1), EARGS},
+		{"spool memory", WithSpoolMemory(-1), EARGS},
+		{"spool dir", WithSpoolDir("/dev/null"), EARGS},
+		{"spool limit", WithSpoolLimit(-1), EARGS},
+		{"request size", WithRequestSize(0), EARGS},
+		{"request size too big", WithRequestSize(MAX_REQUEST_SIZE + 1), EARGS},
+		{"hashcash timeout", WithHashcashTimeout(-time.Second), EARGS},
+		{"hashcash workers", WithHashcashWorkers(MAX_HASHCASH_WORKERS + 1), EWORKER_LIMIT_EXCEEDED},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := NewWithOptions(test.opt)
+			if !errors.Is(err, test.want) {
+				t.Errorf("Expected %v, got %v", test.want, err)
+			}
+			if m != nil {
+				t.Error("Expected no Mega on error")
+			}
+		})
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	m := New(WithRetries(2))
+	if m.retries != 2 {
+		t.Errorf("Expected 2 retries, got %d", m.retries)
+	}
+
+	defer func() {
+		err, _ := recover().(error)
+		if !errors.Is(err, EARGS) || !strings.Contains(err.Error(), "invalid retries -1") {
+			t.Errorf("Expected New to panic with the option error, got %v", err)
+		}
+	}()
+	New(WithRetries(-1))
+}
+
+func TestOptions(t *testing.T) {
+	client := &http.Client{}
+	m, err := NewWithOptions(
+		WithAPIURL("https://example.com/api/"),
+		WithHTTPClient(client),
+		WithRetries(2),
+		WithAPIWorkers(8),
+		WithDownloadWorkers(5),
+		WithUploadWorkers(6),
+		WithHTTPS(true),
+		WithHashcashTimeout(time.Minute),
+		WithHashcashWorkers(3),
+		WithLogger(nil),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.baseurl != "https://example.com/api" {
+		t.Errorf("Wrong baseurl %q", m.baseurl)
+	}
+	if m.client != client {
+		t.Error("HTTP client not set")
+	}
+	if m.retries != 2 || m.api_workers != 8 || m.dl_workers != 5 || m.ul_workers != 6 {
+		t.Errorf("Wrong config %+v", m.config)
+	}
+	if !m.https || m.hashcashTimeout != time.Minute || m.hashcashWorkers != 3 {
+		t.Errorf("Wrong config %+v", m.config)
+	}
+	if m.logf == nil || m.debugf == nil {
+		t.Error("Loggers not set")
+	}
+}
+
+func TestOptionsUserAgent(t *testing.T) {
+	agents := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.Header.Get("User-Agent")
+		_, _ = w.Write([]byte("[0]"))
+	}))
+	defer ts.Close()
+
+	// each instance sends its own user agent
+	for _, ua := range []string{"agent-one", "agent-two"} {
+		m, err := NewWithOptions(WithAPIURL(ts.URL), WithUserAgent(ua))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = m.api_request(context.Background(), []byte(`[{"a":"uq"}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := <-agents; got != ua {
+			t.Errorf("Expected user agent %q, got %q", ua, got)
+		}
+	}
+}
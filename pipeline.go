@@ -0,0 +1,220 @@
+package mega
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// Size classes of the pooled chunk buffers, powers of two from 64K up
+// to MAX_REQUEST_SIZE
+const (
+	minBufferShift = 16
+	maxBufferShift = 26
+)
+
+// bufferPools holds the buffers of each size class
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// bufferClass returns the size class for n bytes, or -1 if there is
+// none
+func bufferClass(n int) int {
+	if n <= 1<<minBufferShift {
+		return 0
+	}
+	class := bits.Len(uint(n-1)) - minBufferShift
+	if class >= len(bufferPools) {
+		return -1
+	}
+	return class
+}
+
+// getBuffer returns a buffer of n bytes, from the pool if possible.
+// The contents are undefined. Return it with putBuffer when done.
+func getBuffer(n int) *[]byte {
+	class := bufferClass(n)
+	if class < 0 {
+		buf := make([]byte, n)
+		return &buf
+	}
+	if buf, ok := bufferPools[class].Get().(*[]byte); ok {
+		*buf = (*buf)[:n]
+		return buf
+	}
+	buf := make([]byte, n, 1<<(class+minBufferShift))
+	return &buf
+}
+
+// putBuffer returns a buffer from getBuffer to the pool
+func putBuffer(buf *[]byte) {
+	c := cap(*buf)
+	class := bufferClass(c)
+	if class < 0 || c != 1<<(class+minBufferShift) {
+		return
+	}
+	bufferPools[class].Put(buf)
+}
+
+// macWriter computes the MACs of the MAC chunks of the data written
+// to it, for data which may arrive in pieces of any size. The MACs are
+// those of chunkMACs.
+type macWriter struct {
+	block cipher.Block
+	iv    [16]byte
+	pos   int64 // position in the file
+	start int64 // start of the current MAC chunk
+	end   int64 // end of the current MAC chunk
+	mac   [16]byte
+	buf   [16]byte // partial block
+	nbuf  int
+	macs  []byte
+}
+
+// newMACWriter returns a macWriter for data from pos in the file,
+// which must be the start of a MAC chunk
+func newMACWriter(block cipher.Block, iv []byte, pos int64) *macWriter {
+	w := &macWriter{}
+	w.reset(block, iv, pos)
+	return w
+}
+
+// reset starts again from pos
+func (w *macWriter) reset(block cipher.Block, iv []byte, pos int64) {
+	w.block = block
+	copy(w.iv[:], iv)
+	w.pos = pos
+	w.start = pos
+	w.end = macChunkEnd(pos)
+	w.mac = w.iv
+	w.nbuf = 0
+	w.macs = w.macs[:0]
+}
+
+// Write implements io.Writer
+func (w *macWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// the part within the current MAC chunk
+		part := p[:min(int64(len(p)), w.end-w.pos)]
+		p = p[len(part):]
+		w.pos += int64(len(part))
+
+		if w.nbuf > 0 {
+			copied := copy(w.buf[w.nbuf:], part)
+			w.nbuf += copied
+			part = part[copied:]
+			if w.nbuf == 16 {
+				w.add(w.buf[:])
+				w.nbuf = 0
+			}
+		}
+		for len(part) >= 16 {
+			w.add(part[:16])
+			part = part[16:]
+		}
+		if len(part) > 0 {
+			w.nbuf = copy(w.buf[:], part)
+		}
+
+		if w.pos == w.end {
+			w.endChunk()
+		}
+	}
+	return n, nil
+}
+
+// add adds a block to the MAC
+func (w *macWriter) add(block []byte) {
+	subtle.XORBytes(w.mac[:], w.mac[:], block)
+	w.block.Encrypt(w.mac[:], w.mac[:])
+}
+
+// endChunk finishes the MAC of the current MAC chunk
+func (w *macWriter) endChunk() {
+	if w.nbuf > 0 {
+		// null padded
+		clear(w.buf[w.nbuf:])
+		w.add(w.buf[:])
+		w.nbuf = 0
+	}
+	w.macs = append(w.macs, w.mac[:]...)
+	w.mac = w.iv
+	w.start = w.pos
+	w.end = macChunkEnd(w.pos)
+}
+
+// Sum returns the MACs of the data written, finishing the last MAC
+// chunk if the data ended within it
+func (w *macWriter) Sum() []byte {
+	if w.pos > w.start {
+		w.endChunk()
+	}
+	if len(w.macs) == 0 {
+		// no data at all has a MAC of zeros
+		return make([]byte, 16)
+	}
+	return append([]byte(nil), w.macs...)
+}
+
+// pipelineStep is how much is decrypted and MACed at once, small
+// enough to stay in the cache
+const pipelineStep = 64 * 1024
+
+// readChunk reads len(buf) bytes from r into buf, decrypting them
+// with stream and adding them to mac, if set, as they arrive. It
+// returns the number of bytes read, which is short only if r ended.
+func readChunk(r io.Reader, buf []byte, stream cipher.Stream, mac *macWriter) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:min(n+pipelineStep, len(buf))])
+		if m > 0 {
+			part := buf[n : n+m]
+			stream.XORKeyStream(part, part)
+			if mac != nil {
+				_, _ = mac.Write(part)
+			}
+			n += m
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// encryptChunk encrypts src into dst with stream, returning the MACs
+// of src, without changing src
+func encryptChunk(dst, src []byte, stream cipher.Stream, mac *macWriter) []byte {
+	for off := 0; off < len(src); off += pipelineStep {
+		end := min(off+pipelineStep, len(src))
+		_, _ = mac.Write(src[off:end])
+		stream.XORKeyStream(dst[off:end], src[off:end])
+	}
+	return mac.Sum()
+}
+
+// trackedBody is a request body which signals when the HTTP client has
+// closed it, after which the buffer it reads can be reused
+type trackedBody struct {
+	io.Reader
+	once   sync.Once
+	closed chan struct{}
+}
+
+// newTrackedBody returns a trackedBody reading r
+func newTrackedBody(r io.Reader) *trackedBody {
+	return &trackedBody{Reader: r, closed: make(chan struct{})}
+}
+
+// Close implements io.Closer
+func (b *trackedBody) Close() error {
+	b.once.Do(func() {
+		close(b.closed)
+	})
+	return nil
+}
@@ -0,0 +1,270 @@
+package mega
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// referenceMACs computes the MACs of the MAC chunks of data at pos
+// the simple way, padding a copy of each
+func referenceMACs(block cipher.Block, iv []byte, pos int64, data []byte) []byte {
+	var macs []byte
+	for {
+		n := int(min(int64(len(data)), macChunkEnd(pos)-pos))
+		enc := cipher.NewCBCEncrypter(block, iv)
+		mac := make([]byte, 16)
+		padded := paddnull(append([]byte(nil), data[:n]...), 16)
+		for i := 0; i < len(padded); i += 16 {
+			enc.CryptBlocks(mac, padded[i:i+16])
+		}
+		macs = append(macs, mac...)
+		data = data[n:]
+		pos += int64(n)
+		if len(data) == 0 {
+			return macs
+		}
+	}
+}
+
+// randomBytes returns n random bytes
+func randomBytes(t testing.TB, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestMACWriter(t *testing.T) {
+	block, err := aes.NewCipher(randomBytes(t, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := randomBytes(t, 16)
+	data := randomBytes(t, 6*1024*1024+33)
+	for _, c := range getRequestChunks(int64(len(data)), 3*1024*1024) {
+		chunk := data[c.position : c.position+int64(c.size)]
+		want := referenceMACs(block, iv, c.position, chunk)
+
+		// all at once and in random pieces
+		if got := chunkMACs(block, iv, c.position, chunk); !bytes.Equal(got, want) {
+			t.Errorf("chunk at %d: wrong MACs", c.position)
+		}
+		w := newMACWriter(block, iv, c.position)
+		for rest := chunk; len(rest) > 0; {
+			n := min(len(rest), 1+mrand.Intn(40000))
+			_, _ = w.Write(rest[:n])
+			rest = rest[n:]
+		}
+		if got := w.Sum(); !bytes.Equal(got, want) {
+			t.Errorf("chunk at %d: wrong MACs from pieces", c.position)
+		}
+	}
+	if got := chunkMACs(block, iv, 0, nil); !bytes.Equal(got, make([]byte, 16)) {
+		t.Errorf("Expected zero MAC for no data, got %x", got)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	for _, n := range []int{0, 1, 65536, 65537, 1 << 20, 3<<20 + 5, MAX_REQUEST_SIZE, MAX_REQUEST_SIZE + 1} {
+		buf := getBuffer(n)
+		if len(*buf) != n {
+			t.Errorf("getBuffer(%d) returned %d bytes", n, len(*buf))
+		}
+		putBuffer(buf)
+	}
+	if bufferClass(MAX_REQUEST_SIZE+1) != -1 {
+		t.Error("Expected no class above MAX_REQUEST_SIZE")
+	}
+}
+
+func TestEncryptChunk(t *testing.T) {
+	block, err := aes.NewCipher(randomBytes(t, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := randomBytes(t, 16)
+	src := randomBytes(t, 1000000)
+	orig := append([]byte(nil), src...)
+	dst := make([]byte, len(src))
+	macs := encryptChunk(dst, src, ctrStream(block, nonce, 131072), newMACWriter(block, nonce, 131072))
+	if !bytes.Equal(src, orig) {
+		t.Fatal("encryptChunk changed its source")
+	}
+	if !bytes.Equal(macs, referenceMACs(block, nonce, 131072, src)) {
+		t.Error("Wrong MACs")
+	}
+	ctrStream(block, nonce, 131072).XORKeyStream(dst, dst)
+	if !bytes.Equal(dst, src) {
+		t.Error("Decrypting didn't give the source back")
+	}
+}
+
+// chunkServer serves random file data for downloads and discards
+// uploads
+func chunkServer(b *testing.B, data []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			_, _ = io.Copy(io.Discard, r.Body)
+			return
+		}
+		start, end, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "-")
+		s, _ := strconv.Atoi(start)
+		e, _ := strconv.Atoi(end)
+		w.Header().Set("Content-Length", strconv.Itoa(e-s+1))
+		_, _ = w.Write(data[s : e+1])
+	}))
+}
+
+// benchmarkTransfer returns a Download and an Upload of size bytes
+// talking to a chunkServer
+func benchmarkTransfer(b *testing.B, size int) (*Download, *Upload) {
+	data := randomBytes(b, size)
+	srv := chunkServer(b, data)
+	b.Cleanup(srv.Close)
+	m, err := NewWithOptions(WithHTTPClient(srv.Client()), WithRequestSize(size))
+	if err != nil {
+		b.Fatal(err)
+	}
+	block, err := aes.NewCipher(randomBytes(b, 16))
+	if err != nil {
+		b.Fatal(err)
+	}
+	d := &Download{
+		m:           m,
+		src:         &Node{fs: m.FS, name: "bench"},
+		resourceUrl: srv.URL,
+		aes_block:   block,
+		iv:          randomBytes(b, 16),
+		requestSize: size,
+		chunks:      getRequestChunks(int64(size), size),
+	}
+	d.chunk_macs = make([][]byte, len(d.chunks))
+	u, err := m.newUpload("", "bench", srv.URL, []uint32{1, 2, 3, 4, 5, 6}, int64(size), size)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return d, u
+}
+
+// legacyDownloadChunk downloads a chunk the way it was done before the
+// pipeline: reading all the body, decrypting then MACing a padded copy
+func legacyDownloadChunk(d *Download, id int) ([]byte, error) {
+	chk_start, chk_size, _ := d.ChunkLocation(id)
+	url := fmt.Sprintf("%s/%d-%d", d.resourceUrl, chk_start, chk_start+int64(chk_size)-1)
+	resp, err := d.m.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	ctrStream(d.aes_block, d.iv, chk_start).XORKeyStream(data, data)
+	d.chunk_macs[id] = referenceMACs(d.aes_block, d.iv, chk_start, data)
+	return data, nil
+}
+
+func BenchmarkChunkMAC(b *testing.B) {
+	block, err := aes.NewCipher(randomBytes(b, 16))
+	if err != nil {
+		b.Fatal(err)
+	}
+	iv := randomBytes(b, 16)
+	data := randomBytes(b, 8*1024*1024)
+	b.Run("padded", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			referenceMACs(block, iv, 0, data)
+		}
+	})
+	b.Run("streaming", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		w := newMACWriter(block, iv, 0)
+		for i := 0; i < b.N; i++ {
+			w.reset(block, iv, 0)
+			_, _ = w.Write(data)
+			w.Sum()
+		}
+	})
+}
+
+func BenchmarkDownloadChunk(b *testing.B) {
+	const size = 8 * 1024 * 1024
+	d, _ := benchmarkTransfer(b, size)
+	b.Run("legacy", func(b *testing.B) {
+		b.SetBytes(size)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := legacyDownloadChunk(d, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("DownloadChunk", func(b *testing.B) {
+		b.SetBytes(size)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := d.DownloadChunk(0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.SetBytes(size)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := getBuffer(size)
+			if err := d.downloadChunkInto(context.Background(), 0, *buf, nil); err != nil {
+				b.Fatal(err)
+			}
+			putBuffer(buf)
+		}
+	})
+}
+
+func BenchmarkUploadChunk(b *testing.B) {
+	const size = 8 * 1024 * 1024
+	_, u := benchmarkTransfer(b, size)
+	chunk := randomBytes(b, size)
+	b.Run("legacy", func(b *testing.B) {
+		b.SetBytes(size)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			// the old way: MAC a padded copy, encrypt in place
+			// after copying to keep chunk intact
+			data := append([]byte(nil), chunk...)
+			referenceMACs(u.aes_block, u.iv, 0, data)
+			ctrStream(u.aes_block, u.kiv, 0).XORKeyStream(data, data)
+			resp, err := u.m.client.Post(u.uploadUrl+"/0", "", bytes.NewReader(data))
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.SetBytes(size)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := u.UploadChunk(0, chunk); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
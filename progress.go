@@ -0,0 +1,376 @@
+package mega
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransferProgress is a snapshot of the progress of a file transfer
+type TransferProgress struct {
+	// ID identifies the transfer among those made by this process
+	ID uint64
+	// Name is the name of the file
+	Name string
+	// Upload is true for an upload and false for a download
+	Upload bool
+	// Total is the size of the file
+	Total int64
+	// Done is the number of bytes transferred so far, including
+	// any transferred before a resumed transfer was started
+	Done int64
+	// Chunk is the chunk this event is for, or -1
+	Chunk int
+	// ChunkBytes is the size of Chunk
+	ChunkBytes int
+	// Attempt is the number of attempts made at Chunk for a retry
+	Attempt int
+	// Start is when the transfer started
+	Start time.Time
+	// Rate is the average bytes per second since the start
+	Rate float64
+	// ETA is the estimated time until the transfer finishes, 0 if
+	// unknown
+	ETA time.Duration
+	// Err is the error causing a retry or ending the transfer
+	Err error
+}
+
+// Progress receives the progress of file transfers.
+//
+// For each transfer Start is called first and Done last, with
+// ChunkDone and Retry called in between. The calls for one transfer
+// are never concurrent but a slow Progress holds up the transfer, so
+// wrap it with NewAsyncProgress if it might be slow.
+type Progress interface {
+	// Start is called when the transfer starts
+	Start(p TransferProgress)
+	// ChunkDone is called when each chunk has been transferred
+	ChunkDone(p TransferProgress)
+	// Retry is called before a chunk is retried, with the error
+	// from the failed attempt
+	Retry(p TransferProgress)
+	// Done is called when the transfer finishes, with Err set if
+	// it failed
+	Done(p TransferProgress)
+}
+
+// SetProgress sets the Progress to receive the progress of all the
+// file transfers made, including those of a TransferManager and by
+// Verify. Use nil to remove it.
+//
+// Use the Reporter of DownloadFileOptions or UploadFileOptions for the
+// progress of a single transfer.
+func (c *config) SetProgress(p Progress) {
+	c.progress = p
+}
+
+// transferIDs is the source of TransferProgress.ID
+var transferIDs atomic.Uint64
+
+// progressTracker keeps track of the progress of a transfer
+type progressTracker struct {
+	mu        sync.Mutex // to protect the following and serialize the calls to p
+	p         Progress
+	info      TransferProgress
+	startDone int64 // bytes done before this transfer started
+	finished  bool
+}
+
+// newProgressTracker returns a tracker reporting to the Progress set
+// with SetProgress, to p and to ch, or nil if there are none of them.
+func (c *config) newProgressTracker(p Progress, ch *chan int, name string, upload bool) *progressTracker {
+	var ps []Progress
+	if c.progress != nil {
+		ps = append(ps, c.progress)
+	}
+	if p != nil {
+		ps = append(ps, p)
+	}
+	if ch != nil {
+		ps = append(ps, chanProgress{ch})
+	}
+	if len(ps) == 0 {
+		return nil
+	}
+	p = multiProgress(ps)
+	if len(ps) == 1 {
+		p = ps[0]
+	}
+	return &progressTracker{
+		p: p,
+		info: TransferProgress{
+			ID:     transferIDs.Add(1),
+			Name:   name,
+			Upload: upload,
+			Chunk:  -1,
+		},
+	}
+}
+
+// start reports the start of the transfer of total bytes, of which
+// done have been transferred already
+func (t *progressTracker) start(total, done int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return
+	}
+	t.info.Total = total
+	t.info.Done = done
+	t.info.Start = time.Now()
+	t.startDone = done
+	t.p.Start(t.info)
+}
+
+// update sets the rate and ETA
+//
+// Call with t.mu held
+func (t *progressTracker) update() {
+	elapsed := time.Since(t.info.Start).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	t.info.Rate = float64(t.info.Done-t.startDone) / elapsed
+	t.info.ETA = 0
+	if t.info.Rate > 0 {
+		t.info.ETA = time.Duration(float64(t.info.Total-t.info.Done) / t.info.Rate * float64(time.Second))
+	}
+}
+
+// chunkDone reports that chunk id of size bytes is done
+func (t *progressTracker) chunkDone(id int, size int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return
+	}
+	t.info.Done += int64(size)
+	t.update()
+	info := t.info
+	info.Chunk = id
+	info.ChunkBytes = size
+	t.p.ChunkDone(info)
+}
+
+// chunkRetry returns the retryNotify to report the retries of chunk
+// id, or nil if there is nothing to report to
+func (t *progressTracker) chunkRetry(id int, size int) retryNotify {
+	if t == nil {
+		return nil
+	}
+	return func(attempts int, err *MegaError) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.update()
+		info := t.info
+		info.Chunk = id
+		info.ChunkBytes = size
+		info.Attempt = attempts
+		info.Err = err
+		t.p.Retry(info)
+	}
+}
+
+// done reports the end of the transfer. Only the first call has any
+// effect.
+func (t *progressTracker) done(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return
+	}
+	t.finished = true
+	if t.info.Start.IsZero() {
+		// failed before starting
+		t.info.Start = time.Now()
+		t.p.Start(t.info)
+	}
+	t.update()
+	info := t.info
+	info.Err = err
+	t.p.Done(info)
+}
+
+// multiProgress reports to several Progress
+type multiProgress []Progress
+
+// Start implements Progress
+func (ps multiProgress) Start(p TransferProgress) {
+	for _, x := range ps {
+		x.Start(p)
+	}
+}
+
+// ChunkDone implements Progress
+func (ps multiProgress) ChunkDone(p TransferProgress) {
+	for _, x := range ps {
+		x.ChunkDone(p)
+	}
+}
+
+// Retry implements Progress
+func (ps multiProgress) Retry(p TransferProgress) {
+	for _, x := range ps {
+		x.Retry(p)
+	}
+}
+
+// Done implements Progress
+func (ps multiProgress) Done(p TransferProgress) {
+	for _, x := range ps {
+		x.Done(p)
+	}
+}
+
+// chanProgress reports progress the old way, by sending the size of
+// each chunk on a channel and closing it at the end
+type chanProgress struct {
+	ch *chan int
+}
+
+// Start implements Progress
+func (c chanProgress) Start(p TransferProgress) {}
+
+// ChunkDone implements Progress
+func (c chanProgress) ChunkDone(p TransferProgress) {
+	*c.ch <- p.ChunkBytes
+}
+
+// Retry implements Progress
+func (c chanProgress) Retry(p TransferProgress) {}
+
+// Done implements Progress
+func (c chanProgress) Done(p TransferProgress) {
+	close(*c.ch)
+}
+
+// progressEvent is a call queued by AsyncProgress
+type progressEvent struct {
+	call      func(Progress, TransferProgress)
+	info      TransferProgress
+	chunkDone bool
+}
+
+// AsyncProgress is a Progress which passes the calls on to another
+// Progress from its own goroutine so the transfers never wait for
+// it.
+//
+// If the other Progress falls behind, ChunkDone calls waiting to be
+// passed on are replaced by later ones for the same transfer, so it
+// sees the latest progress without seeing every chunk.
+type AsyncProgress struct {
+	p       Progress
+	mu      sync.Mutex // to protect the following
+	queue   []progressEvent
+	closed  bool
+	wake    chan struct{}
+	stopped chan struct{}
+}
+
+// NewAsyncProgress returns an AsyncProgress passing calls on to p.
+// Call Close when finished with it.
+func NewAsyncProgress(p Progress) *AsyncProgress {
+	a := &AsyncProgress{
+		p:       p,
+		wake:    make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// push queues a call to p
+func (a *AsyncProgress) push(call func(Progress, TransferProgress), info TransferProgress, coalesce bool) {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	replaced := false
+	if coalesce {
+		// replace a queued ChunkDone for the same transfer
+		for i := len(a.queue) - 1; i >= 0; i-- {
+			e := &a.queue[i]
+			if e.info.ID != info.ID {
+				continue
+			}
+			if e.chunkDone {
+				e.info = info
+				replaced = true
+			}
+			break
+		}
+	}
+	if !replaced {
+		a.queue = append(a.queue, progressEvent{call: call, info: info, chunkDone: coalesce})
+	}
+	a.mu.Unlock()
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run passes on the queued calls until closed
+func (a *AsyncProgress) run() {
+	defer close(a.stopped)
+	for {
+		a.mu.Lock()
+		queue := a.queue
+		a.queue = nil
+		closed := a.closed
+		a.mu.Unlock()
+		for _, e := range queue {
+			e.call(a.p, e.info)
+		}
+		if len(queue) == 0 {
+			if closed {
+				return
+			}
+			<-a.wake
+		}
+	}
+}
+
+// Start implements Progress
+func (a *AsyncProgress) Start(p TransferProgress) {
+	a.push(Progress.Start, p, false)
+}
+
+// ChunkDone implements Progress
+func (a *AsyncProgress) ChunkDone(p TransferProgress) {
+	a.push(Progress.ChunkDone, p, true)
+}
+
+// Retry implements Progress
+func (a *AsyncProgress) Retry(p TransferProgress) {
+	a.push(Progress.Retry, p, false)
+}
+
+// Done implements Progress
+func (a *AsyncProgress) Done(p TransferProgress) {
+	a.push(Progress.Done, p, false)
+}
+
+// Close passes on the calls still queued then stops. Calls made after
+// Close are ignored.
+func (a *AsyncProgress) Close() {
+	a.mu.Lock()
+	a.closed = true
+	a.mu.Unlock()
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+	<-a.stopped
+}
@@ -0,0 +1,80 @@
+package mega
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingProgress records ChunkDone calls, blocking until released
+type blockingProgress struct {
+	mu      sync.Mutex
+	release chan struct{}
+	chunks  []int
+	done    bool
+}
+
+func (p *blockingProgress) Start(info TransferProgress) {}
+
+func (p *blockingProgress) ChunkDone(info TransferProgress) {
+	<-p.release
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.chunks = append(p.chunks, info.Chunk)
+}
+
+func (p *blockingProgress) Retry(info TransferProgress) {}
+
+func (p *blockingProgress) Done(info TransferProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = true
+}
+
+func TestAsyncProgress(t *testing.T) {
+	p := &blockingProgress{release: make(chan struct{})}
+	a := NewAsyncProgress(p)
+
+	// None of these may block although p is stuck in the first
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		info := TransferProgress{ID: 1}
+		a.Start(info)
+		for i := 0; i < 100; i++ {
+			info.Chunk = i
+			a.ChunkDone(info)
+		}
+		a.Done(info)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("AsyncProgress blocked the caller")
+	}
+
+	close(p.release)
+	a.Close()
+
+	if !p.done {
+		t.Error("Done not passed on")
+	}
+	if len(p.chunks) == 0 || len(p.chunks) == 100 {
+		t.Errorf("Expected ChunkDone calls to be coalesced, got %d", len(p.chunks))
+	}
+	for i := 1; i < len(p.chunks); i++ {
+		if p.chunks[i] <= p.chunks[i-1] {
+			t.Errorf("ChunkDone calls out of order: %v", p.chunks)
+			break
+		}
+	}
+	if last := p.chunks[len(p.chunks)-1]; last != 99 {
+		t.Errorf("Expected the last ChunkDone to be for chunk 99, got %d", last)
+	}
+
+	// Calls after Close are dropped
+	a.ChunkDone(TransferProgress{ID: 1, Chunk: 100})
+	if last := p.chunks[len(p.chunks)-1]; last != 99 {
+		t.Errorf("ChunkDone passed on after Close")
+	}
+}
@@ -0,0 +1,167 @@
+package mega
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimitReadSize is the most read through a rate limit at once so
+// a transfer is paced smoothly rather than in bursts
+const rateLimitReadSize = 32 * 1024
+
+// RateLimiter is a token bucket limiting the bytes per second
+// transferred. One RateLimiter can be shared by many transfers to
+// limit their total bandwidth.
+//
+// It is safe for concurrent use and the limit can be changed while
+// transfers are running.
+type RateLimiter struct {
+	mu     sync.Mutex
+	limit  float64 // bytes per second, 0 for unlimited
+	tokens float64 // may go negative to pace large reads
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing bytesPerSecond with
+// bursts of up to a second's worth. 0 is unlimited.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetLimit(bytesPerSecond)
+	return l
+}
+
+// SetLimit changes the limit to bytesPerSecond. 0 or less is
+// unlimited.
+func (l *RateLimiter) SetLimit(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	if l.limit == 0 {
+		// start with a full bucket when becoming limited
+		l.tokens = float64(bytesPerSecond)
+	}
+	l.limit = float64(max(bytesPerSecond, 0))
+	l.tokens = min(l.tokens, l.limit)
+}
+
+// Limit returns the limit in bytes per second, 0 for unlimited
+func (l *RateLimiter) Limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.limit)
+}
+
+// refill adds the tokens earned since the last call
+//
+// Call with l.mu held
+func (l *RateLimiter) refill(now time.Time) {
+	if l.limit > 0 {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.limit, l.limit)
+	}
+	l.last = now
+}
+
+// WaitN waits until n bytes can be transferred, returning early with
+// the context error if ctx is cancelled
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.limit == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.limit * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	return sleepContext(ctx, wait)
+}
+
+// rateLimitedReader reads from r at the rate allowed by l
+type rateLimitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *RateLimiter
+}
+
+// Read implements io.Reader
+func (r *rateLimitedReader) Read(p []byte) (n int, err error) {
+	if len(p) > rateLimitReadSize {
+		p = p[:rateLimitReadSize]
+	}
+	n, err = r.r.Read(p)
+	if n > 0 {
+		waitErr := r.l.WaitN(r.ctx, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// newRateLimitedReader returns r limited by l, or r if l is nil
+func newRateLimitedReader(ctx context.Context, r io.Reader, l *RateLimiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, l: l}
+}
+
+// DownloadLimiter returns the RateLimiter shared by the downloads of
+// m. Use its SetLimit method to change the download limit.
+func (m *Mega) DownloadLimiter() *RateLimiter {
+	return m.dlLimiter
+}
+
+// UploadLimiter returns the RateLimiter shared by the uploads of m.
+// Use its SetLimit method to change the upload limit.
+func (m *Mega) UploadLimiter() *RateLimiter {
+	return m.ulLimiter
+}
+
+// rateLimiter returns the limiter for a chunk transfer: the transfer's
+// own if set, otherwise def
+func rateLimiter(own, def *RateLimiter) *RateLimiter {
+	if own != nil {
+		return own
+	}
+	return def
+}
+
+// SetRateLimiter makes the chunks of this download limited by l
+// instead of by the download limit of the Mega. Use nil to restore
+// that.
+func (d *Download) SetRateLimiter(l *RateLimiter) {
+	d.mutex.Lock()
+	d.limiter = l
+	d.mutex.Unlock()
+}
+
+// getRateLimiter returns the limiter for a chunk of the download
+func (d *Download) getRateLimiter() *RateLimiter {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return rateLimiter(d.limiter, d.m.dlLimiter)
+}
+
+// SetRateLimiter makes the chunks of this upload limited by l instead
+// of by the upload limit of the Mega. Use nil to restore that.
+func (u *Upload) SetRateLimiter(l *RateLimiter) {
+	u.mutex.Lock()
+	u.limiter = l
+	u.mutex.Unlock()
+}
+
+// getRateLimiter returns the limiter for a chunk of the upload
+func (u *Upload) getRateLimiter() *RateLimiter {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return rateLimiter(u.limiter, u.m.ulLimiter)
+}
@@ -0,0 +1,71 @@
+package mega
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// readLimited reads size bytes through l returning the time taken
+func readLimited(t *testing.T, ctx context.Context, l *RateLimiter, size int) (time.Duration, error) {
+	t.Helper()
+	start := time.Now()
+	n, err := io.Copy(io.Discard, newRateLimitedReader(ctx, bytes.NewReader(make([]byte, size)), l))
+	if err == nil && n != int64(size) {
+		t.Errorf("Read %d bytes, expected %d", n, size)
+	}
+	return time.Since(start), err
+}
+
+func TestRateLimiter(t *testing.T) {
+	const limit = 200 * 1024
+	l := NewRateLimiter(limit)
+	if l.Limit() != limit {
+		t.Errorf("Wrong limit %d", l.Limit())
+	}
+
+	// The first second's worth is a burst then the rest is paced
+	elapsed, err := readLimited(t, context.Background(), l, 2*limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed < 800*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Expected about 1s, took %v", elapsed)
+	}
+
+	// Removing the limit takes effect straight away
+	l.SetLimit(0)
+	elapsed, err = readLimited(t, context.Background(), l, 10*limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("Expected no limit, took %v", elapsed)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := NewRateLimiter(1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	elapsed, err := readLimited(t, ctx, l, 1024*1024)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("Cancel took %v", elapsed)
+	}
+}
+
+func TestRateLimiterChoice(t *testing.T) {
+	own, def := NewRateLimiter(1), NewRateLimiter(2)
+	if got := rateLimiter(own, def); got != own {
+		t.Error("Expected the transfer's own limiter")
+	}
+	if got := rateLimiter(nil, def); got != def {
+		t.Error("Expected the default limiter")
+	}
+}
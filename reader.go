@@ -0,0 +1,226 @@
+package mega
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// Settings for FileReader
+const (
+	readerBlockSize = 1024 * 1024 // size of each range fetched
+	readerReadAhead = 2           // blocks fetched ahead of sequential reads
+)
+
+// FileReader reads the contents of a remote file, fetching and
+// decrypting the parts needed on demand. It implements io.Reader,
+// io.Seeker, io.ReaderAt and io.Closer.
+//
+// Sequential reads fetch the following blocks in the background. The
+// MAC of the file isn't checked as the whole file may never be read,
+// so use DownloadFile if that is needed.
+//
+// Read and Seek must not be called concurrently but ReadAt may be
+// called concurrently with any method.
+type FileReader struct {
+	d      *Download
+	name   string
+	size   int64
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	mu     sync.Mutex // to protect the following
+	offset int64
+	blocks map[int64]*readerBlock
+	lru    []int64 // indices of blocks, most recently used last
+}
+
+// readerBlock is a block of the file, fetched or being fetched
+type readerBlock struct {
+	done chan struct{} // closed when data and err are set
+	data []byte
+	err  error
+}
+
+// Open returns a FileReader for the contents of the file node
+func (m *Mega) Open(node *Node) (*FileReader, error) {
+	return m.OpenContext(context.Background(), node)
+}
+
+// OpenContext is like Open but with a context which is used for all
+// the fetches made by the FileReader
+func (m *Mega) OpenContext(ctx context.Context, node *Node) (*FileReader, error) {
+	if node == nil {
+		return nil, EARGS
+	}
+	if node.GetType() != FILE {
+		return nil, fmt.Errorf("can't open %q: not a file: %w", node.GetName(), EARGS)
+	}
+	d, err := m.NewDownloadContext(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &FileReader{
+		d:      d,
+		name:   node.GetName(),
+		size:   node.GetSize(),
+		ctx:    ctx,
+		cancel: cancel,
+		blocks: make(map[int64]*readerBlock),
+	}, nil
+}
+
+// Size returns the size of the file
+func (r *FileReader) Size() int64 {
+	return r.size
+}
+
+// block returns block i, starting to fetch it if necessary
+//
+// Call with r.mu held
+func (r *FileReader) block(i int64) *readerBlock {
+	b := r.blocks[i]
+	if b != nil {
+		// mark as most recently used
+		for j, k := range r.lru {
+			if k == i {
+				r.lru = append(r.lru[:j], r.lru[j+1:]...)
+				break
+			}
+		}
+	} else {
+		b = &readerBlock{done: make(chan struct{})}
+		r.blocks[i] = b
+		go r.fetch(i, b)
+	}
+	r.lru = append(r.lru, i)
+
+	// Evict the least recently used. Blocks still being fetched
+	// finish in the background.
+	for len(r.lru) > readerReadAhead+2 {
+		delete(r.blocks, r.lru[0])
+		r.lru = r.lru[1:]
+	}
+	return b
+}
+
+// forget removes block i if it is b so it is fetched again
+func (r *FileReader) forget(i int64, b *readerBlock) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.blocks[i] != b {
+		return
+	}
+	delete(r.blocks, i)
+	for j, k := range r.lru {
+		if k == i {
+			r.lru = append(r.lru[:j], r.lru[j+1:]...)
+			break
+		}
+	}
+}
+
+// fetch downloads block i into b
+func (r *FileReader) fetch(i int64, b *readerBlock) {
+	defer close(b.done)
+	start := i * readerBlockSize
+	size := int(min(readerBlockSize, r.size-start))
+	attempts := 0
+	b.data, b.err = r.d.fetchRange(r.ctx, r.name+": read", start, size, &attempts)
+}
+
+// ReadAt reads len(p) bytes from the file at off. It implements
+// io.ReaderAt.
+func (r *FileReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d: %w", off, EARGS)
+	}
+	for n < len(p) {
+		if r.ctx.Err() != nil {
+			if errors.Is(context.Cause(r.ctx), errReaderClosed) {
+				return n, fs.ErrClosed
+			}
+			return n, r.ctx.Err()
+		}
+		if off >= r.size {
+			return n, io.EOF
+		}
+		i := off / readerBlockSize
+		r.mu.Lock()
+		b := r.block(i)
+		r.mu.Unlock()
+		select {
+		case <-b.done:
+		case <-r.ctx.Done():
+			continue
+		}
+		if b.err != nil {
+			r.forget(i, b)
+			return n, b.err
+		}
+		copied := copy(p[n:], b.data[off-i*readerBlockSize:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// Read implements io.Reader
+func (r *FileReader) Read(p []byte) (n int, err error) {
+	r.mu.Lock()
+	off := r.offset
+	r.mu.Unlock()
+
+	n, err = r.ReadAt(p, off)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.offset += int64(n)
+	if err == nil {
+		// fetch the following blocks in the background
+		cur := r.offset / readerBlockSize
+		for i := cur; i <= cur+readerReadAhead && i*readerBlockSize < r.size; i++ {
+			r.block(i)
+		}
+	}
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.offset, fmt.Errorf("bad whence %d: %w", whence, EARGS)
+	}
+	if offset < 0 {
+		return r.offset, fmt.Errorf("negative offset %d: %w", offset, EARGS)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// errReaderClosed is the cause of the context of a closed FileReader
+var errReaderClosed = errors.New("file reader closed")
+
+// Close stops any fetches in progress. It implements io.Closer.
+func (r *FileReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cancel(errReaderClosed)
+	r.blocks = make(map[int64]*readerBlock)
+	r.lru = nil
+	return nil
+}
@@ -0,0 +1,351 @@
+package mega
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Settings for resumable downloads
+const (
+	downloadStateSuffix   = ".mega-resume" // appended to the file name for the state file
+	downloadStateInterval = time.Second    // how often the state file is saved
+)
+
+// resumeTokenVersion is the version of the resume token format
+const resumeTokenVersion = 1
+
+// uploadState is the state of an Upload kept in its resume token
+type uploadState struct {
+	V      int      `json:"v"`
+	Parent string   `json:"p"`
+	Name   string   `json:"n"`
+	URL    string   `json:"u"`
+	Key    []uint32 `json:"k"`
+	Size   int64    `json:"s"`
+	MACs   []string `json:"m"` // "" for chunks not acknowledged
+	Handle string   `json:"h"`
+	// RequestSize sets the chunks, 0 in tokens from before it could
+	// be set when each chunk was one MAC chunk
+	RequestSize int    `json:"r,omitempty"`
+	Fingerprint string `json:"c,omitempty"`
+}
+
+// sealResumeToken encrypts state with a key derived from the master key
+// so only the same account can read it and it can't be altered
+func (m *Mega) sealResumeToken(state any) (string, error) {
+	plain, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := m.resumeTokenCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64urlencode(gcm.Seal(nonce, nonce, plain, nil)), nil
+}
+
+// openResumeToken decrypts token made by sealResumeToken into state
+func (m *Mega) openResumeToken(token string, state any) error {
+	sealed, err := base64urldecode(token)
+	if err != nil {
+		return fmt.Errorf("bad resume token: %w", EARGS)
+	}
+	gcm, err := m.resumeTokenCipher()
+	if err != nil {
+		return err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return fmt.Errorf("bad resume token: %w", EARGS)
+	}
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return fmt.Errorf("resume token not from this account or corrupted: %w", EARGS)
+	}
+	err = json.Unmarshal(plain, state)
+	if err != nil {
+		return fmt.Errorf("bad resume token: %w", err)
+	}
+	return nil
+}
+
+// resumeTokenLabel is the HKDF info used to derive the resume token key
+const resumeTokenLabel = "go-mega resume token"
+
+// resumeTokenCipher returns the cipher for resume tokens. Its key is
+// derived from the master key rather than being the master key, which
+// encrypts the node keys in another mode.
+func (m *Mega) resumeTokenCipher() (cipher.AEAD, error) {
+	if len(m.k) == 0 {
+		return nil, ENOENT // not logged in
+	}
+	key, err := hkdf.Key(sha256.New, m.k, nil, resumeTokenLabel, len(m.k))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ChunkDone returns whether the server has acknowledged chunk id
+func (u *Upload) ChunkDone(id int) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return id >= 0 && id < len(u.chunk_macs) && u.chunk_macs[id] != nil
+}
+
+// ResumeToken returns an opaque token holding the state of the
+// upload, including which chunks have been acknowledged. Pass it to
+// ResumeUpload, possibly in another process, to carry on with the
+// upload.
+//
+// The token is encrypted with a key derived from the master key of
+// the account so it can only be used when logged in to the same
+// account. It may be called while chunks are being uploaded to
+// checkpoint the progress.
+func (u *Upload) ResumeToken() (string, error) {
+	state := uploadState{
+		V:      resumeTokenVersion,
+		Parent: u.parenthash,
+		Name:   u.name,
+		URL:    u.uploadUrl,
+		Key:    u.ukey,
+		Size:   u.size,
+
+		RequestSize: u.requestSize,
+		Fingerprint: u.fingerprint,
+	}
+	u.mutex.Lock()
+	state.MACs = make([]string, len(u.chunk_macs))
+	for i, mac := range u.chunk_macs {
+		if mac != nil {
+			state.MACs[i] = base64urlencode(mac)
+		}
+	}
+	state.Handle = string(u.completion_handle)
+	u.mutex.Unlock()
+	return u.m.sealResumeToken(state)
+}
+
+// ResumeUpload rebuilds an Upload from a token made by its
+// ResumeToken method.
+//
+// Only the chunks for which ChunkDone returns false need to be
+// uploaded before calling Finish. UploadReaderAt does this.
+func (m *Mega) ResumeUpload(token string) (*Upload, error) {
+	var state uploadState
+	err := m.openResumeToken(token, &state)
+	if err != nil {
+		return nil, err
+	}
+	if state.V != resumeTokenVersion || len(state.Key) != 6 {
+		return nil, fmt.Errorf("bad resume token: %w", EARGS)
+	}
+	requestSize := state.RequestSize
+	if requestSize == 0 {
+		requestSize = 1
+	}
+	u, err := m.newUpload(state.Parent, state.Name, state.URL, state.Key, state.Size, requestSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(state.MACs) != len(u.chunk_macs) {
+		return nil, fmt.Errorf("bad resume token: %w", EARGS)
+	}
+	for i, mac := range state.MACs {
+		if mac == "" {
+			continue
+		}
+		u.chunk_macs[i], err = base64urldecode(mac)
+		if err != nil || len(u.chunk_macs[i]) == 0 || len(u.chunk_macs[i])%16 != 0 {
+			return nil, fmt.Errorf("bad resume token: %w", EARGS)
+		}
+	}
+	u.completion_handle = []byte(state.Handle)
+	u.fingerprint = state.Fingerprint
+	return u, nil
+}
+
+// SetResumableDownloads sets whether DownloadFile keeps the partial
+// file when it fails, named with the suffix ".mega-partial", along
+// with a state file named with the suffix ".mega-resume". A later
+// DownloadFile of the same node to the same path then only fetches
+// the missing chunks.
+func (c *config) SetResumableDownloads(e bool) {
+	c.resumableDownloads = e
+}
+
+// ChunkDone returns whether chunk id has been downloaded
+func (d *Download) ChunkDone(id int) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return id >= 0 && id < len(d.chunk_macs) && d.chunk_macs[id] != nil
+}
+
+// downloadState is the state of a partly downloaded file, saved next
+// to it
+type downloadState struct {
+	path     string
+	saveMu   sync.Mutex // held while saving
+	mu       sync.Mutex // to protect the following
+	lastSave time.Time
+	V        int            `json:"v"`
+	Hash     string         `json:"h"`
+	Size     int64          `json:"s"`
+	MAC      string         `json:"m"`
+	Request  int            `json:"r"` // the request size setting the chunks
+	Chunks   map[int]string `json:"c"` // MACs of the chunks written
+}
+
+// openResumable opens partialpath for the download, carrying on from
+// a partial download if statepath matches d.
+//
+// The chunks recorded in the state file are read back and their MACs
+// checked so any which don't match are downloaded again, so Finish
+// checks the whole file.
+func (d *Download) openResumable(partialpath, statepath string) (*os.File, *downloadState, error) {
+	d.src.fs.mutex.Lock()
+	want := downloadState{
+		V:    resumeTokenVersion,
+		Hash: d.src.hash,
+		Size: d.src.size,
+		MAC:  base64urlencode(d.src.meta.mac),
+
+		Request: d.requestSize,
+	}
+	d.src.fs.mutex.Unlock()
+
+	state := &downloadState{path: statepath}
+	buf, err := os.ReadFile(state.path)
+	if err == nil {
+		err = json.Unmarshal(buf, state)
+	}
+	var outfile *os.File
+	if err == nil && state.V == want.V && state.Hash == want.Hash && state.Size == want.Size && state.MAC == want.MAC && state.Request == want.Request {
+		outfile, err = os.OpenFile(partialpath, os.O_RDWR, 0600)
+		if err == nil {
+			err = d.resumeChunks(outfile, state)
+			if err != nil {
+				_ = outfile.Close()
+				return nil, nil, err
+			}
+		}
+	}
+	if outfile == nil {
+		// start from scratch
+		outfile, err = os.OpenFile(partialpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+		state.V, state.Hash, state.Size, state.MAC, state.Request = want.V, want.Hash, want.Size, want.MAC, want.Request
+		state.Chunks = make(map[int]string)
+	}
+	err = state.save(outfile)
+	if err != nil {
+		_ = outfile.Close()
+		return nil, nil, err
+	}
+	return outfile, state, nil
+}
+
+// resumeChunks marks the chunks in state which are intact in outfile
+// as done and forgets the others
+func (d *Download) resumeChunks(outfile *os.File, state *downloadState) error {
+	for id, mac := range state.Chunks {
+		chk_start, chk_size, err := d.ChunkLocation(id)
+		if err != nil {
+			delete(state.Chunks, id)
+			continue
+		}
+		chunk := getBuffer(chk_size)
+		_, err = outfile.ReadAt(*chunk, chk_start)
+		if err == io.EOF {
+			putBuffer(chunk)
+			delete(state.Chunks, id)
+			continue
+		}
+		if err != nil {
+			putBuffer(chunk)
+			return err
+		}
+		block := d.chunkMAC(chk_start, *chunk)
+		putBuffer(chunk)
+		if base64urlencode(block) != mac {
+			d.m.debugf("%s: chunk %d of partial file is corrupt", d.src.GetName(), id)
+			delete(state.Chunks, id)
+			continue
+		}
+		d.mutex.Lock()
+		d.chunk_macs[id] = block
+		d.mutex.Unlock()
+	}
+	return nil
+}
+
+// chunkDone records that chunk id has been written to outfile,
+// saving the state every downloadStateInterval
+func (state *downloadState) chunkDone(outfile *os.File, d *Download, id int) error {
+	d.mutex.Lock()
+	mac := d.chunk_macs[id]
+	d.mutex.Unlock()
+
+	state.mu.Lock()
+	state.Chunks[id] = base64urlencode(mac)
+	due := time.Since(state.lastSave) >= downloadStateInterval
+	state.mu.Unlock()
+	if !due {
+		return nil
+	}
+	return state.save(outfile)
+}
+
+// save syncs outfile then writes the state file, so the state never
+// records chunks which aren't on disk
+func (state *downloadState) save(outfile *os.File) error {
+	state.saveMu.Lock()
+	defer state.saveMu.Unlock()
+	err := outfile.Sync()
+	if err != nil {
+		return err
+	}
+	state.mu.Lock()
+	buf, err := json.Marshal(state)
+	state.lastSave = time.Now()
+	state.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := state.path + ".tmp"
+	err = os.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, state.path)
+}
+
+// remove deletes the state file
+func (state *downloadState) remove() error {
+	err := os.Remove(state.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package mega
+
+import (
+	"context"
+	mrand "math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy decides whether a failed API request or chunk transfer
+// is retried and how long to wait before retrying.
+//
+// Retry is called after each failed attempt with the number of
+// attempts made so far, the time since the first attempt started and
+// the error from the attempt. The policy is shared by all the
+// requests made by a Mega so it must be safe for concurrent use.
+type RetryPolicy interface {
+	Retry(attempts int, elapsed time.Duration, err *MegaError) (retry bool, wait time.Duration)
+}
+
+// BackoffPolicy is a RetryPolicy which retries transient errors (see
+// MegaError.Retryable) using truncated exponential backoff.
+//
+// This is the default policy, with MaxRetries set by SetRetries.
+type BackoffPolicy struct {
+	// MaxRetries is the number of retries after the first attempt
+	MaxRetries int
+	// MinSleep is the wait before the first retry
+	MinSleep time.Duration
+	// MaxSleep is the longest wait between retries
+	MaxSleep time.Duration
+	// Jitter randomizes each wait by up to this fraction of it, eg
+	// 0.2 for ±20%
+	Jitter float64
+	// MaxElapsed is the total time budget. No retry is made which
+	// would start later than this after the first attempt. 0 is
+	// unlimited.
+	MaxElapsed time.Duration
+}
+
+// Retry implements RetryPolicy
+func (p *BackoffPolicy) Retry(attempts int, elapsed time.Duration, err *MegaError) (retry bool, wait time.Duration) {
+	if !err.Retryable || attempts > p.MaxRetries {
+		return false, 0
+	}
+	wait = p.MinSleep
+	// A hashcash challenge has been solved so retry straight away
+	if err.Status != http.StatusPaymentRequired {
+		for i := 1; i < attempts && wait < p.MaxSleep; i++ {
+			wait *= 2
+		}
+	}
+	wait = min(wait, p.MaxSleep)
+	if p.Jitter > 0 {
+		wait += time.Duration((mrand.Float64()*2 - 1) * p.Jitter * float64(wait))
+	}
+	if p.MaxElapsed > 0 && elapsed+wait > p.MaxElapsed {
+		return false, 0
+	}
+	return true, wait
+}
+
+// SetRetryPolicy sets the policy for retrying API requests and chunk
+// transfers. Use nil to restore the default BackoffPolicy.
+func (c *config) SetRetryPolicy(p RetryPolicy) {
+	c.retryPolicy = p
+}
+
+// getRetryPolicy returns the retry policy in use
+func (c *config) getRetryPolicy() RetryPolicy {
+	if c.retryPolicy != nil {
+		return c.retryPolicy
+	}
+	return &BackoffPolicy{
+		MaxRetries: c.retries,
+		MinSleep:   minSleepTime,
+		MaxSleep:   maxSleepTime,
+	}
+}
+
+// sleepContext sleeps for d returning early with the context error if
+// ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryNotify is called before each retry with the number of attempts
+// made so far and the error from the last one
+type retryNotify func(attempts int, err *MegaError)
+
+// retryLoop calls attempt until it succeeds or the retry policy gives
+// up, waiting between attempts as the policy says. what is used in
+// the debug messages, and notify, if not nil, is called before each
+// retry.
+//
+// The returned error is either the *MegaError from the last attempt,
+// with Attempts set, or a context error.
+func (m *Mega) retryLoop(ctx context.Context, what string, notify retryNotify, attempt func() *MegaError) error {
+	policy := m.getRetryPolicy()
+	start := time.Now()
+	for attempts := 1; ; attempts++ {
+		merr := attempt()
+		if merr == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		merr.Attempts = attempts
+		retry, wait := policy.Retry(attempts, time.Since(start), merr)
+		if !retry {
+			return merr
+		}
+		m.debugf("%s: retry %d in %v: %v", what, attempts, wait, merr)
+		if notify != nil {
+			notify(attempts, merr)
+		}
+		err := sleepContext(ctx, wait)
+		if err != nil {
+			return err
+		}
+	}
+}
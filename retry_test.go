@@ -0,0 +1,63 @@
+package mega
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffPolicy(t *testing.T) {
+	p := &BackoffPolicy{
+		MaxRetries: 5,
+		MinSleep:   10 * time.Millisecond,
+		MaxSleep:   50 * time.Millisecond,
+	}
+	transient := &MegaError{Code: -4, Err: ERATELIMIT, Retryable: true}
+	for _, test := range []struct {
+		attempts int
+		retry    bool
+		wait     time.Duration
+	}{
+		{1, true, 10 * time.Millisecond},
+		{2, true, 20 * time.Millisecond},
+		{3, true, 40 * time.Millisecond},
+		{4, true, 50 * time.Millisecond},
+		{5, true, 50 * time.Millisecond},
+		{6, false, 0},
+	} {
+		retry, wait := p.Retry(test.attempts, 0, transient)
+		if retry != test.retry || wait != test.wait {
+			t.Errorf("attempt %d: want (%v, %v), got (%v, %v)", test.attempts, test.retry, test.wait, retry, wait)
+		}
+	}
+
+	// Permanent errors aren't retried
+	if retry, _ := p.Retry(1, 0, &MegaError{Code: -9, Err: ENOENT}); retry {
+		t.Error("Expected no retry for ENOENT")
+	}
+
+	// Too many IPs on an upload URL won't clear by retrying it
+	if retry, _ := p.Retry(1, 0, newAPIError(-6)); retry {
+		t.Error("Expected no retry for ETOOMANY")
+	}
+
+	// Retry straight away after a hashcash challenge
+	if _, wait := p.Retry(4, 0, &MegaError{Status: 402, Retryable: true}); wait != p.MinSleep {
+		t.Errorf("Expected minimum wait after hashcash, got %v", wait)
+	}
+
+	// Give up when the time budget would be exceeded
+	p.MaxElapsed = 100 * time.Millisecond
+	if retry, _ := p.Retry(3, 70*time.Millisecond, transient); retry {
+		t.Error("Expected no retry past MaxElapsed")
+	}
+
+	// Jitter stays within bounds
+	p.MaxElapsed = 0
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		_, wait := p.Retry(2, 0, transient)
+		if wait < 10*time.Millisecond || wait > 30*time.Millisecond {
+			t.Fatalf("Jittered wait %v out of range", wait)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package mega
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+)
+
+// Default spool settings for uploads of unknown size
+const (
+	SPOOL_MEMORY = 16 * 1024 * 1024 // spooled in memory up to this size
+)
+
+// SetSpoolMemory sets how much of an upload of unknown size is held in
+// memory. Anything larger is spooled to a temporary file.
+func (c *config) SetSpoolMemory(n int64) error {
+	if n < 0 {
+		return EARGS
+	}
+	c.spoolMemory = n
+	return nil
+}
+
+// SetSpoolDir sets the directory for the temporary files of uploads
+// of unknown size. The default is os.TempDir().
+func (c *config) SetSpoolDir(dir string) {
+	c.spoolDir = dir
+}
+
+// SetSpoolLimit sets the largest upload of unknown size which can be
+// spooled. 0 is unlimited.
+func (c *config) SetSpoolLimit(n int64) error {
+	if n < 0 {
+		return EARGS
+	}
+	c.spoolLimit = n
+	return nil
+}
+
+// contextReader is an io.Reader which fails once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read implements io.Reader
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// spool holds the whole of an upload of unknown size
+type spool struct {
+	io.ReaderAt
+	size int64
+	file *os.File // set if spooled to a file
+}
+
+// Size returns the size of the data spooled
+func (sp *spool) Size() int64 {
+	return sp.size
+}
+
+// Close removes the temporary file, if any
+func (sp *spool) Close() error {
+	if sp.file == nil {
+		return nil
+	}
+	err := sp.file.Close()
+	removeErr := os.Remove(sp.file.Name())
+	if err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// spool reads r to the end, in memory if it fits within the spool
+// memory limit and otherwise into a temporary file.
+func (m *Mega) spool(ctx context.Context, r io.Reader) (sp *spool, err error) {
+	r = &contextReader{ctx: ctx, r: r}
+	limit := m.spoolLimit
+	if limit == 0 {
+		limit = -1 // unlimited
+	}
+	tooBig := func(size int64) bool {
+		return limit >= 0 && size > limit
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, m.spoolMemory+1)
+	if err == io.EOF {
+		if tooBig(n) {
+			return nil, ESPOOL_LIMIT_EXCEEDED
+		}
+		return &spool{ReaderAt: bytes.NewReader(buf.Bytes()), size: n}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(m.spoolDir, "gomega-spool-")
+	if err != nil {
+		return nil, err
+	}
+	fileSpool := &spool{ReaderAt: file, file: file}
+	defer func() {
+		if err != nil {
+			_ = fileSpool.Close()
+		}
+	}()
+	n, err = io.Copy(file, &buf)
+	if err != nil {
+		return nil, err
+	}
+	var rest io.Reader = r
+	if limit >= 0 {
+		// read one more than the limit to detect going over it
+		rest = io.LimitReader(r, limit-n+1)
+	}
+	copied, err := io.Copy(file, rest)
+	if err != nil {
+		return nil, err
+	}
+	fileSpool.size = n + copied
+	if tooBig(fileSpool.size) {
+		return nil, ESPOOL_LIMIT_EXCEEDED
+	}
+	return fileSpool, nil
+}
@@ -0,0 +1,66 @@
+package mega
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	data := make([]byte, 1000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name   string
+		memory int64
+		limit  int64
+		file   bool
+		err    error
+	}{
+		{"memory", 1000, 0, false, nil},
+		{"file", 999, 0, true, nil},
+		{"empty memory", 0, 0, true, nil},
+		{"memory over limit", 1000, 999, false, ESPOOL_LIMIT_EXCEEDED},
+		{"file at limit", 10, 1000, true, nil},
+		{"file over limit", 10, 999, true, ESPOOL_LIMIT_EXCEEDED},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := NewWithOptions(WithSpoolMemory(test.memory), WithSpoolLimit(test.limit), WithSpoolDir(dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sp, err := m.spool(context.Background(), bytes.NewReader(data))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Expected %v, got %v", test.err, err)
+			}
+			defer func() {
+				// no temporary files are left behind
+				if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+					t.Errorf("%d files left in spool dir", len(entries))
+				}
+			}()
+			if err != nil {
+				return
+			}
+			if (sp.file != nil) != test.file {
+				t.Errorf("Expected spooled to file %v", test.file)
+			}
+			got := make([]byte, sp.Size())
+			if _, err := sp.ReadAt(got, 0); err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("Spooled data mismatch")
+			}
+			if err := sp.Close(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package mega
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer receives a callback after each operation the client makes
+// with the server, for exporting metrics and trace spans.
+//
+// The callbacks are made from the goroutine doing the work so they
+// should return quickly. They may be called concurrently. Embed
+// NopTracer to implement only some of them.
+type Tracer interface {
+	// APIAttempt is called after each attempt at an API request,
+	// so a request which is retried is reported more than once
+	APIAttempt(ctx context.Context, info *APIAttemptInfo)
+	// ChunkTransfer is called after each chunk download or upload,
+	// including all its attempts
+	ChunkTransfer(ctx context.Context, info *ChunkTransferInfo)
+	// Hashcash is called after each hashcash challenge is solved or
+	// fails to be solved
+	Hashcash(ctx context.Context, info *HashcashInfo)
+	// PollEvents is called after each fetch of the server events
+	PollEvents(ctx context.Context, info *PollEventsInfo)
+}
+
+// APIAttemptInfo describes an attempt at an API request
+type APIAttemptInfo struct {
+	// Cmd is the names of the commands in the request, joined by ","
+	Cmd string
+	// Attempt is 1 for the first attempt, 2 for the first retry etc
+	Attempt int
+	// Start is when the attempt started
+	Start time.Time
+	// Duration is how long the attempt took
+	Duration time.Duration
+	// Status is the HTTP status, 0 if no response was received
+	Status int
+	// RequestBytes is the size of the request body
+	RequestBytes int
+	// ResponseBytes is the size of the response body
+	ResponseBytes int
+	// Err is the error from the attempt, nil on success
+	Err error
+}
+
+// ChunkTransferInfo describes the transfer of a chunk of a file
+type ChunkTransferInfo struct {
+	// Upload is true for an upload and false for a download
+	Upload bool
+	// Name is the name of the file
+	Name string
+	// Chunk is the chunk number
+	Chunk int
+	// Offset is the position of the chunk in the file
+	Offset int64
+	// Bytes is the size of the chunk
+	Bytes int
+	// Attempts is the number of HTTP requests made
+	Attempts int
+	// Start is when the transfer started
+	Start time.Time
+	// Duration is how long the transfer took including retries
+	Duration time.Duration
+	// Err is the error from the transfer, nil on success
+	Err error
+}
+
+// HashcashInfo describes the solving of a hashcash challenge
+type HashcashInfo struct {
+	// Easiness is the difficulty sent by the server
+	Easiness int
+	// Attempts is the number of prefixes tried, if known
+	Attempts int64
+	// Start is when solving started
+	Start time.Time
+	// Duration is how long solving took
+	Duration time.Duration
+	// Err is the error from the solver, nil on success
+	Err error
+}
+
+// PollEventsInfo describes one fetch of the server events
+type PollEventsInfo struct {
+	// Events is the number of events received
+	Events int
+	// Start is when the fetch started
+	Start time.Time
+	// Duration is how long the fetch took including playing the
+	// events. This includes waiting for the server to have events.
+	Duration time.Duration
+	// Err is the error from the fetch, nil on success
+	Err error
+}
+
+// NopTracer is a Tracer which does nothing
+type NopTracer struct{}
+
+// APIAttempt implements Tracer
+func (NopTracer) APIAttempt(ctx context.Context, info *APIAttemptInfo) {}
+
+// ChunkTransfer implements Tracer
+func (NopTracer) ChunkTransfer(ctx context.Context, info *ChunkTransferInfo) {}
+
+// Hashcash implements Tracer
+func (NopTracer) Hashcash(ctx context.Context, info *HashcashInfo) {}
+
+// PollEvents implements Tracer
+func (NopTracer) PollEvents(ctx context.Context, info *PollEventsInfo) {}
+
+// SetTracer sets the Tracer to receive callbacks about the operations
+// made. Use nil to remove it.
+func (c *config) SetTracer(t Tracer) {
+	c.tracer = t
+}
+
+// getTracer returns the Tracer in use
+func (c *config) getTracer() Tracer {
+	if c.tracer != nil {
+		return c.tracer
+	}
+	return NopTracer{}
+}
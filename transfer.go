@@ -0,0 +1,807 @@
+package mega
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TransferStatus is the state of a Transfer
+type TransferStatus int
+
+const (
+	TransferQueued    TransferStatus = iota // waiting for a worker
+	TransferRunning                         // being worked on
+	TransferPaused                          // paused by Pause
+	TransferDone                            // finished successfully
+	TransferFailed                          // finished with an error
+	TransferCancelled                       // cancelled by Cancel
+)
+
+// String returns the name of the status
+func (s TransferStatus) String() string {
+	switch s {
+	case TransferQueued:
+		return "queued"
+	case TransferRunning:
+		return "running"
+	case TransferPaused:
+		return "paused"
+	case TransferDone:
+		return "done"
+	case TransferFailed:
+		return "failed"
+	case TransferCancelled:
+		return "cancelled"
+	}
+	return fmt.Sprintf("TransferStatus(%d)", int(s))
+}
+
+// Finished returns whether the transfer has ended, successfully or not
+func (s TransferStatus) Finished() bool {
+	return s >= TransferDone
+}
+
+// TransferState is a snapshot of a Transfer
+type TransferState struct {
+	// ID identifies the transfer, the same as TransferProgress.ID
+	ID uint64
+	// Name is the name of the file
+	Name string
+	// Upload is true for an upload and false for a download
+	Upload bool
+	// Status is the state of the transfer
+	Status TransferStatus
+	// Priority is the priority of the transfer
+	Priority int
+	// Total is the size of the file
+	Total int64
+	// Done is the number of bytes transferred
+	Done int64
+	// Chunks is the number of chunks, 0 until the transfer starts
+	Chunks int
+	// ChunksDone is the number of chunks transferred
+	ChunksDone int
+	// Start is when the transfer started, zero until it does
+	Start time.Time
+	// Rate is the average bytes per second since the start
+	Rate float64
+	// ETA is the estimated time until the transfer finishes, 0 if
+	// unknown
+	ETA time.Duration
+	// Err is the error which ended the transfer
+	Err error
+}
+
+// transferWork does the work of a Transfer. The methods are never
+// called concurrently except for chunk.
+type transferWork interface {
+	// open starts the transfer, returning the number of chunks
+	open(ctx context.Context) (chunks int, err error)
+	// chunkSize returns the size of chunk id
+	chunkSize(id int) int
+	// chunk transfers chunk id, calling notify, if not nil, before
+	// each retry
+	chunk(ctx context.Context, id int, notify retryNotify) error
+	// finish completes the transfer once all the chunks are done
+	finish(ctx context.Context) error
+	// abort releases the resources of a transfer which didn't finish
+	abort()
+}
+
+// TransferManager runs many downloads and uploads with a fixed number
+// of workers shared between them, so the number of connections and
+// the memory used stay the same however many transfers are queued.
+//
+// Each worker transfers one chunk at a time, taken from the transfer
+// with the highest priority which has work to do. Transfers of the
+// same priority are served in the order they were added.
+type TransferManager struct {
+	m         *Mega
+	maxMemory int64
+	wg        sync.WaitGroup
+	mu        sync.Mutex // to protect the following
+	cond      *sync.Cond
+	transfers []*Transfer // not yet finished, in the order added
+	memory    int64       // size of the chunks in flight
+	paused    bool
+	closed    bool
+}
+
+// NewTransferManager returns a TransferManager transferring up to
+// workers chunks at once with up to maxMemory bytes of chunks in
+// flight. A maxMemory of 0 is unlimited.
+//
+// Call Close when finished with it.
+func (m *Mega) NewTransferManager(workers int, maxMemory int64) (*TransferManager, error) {
+	if workers < 1 || maxMemory < 0 {
+		return nil, EARGS
+	}
+	if workers > MAX_DOWNLOAD_WORKERS {
+		return nil, EWORKER_LIMIT_EXCEEDED
+	}
+	tm := &TransferManager{
+		m:         m,
+		maxMemory: maxMemory,
+	}
+	tm.cond = sync.NewCond(&tm.mu)
+	for w := 0; w < workers; w++ {
+		tm.wg.Add(1)
+		go tm.worker()
+	}
+	return tm, nil
+}
+
+// Transfer is a download or upload run by a TransferManager
+type Transfer struct {
+	tm       *TransferManager
+	id       uint64
+	name     string
+	upload   bool
+	total    int64
+	work     transferWork
+	tracker  *progressTracker
+	ctx      context.Context // cancelled when the transfer ends
+	cancel   context.CancelCauseFunc
+	stop     func() bool   // stops watching the caller's context
+	finished chan struct{} // closed when the transfer has ended and cleaned up
+
+	// protected by tm.mu
+	status     TransferStatus
+	priority   int
+	runCtx     context.Context // cancelled by Pause
+	runCancel  context.CancelCauseFunc
+	opening    bool
+	opened     bool
+	finishing  bool
+	released   bool
+	pending    []int // chunks still to be done, in order
+	chunks     int
+	chunksDone int
+	inFlight   int
+	done       int64
+	start      time.Time
+	err        error
+}
+
+// errTransferPaused is the cause of the run context of a paused
+// transfer
+var errTransferPaused = errors.New("transfer paused")
+
+// add queues a transfer doing work
+func (tm *TransferManager) add(ctx context.Context, work transferWork, name string, upload bool, total int64, priority int) (*Transfer, error) {
+	t := &Transfer{
+		tm:       tm,
+		id:       transferIDs.Add(1),
+		name:     name,
+		upload:   upload,
+		total:    total,
+		work:     work,
+		finished: make(chan struct{}),
+		status:   TransferQueued,
+		priority: priority,
+	}
+	t.tracker = tm.m.newProgressTracker(nil, nil, name, upload)
+	if t.tracker != nil {
+		// so the ids match
+		t.tracker.info.ID = t.id
+	}
+	t.ctx, t.cancel = context.WithCancelCause(ctx)
+	t.runCtx, t.runCancel = context.WithCancelCause(t.ctx)
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.closed {
+		t.cancel(nil)
+		return nil, fs.ErrClosed
+	}
+	tm.transfers = append(tm.transfers, t)
+	t.stop = context.AfterFunc(ctx, func() {
+		t.end(TransferFailed, context.Cause(ctx))
+	})
+	tm.cond.Broadcast()
+	return t, nil
+}
+
+// Download queues the download of src to dstpath. The file is written
+// to a temporary file which is renamed to dstpath once the MAC has
+// been checked, replacing any existing file.
+//
+// The transfer fails if ctx is cancelled. The progress is reported to
+// the Progress set with SetProgress.
+func (tm *TransferManager) Download(ctx context.Context, src *Node, dstpath string, priority int) (*Transfer, error) {
+	if src == nil || src.GetType() != FILE {
+		return nil, EARGS
+	}
+	work := &downloadWork{m: tm.m, src: src, dstpath: dstpath}
+	return tm.add(ctx, work, src.GetName(), false, src.GetSize(), priority)
+}
+
+// Upload queues the upload of the file srcpath to parent as name, or
+// as the base name of srcpath if name is empty.
+//
+// The transfer fails if ctx is cancelled. The progress is reported to
+// the Progress set with SetProgress.
+func (tm *TransferManager) Upload(ctx context.Context, srcpath string, parent *Node, name string, priority int) (*Transfer, error) {
+	if parent == nil {
+		return nil, EARGS
+	}
+	info, err := os.Stat(srcpath)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = filepath.Base(srcpath)
+	}
+	work := &uploadWork{m: tm.m, srcpath: srcpath, parent: parent, name: name, size: info.Size(), mtime: info.ModTime()}
+	return tm.add(ctx, work, name, true, info.Size(), priority)
+}
+
+// Transfers returns the state of the transfers which haven't finished
+// in the order they were added
+func (tm *TransferManager) Transfers() []TransferState {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	states := make([]TransferState, 0, len(tm.transfers))
+	for _, t := range tm.transfers {
+		states = append(states, t.stateLocked())
+	}
+	return states
+}
+
+// Pause stops the workers starting any more work until Resume is
+// called. Work already started carries on. Transfers can be queued and
+// paused while the manager is paused.
+func (tm *TransferManager) Pause() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.paused = true
+}
+
+// Resume lets the workers start work again after Pause
+func (tm *TransferManager) Resume() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.paused = false
+	tm.cond.Broadcast()
+}
+
+// Close cancels the transfers which haven't finished and waits for the
+// workers to stop. Transfers can't be added afterwards.
+func (tm *TransferManager) Close() error {
+	tm.mu.Lock()
+	tm.closed = true
+	transfers := append([]*Transfer(nil), tm.transfers...)
+	tm.cond.Broadcast()
+	tm.mu.Unlock()
+	for _, t := range transfers {
+		t.end(TransferCancelled, ETRANSFER_CANCELLED)
+	}
+	tm.wg.Wait()
+	return nil
+}
+
+// transferJob is the kind of work given to a worker
+type transferJob int
+
+const (
+	jobOpen transferJob = iota
+	jobChunk
+	jobFinish
+)
+
+// next claims the next job, returning a nil transfer if there is none
+//
+// Call with tm.mu held
+func (tm *TransferManager) next() (t *Transfer, job transferJob, id int) {
+	if tm.paused {
+		return nil, 0, 0
+	}
+	for _, c := range tm.transfers {
+		if !c.hasWorkLocked() {
+			continue
+		}
+		if t == nil || c.priority > t.priority {
+			t = c
+		}
+	}
+	if t == nil {
+		return nil, 0, 0
+	}
+	switch {
+	case !t.opened:
+		t.opening = true
+		job = jobOpen
+	case len(t.pending) > 0:
+		id = t.pending[0]
+		size := int64(t.work.chunkSize(id))
+		if tm.maxMemory > 0 && tm.memory > 0 && tm.memory+size > tm.maxMemory {
+			// wait for memory rather than let lower priorities
+			// take it
+			return nil, 0, 0
+		}
+		tm.memory += size
+		t.pending = t.pending[1:]
+		t.inFlight++
+		job = jobChunk
+	default:
+		t.finishing = true
+		t.inFlight++
+		job = jobFinish
+	}
+	t.status = TransferRunning
+	return t, job, id
+}
+
+// worker runs jobs until the manager is closed
+func (tm *TransferManager) worker() {
+	defer tm.wg.Done()
+	for {
+		tm.mu.Lock()
+		var t *Transfer
+		var job transferJob
+		var id int
+		for {
+			if tm.closed {
+				tm.mu.Unlock()
+				return
+			}
+			t, job, id = tm.next()
+			if t != nil {
+				break
+			}
+			tm.cond.Wait()
+		}
+		runCtx := t.runCtx
+		tm.mu.Unlock()
+
+		switch job {
+		case jobOpen:
+			t.doOpen()
+		case jobChunk:
+			t.doChunk(runCtx, id)
+		case jobFinish:
+			t.doFinish()
+		}
+	}
+}
+
+// hasWorkLocked returns whether a worker could work on t now
+//
+// Call with tm.mu held
+func (t *Transfer) hasWorkLocked() bool {
+	switch {
+	case t.status == TransferPaused || t.status.Finished():
+		return false
+	case !t.opened:
+		return !t.opening
+	case len(t.pending) > 0:
+		return true
+	}
+	return t.chunksDone == t.chunks && t.inFlight == 0 && !t.finishing
+}
+
+// doOpen starts the transfer
+func (t *Transfer) doOpen() {
+	chunks, err := t.work.open(t.ctx)
+	tm := t.tm
+	tm.mu.Lock()
+	t.opening = false
+	if err != nil {
+		t.endLocked(TransferFailed, err)
+	} else {
+		t.opened = true
+		t.chunks = chunks
+		t.pending = make([]int, chunks)
+		for id := range t.pending {
+			t.pending[id] = id
+		}
+		t.start = time.Now()
+	}
+	release := t.settleLocked()
+	tm.cond.Broadcast()
+	tm.mu.Unlock()
+
+	if err == nil {
+		t.tracker.start(t.total, 0)
+	}
+	if release {
+		t.release()
+	}
+}
+
+// doChunk transfers chunk id
+func (t *Transfer) doChunk(runCtx context.Context, id int) {
+	size := t.work.chunkSize(id)
+	err := t.work.chunk(runCtx, id, t.tracker.chunkRetry(id, size))
+	tm := t.tm
+	tm.mu.Lock()
+	t.inFlight--
+	tm.memory -= int64(size)
+	switch {
+	case err == nil:
+		t.chunksDone++
+		t.done += int64(size)
+	case t.status.Finished():
+	case errors.Is(context.Cause(runCtx), errTransferPaused):
+		// do it again when resumed
+		t.pending = append([]int{id}, t.pending...)
+	default:
+		t.endLocked(TransferFailed, err)
+	}
+	release := t.settleLocked()
+	tm.cond.Broadcast()
+	tm.mu.Unlock()
+
+	if err == nil {
+		t.tracker.chunkDone(id, size)
+	}
+	if release {
+		t.release()
+	}
+}
+
+// doFinish completes the transfer
+func (t *Transfer) doFinish() {
+	err := t.work.finish(t.ctx)
+	tm := t.tm
+	tm.mu.Lock()
+	t.inFlight--
+	if err != nil {
+		t.endLocked(TransferFailed, err)
+	} else {
+		t.endLocked(TransferDone, nil)
+	}
+	release := t.settleLocked()
+	tm.cond.Broadcast()
+	tm.mu.Unlock()
+
+	if release {
+		t.release()
+	}
+}
+
+// end ends the transfer with status unless it has ended or is
+// finishing already
+func (t *Transfer) end(status TransferStatus, err error) {
+	tm := t.tm
+	tm.mu.Lock()
+	if t.finishing {
+		tm.mu.Unlock()
+		return
+	}
+	t.endLocked(status, err)
+	release := t.settleLocked()
+	tm.cond.Broadcast()
+	tm.mu.Unlock()
+
+	if release {
+		t.release()
+	}
+}
+
+// endLocked ends the transfer with status and err, stopping any chunks
+// in flight, unless it has ended already
+//
+// Call with tm.mu held
+func (t *Transfer) endLocked(status TransferStatus, err error) {
+	if t.status.Finished() {
+		return
+	}
+	t.status = status
+	t.err = err
+	if err == nil {
+		err = context.Canceled
+	}
+	t.cancel(err)
+	for i, c := range t.tm.transfers {
+		if c == t {
+			t.tm.transfers = append(t.tm.transfers[:i], t.tm.transfers[i+1:]...)
+			break
+		}
+	}
+}
+
+// settleLocked returns whether the transfer has ended with no work in
+// progress, in which case the caller must call release
+//
+// Call with tm.mu held
+func (t *Transfer) settleLocked() bool {
+	if !t.status.Finished() || t.inFlight > 0 || t.opening || t.released {
+		return false
+	}
+	t.released = true
+	return true
+}
+
+// release cleans up after the transfer has ended
+func (t *Transfer) release() {
+	if t.status != TransferDone {
+		t.work.abort()
+	}
+	t.stop()
+	t.tracker.done(t.err)
+	close(t.finished)
+}
+
+// ID returns the id of the transfer, the same as TransferProgress.ID
+func (t *Transfer) ID() uint64 {
+	return t.id
+}
+
+// stateLocked returns the state of the transfer
+//
+// Call with tm.mu held
+func (t *Transfer) stateLocked() TransferState {
+	s := TransferState{
+		ID:         t.id,
+		Name:       t.name,
+		Upload:     t.upload,
+		Status:     t.status,
+		Priority:   t.priority,
+		Total:      t.total,
+		Done:       t.done,
+		Chunks:     t.chunks,
+		ChunksDone: t.chunksDone,
+		Start:      t.start,
+		Err:        t.err,
+	}
+	if !t.start.IsZero() {
+		elapsed := time.Since(t.start).Seconds()
+		if elapsed > 0 {
+			s.Rate = float64(t.done) / elapsed
+		}
+		if s.Rate > 0 && !t.status.Finished() {
+			s.ETA = time.Duration(float64(t.total-t.done) / s.Rate * float64(time.Second))
+		}
+	}
+	return s
+}
+
+// State returns a snapshot of the transfer for polling
+func (t *Transfer) State() TransferState {
+	t.tm.mu.Lock()
+	defer t.tm.mu.Unlock()
+	return t.stateLocked()
+}
+
+// SetPriority changes the priority of the transfer. Higher priorities
+// are served first.
+func (t *Transfer) SetPriority(priority int) {
+	t.tm.mu.Lock()
+	defer t.tm.mu.Unlock()
+	t.priority = priority
+	t.tm.cond.Broadcast()
+}
+
+// Pause stops the transfer until Resume is called. Chunks in flight
+// are abandoned and transferred again on resuming. It has no effect on
+// a transfer which has finished or is finishing.
+func (t *Transfer) Pause() {
+	t.tm.mu.Lock()
+	defer t.tm.mu.Unlock()
+	if t.status == TransferPaused || t.status.Finished() || t.finishing {
+		return
+	}
+	t.status = TransferPaused
+	t.runCancel(errTransferPaused)
+}
+
+// Resume queues a paused transfer again
+func (t *Transfer) Resume() {
+	t.tm.mu.Lock()
+	defer t.tm.mu.Unlock()
+	if t.status != TransferPaused {
+		return
+	}
+	t.status = TransferQueued
+	t.runCtx, t.runCancel = context.WithCancelCause(t.ctx)
+	t.tm.cond.Broadcast()
+}
+
+// Cancel stops the transfer and removes any partial file. Wait then
+// returns ETRANSFER_CANCELLED. It has no effect on a transfer which has
+// finished or is finishing.
+func (t *Transfer) Cancel() {
+	t.end(TransferCancelled, ETRANSFER_CANCELLED)
+}
+
+// Wait waits for the transfer to end, returning its error
+func (t *Transfer) Wait() error {
+	<-t.finished
+	return t.err
+}
+
+// Done returns a channel which is closed when the transfer has ended
+func (t *Transfer) Done() <-chan struct{} {
+	return t.finished
+}
+
+// Node returns the node created by an upload once it is done, nil
+// otherwise
+func (t *Transfer) Node() *Node {
+	select {
+	case <-t.finished:
+	default:
+		return nil
+	}
+	if w, ok := t.work.(*uploadWork); ok {
+		return w.node
+	}
+	return nil
+}
+
+// downloadWork is the work of a download to a file
+type downloadWork struct {
+	m       *Mega
+	src     *Node
+	dstpath string
+	d       *Download
+	file    *os.File
+	tmppath string
+}
+
+// open implements transferWork
+func (w *downloadWork) open(ctx context.Context) (int, error) {
+	d, err := w.m.NewDownloadContext(ctx, w.src)
+	if err != nil {
+		return 0, err
+	}
+	dir, base := filepath.Split(w.dstpath)
+	w.file, err = os.CreateTemp(dir, "."+base+downloadTempPattern)
+	if err != nil {
+		return 0, err
+	}
+	w.tmppath = w.file.Name()
+	w.d = d
+	return d.Chunks(), nil
+}
+
+// chunkSize implements transferWork
+func (w *downloadWork) chunkSize(id int) int {
+	_, size, _ := w.d.ChunkLocation(id)
+	return size
+}
+
+// chunk implements transferWork
+func (w *downloadWork) chunk(ctx context.Context, id int, notify retryNotify) error {
+	chk_start, chk_size, err := w.d.ChunkLocation(id)
+	if err != nil {
+		return err
+	}
+	chunk := getBuffer(chk_size)
+	defer putBuffer(chunk)
+	err = w.d.downloadChunkInto(ctx, id, *chunk, notify)
+	if err != nil {
+		return err
+	}
+	_, err = w.file.WriteAt(*chunk, chk_start)
+	return err
+}
+
+// finish implements transferWork
+func (w *downloadWork) finish(ctx context.Context) error {
+	err := w.file.Sync()
+	closeErr := w.file.Close()
+	w.file = nil
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = w.d.Finish()
+	}
+	if err == nil {
+		err = finishDownloadFile(w.tmppath, w.dstpath, w.src, &DownloadFileOptions{})
+	}
+	return err
+}
+
+// abort implements transferWork
+func (w *downloadWork) abort() {
+	if w.file != nil {
+		_ = w.file.Close()
+		w.file = nil
+	}
+	if w.tmppath != "" {
+		_ = os.Remove(w.tmppath)
+	}
+}
+
+// uploadWork is the work of an upload from a file
+type uploadWork struct {
+	m       *Mega
+	srcpath string
+	parent  *Node
+	name    string
+	size    int64
+	mtime   time.Time
+	u       *Upload // nil if the file was copied
+	file    *os.File
+	node    *Node // the node created
+}
+
+// open implements transferWork
+func (w *uploadWork) open(ctx context.Context) (int, error) {
+	file, err := os.Open(w.srcpath)
+	if err != nil {
+		return 0, err
+	}
+	fp, src, err := w.m.fingerprintFile(file, w.size, w.mtime)
+	if err != nil {
+		_ = file.Close()
+		return 0, err
+	}
+	if src != nil {
+		node, err := w.m.CopyContext(ctx, src, w.parent, w.name)
+		// upload it after all if the file has just been deleted
+		if !errors.Is(err, ENOENT) {
+			_ = file.Close()
+			w.node = node
+			return 0, err
+		}
+	}
+	u, err := w.m.NewUploadContext(ctx, w.parent, w.name, w.size)
+	if err != nil {
+		_ = file.Close()
+		return 0, err
+	}
+	u.SetFingerprint(fp)
+	w.file = file
+	w.u = u
+	return u.Chunks(), nil
+}
+
+// chunkSize implements transferWork
+func (w *uploadWork) chunkSize(id int) int {
+	_, size, _ := w.u.ChunkLocation(id)
+	return size
+}
+
+// chunk implements transferWork
+func (w *uploadWork) chunk(ctx context.Context, id int, notify retryNotify) error {
+	chk_start, chk_size, err := w.u.ChunkLocation(id)
+	if err != nil {
+		return err
+	}
+	chunk := getBuffer(chk_size)
+	defer putBuffer(chunk)
+	n, err := w.file.ReadAt(*chunk, chk_start)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n != len(*chunk) {
+		return errors.New("chunk too short")
+	}
+	return w.u.uploadChunk(ctx, id, *chunk, notify)
+}
+
+// finish implements transferWork
+func (w *uploadWork) finish(ctx context.Context) error {
+	if w.u == nil {
+		return nil
+	}
+	node, err := w.u.FinishContext(ctx)
+	closeErr := w.file.Close()
+	w.file = nil
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		w.node = node
+	}
+	return err
+}
+
+// abort implements transferWork
+func (w *uploadWork) abort() {
+	if w.file != nil {
+		_ = w.file.Close()
+		w.file = nil
+	}
+}
@@ -0,0 +1,247 @@
+package mega
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubWork is a transferWork which records the chunks transferred,
+// waiting on gate for each if set after signalling entered
+type stubWork struct {
+	name    string
+	chunks  int
+	size    int
+	gate    chan struct{}
+	entered chan struct{}
+	log     *stubLog
+	aborted bool
+}
+
+// stubLog records the order of the work done by stubWorks
+type stubLog struct {
+	mu     sync.Mutex
+	events []string
+	memory int
+	peak   int
+}
+
+func (l *stubLog) add(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (w *stubWork) open(ctx context.Context) (int, error) {
+	w.log.add(w.name + " open")
+	return w.chunks, nil
+}
+
+func (w *stubWork) chunkSize(id int) int {
+	return w.size
+}
+
+func (w *stubWork) chunk(ctx context.Context, id int, notify retryNotify) error {
+	w.log.mu.Lock()
+	w.log.memory += w.size
+	w.log.peak = max(w.log.peak, w.log.memory)
+	w.log.mu.Unlock()
+	defer func() {
+		w.log.mu.Lock()
+		w.log.memory -= w.size
+		w.log.mu.Unlock()
+	}()
+	if w.entered != nil {
+		w.entered <- struct{}{}
+	}
+	if w.gate != nil {
+		select {
+		case <-w.gate:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	w.log.add(w.name + " chunk")
+	return nil
+}
+
+func (w *stubWork) finish(ctx context.Context) error {
+	w.log.add(w.name + " finish")
+	return nil
+}
+
+func (w *stubWork) abort() {
+	w.aborted = true
+}
+
+func newTestTransferManager(t *testing.T, workers int, maxMemory int64) *TransferManager {
+	tm, err := (&Mega{}).NewTransferManager(workers, maxMemory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = tm.Close()
+	})
+	return tm
+}
+
+func TestTransferManagerPriority(t *testing.T) {
+	tm := newTestTransferManager(t, 1, 0)
+	log := &stubLog{}
+	ctx := context.Background()
+
+	// hold the only worker while the others are queued
+	gate := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	first, err := tm.add(ctx, &stubWork{name: "first", chunks: 1, gate: gate, entered: entered, log: log}, "first", false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+	low, _ := tm.add(ctx, &stubWork{name: "low", chunks: 2, log: log}, "low", false, 0, 0)
+	high, _ := tm.add(ctx, &stubWork{name: "high", chunks: 2, log: log}, "high", false, 0, 5)
+	close(gate)
+
+	for _, tr := range []*Transfer{first, low, high} {
+		if err := tr.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// finishing is a job too so waits for the higher priority
+	want := []string{
+		"first open", "first chunk",
+		"high open", "high chunk", "high chunk", "high finish",
+		"first finish",
+		"low open", "low chunk", "low chunk", "low finish",
+	}
+	if len(log.events) != len(want) {
+		t.Fatalf("Got %v, want %v", log.events, want)
+	}
+	for i := range want {
+		if log.events[i] != want[i] {
+			t.Fatalf("Got %v, want %v", log.events, want)
+		}
+	}
+	if s := low.State(); s.Status != TransferDone || s.ChunksDone != 2 || s.Err != nil {
+		t.Errorf("Wrong state %+v", s)
+	}
+}
+
+func TestTransferManagerMemory(t *testing.T) {
+	tm := newTestTransferManager(t, 8, 3*100)
+	log := &stubLog{}
+	var transfers []*Transfer
+	for i := 0; i < 4; i++ {
+		tr, err := tm.add(context.Background(), &stubWork{name: "t", chunks: 5, size: 100, log: log}, "t", true, 500, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transfers = append(transfers, tr)
+	}
+	for _, tr := range transfers {
+		if err := tr.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if log.peak > 300 {
+		t.Errorf("Memory in flight reached %d, limit 300", log.peak)
+	}
+}
+
+func TestTransferManagerPauseCancel(t *testing.T) {
+	tm := newTestTransferManager(t, 2, 0)
+	log := &stubLog{}
+	ctx := context.Background()
+
+	gate := make(chan struct{})
+	work := &stubWork{name: "paused", chunks: 3, gate: gate, log: log}
+	paused, _ := tm.add(ctx, work, "paused", false, 0, 0)
+	paused.Pause()
+	if s := paused.State(); s.Status != TransferPaused {
+		t.Fatalf("Expected paused, got %v", s.Status)
+	}
+	close(gate)
+
+	// nothing happens while paused
+	time.Sleep(50 * time.Millisecond)
+	if s := paused.State(); s.Status != TransferPaused || s.ChunksDone != 0 {
+		t.Fatalf("Wrong state while paused %+v", s)
+	}
+	if states := tm.Transfers(); len(states) != 1 || states[0].ID != paused.ID() {
+		t.Errorf("Wrong transfers %+v", states)
+	}
+	paused.Resume()
+	if err := paused.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if s := paused.State(); s.Status != TransferDone || s.ChunksDone != 3 {
+		t.Errorf("Wrong state after resume %+v", s)
+	}
+	if work.aborted {
+		t.Error("Finished transfer was aborted")
+	}
+
+	// Cancel stops a transfer in the middle of a chunk
+	work = &stubWork{name: "cancelled", chunks: 3, gate: make(chan struct{}), log: log}
+	cancelled, _ := tm.add(ctx, work, "cancelled", false, 0, 0)
+	cancelled.Cancel()
+	if err := cancelled.Wait(); !errors.Is(err, ETRANSFER_CANCELLED) {
+		t.Errorf("Expected ETRANSFER_CANCELLED, got %v", err)
+	}
+	if s := cancelled.State(); s.Status != TransferCancelled {
+		t.Errorf("Wrong state after cancel %+v", s)
+	}
+	if !work.aborted {
+		t.Error("Cancelled transfer not aborted")
+	}
+
+	// Cancelling the context fails the transfer
+	cctx, cancel := context.WithCancel(ctx)
+	failed, _ := tm.add(cctx, &stubWork{name: "failed", chunks: 3, gate: make(chan struct{}), log: log}, "failed", false, 0, 0)
+	cancel()
+	if err := failed.Wait(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if s := failed.State(); s.Status != TransferFailed {
+		t.Errorf("Wrong state after context cancel %+v", s)
+	}
+
+	// Close cancels what is left
+	left, _ := tm.add(ctx, &stubWork{name: "left", chunks: 1, gate: make(chan struct{}), log: log}, "left", false, 0, 0)
+	_ = tm.Close()
+	if err := left.Wait(); !errors.Is(err, ETRANSFER_CANCELLED) {
+		t.Errorf("Expected ETRANSFER_CANCELLED after Close, got %v", err)
+	}
+	if _, err := tm.add(ctx, &stubWork{log: log}, "late", false, 0, 0); err == nil {
+		t.Error("Expected error adding after Close")
+	}
+}
+
+func TestTransferManagerPause(t *testing.T) {
+	tm := newTestTransferManager(t, 2, 0)
+	log := &stubLog{}
+	ctx := context.Background()
+
+	tm.Pause()
+	tr, err := tm.add(ctx, &stubWork{name: "paused", chunks: 2, log: log}, "paused", false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	log.mu.Lock()
+	events := len(log.events)
+	log.mu.Unlock()
+	if events != 0 || tr.State().Status != TransferQueued {
+		t.Fatalf("Work started while paused: %v, %v", log.events, tr.State().Status)
+	}
+
+	tm.Resume()
+	if err := tr.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if len(log.events) != 4 {
+		t.Errorf("Got %v", log.events)
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"math/big"
 	"net"
 	"net/http"
-	"regexp"
 	"runtime"
 	"strings"
 	"time"
@@ -278,6 +277,55 @@ type chunkSize struct {
 	size     int
 }
 
+// macChunkEnd returns the end of the MAC chunk containing pos. These
+// are the chunks returned by getChunkSizes.
+func macChunkEnd(pos int64) int64 {
+	end := int64(0)
+	for i := int64(1); i <= 8; i++ {
+		end += i * 131072
+		if pos < end {
+			return end
+		}
+	}
+	return end + ((pos-end)/1048576+1)*1048576
+}
+
+// getRequestChunks returns the chunks of a file of size bytes to
+// transfer one per HTTP request. Each is made of whole MAC chunks from
+// getChunkSizes, as many as fit in requestSize but at least one.
+func getRequestChunks(size int64, requestSize int) (chunks []chunkSize) {
+	for _, c := range getChunkSizes(size) {
+		n := len(chunks)
+		if n > 0 && chunks[n-1].size+c.size <= requestSize {
+			chunks[n-1].size += c.size
+			continue
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks
+}
+
+// chunkMACs returns the MACs of the MAC chunks making up data, which
+// is at pos in the file, one after another. pos must be the start of
+// a MAC chunk.
+func chunkMACs(block cipher.Block, iv []byte, pos int64, data []byte) []byte {
+	w := newMACWriter(block, iv, pos)
+	_, _ = w.Write(data)
+	return w.Sum()
+}
+
+// metaMAC folds the chunk MACs from chunkMACs into the MAC of the
+// whole file
+func metaMAC(mac_enc cipher.BlockMode, chunk_macs [][]byte) []byte {
+	mac_data := make([]byte, 16)
+	for _, v := range chunk_macs {
+		for i := 0; i < len(v); i += 16 {
+			mac_enc.CryptBlocks(mac_data, v[i:i+16])
+		}
+	}
+	return mac_data
+}
+
 func getChunkSizes(size int64) (chunks []chunkSize) {
 	p := int64(0)
 	for i := 1; size > 0; i++ {
@@ -297,8 +345,6 @@ func getChunkSizes(size int64) (chunks []chunkSize) {
 	return chunks
 }
 
-var attrMatch = regexp.MustCompile(`{".*"}`)
-
 func decryptAttr(key []byte, data string) (attr FileAttr, err error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -309,21 +355,22 @@ func decryptAttr(key []byte, data string) (attr FileAttr, err error) {
 		return attr, err
 	}
 	mode := cipher.NewCBCDecrypter(block, iv)
-	buf := make([]byte, len(data))
 	ddata, err := base64urldecode(data)
 	if err != nil {
 		return attr, err
 	}
+	if len(ddata) == 0 || len(ddata)%16 != 0 {
+		return attr, EBADATTR
+	}
+	buf := make([]byte, len(ddata))
 	mode.CryptBlocks(buf, ddata)
 
-	if string(buf[:4]) == "MEGA" {
-		str := strings.TrimRight(string(buf[4:]), "\x00")
-		trimmed := attrMatch.FindString(str)
-		if trimmed != "" {
-			str = trimmed
-		}
-		err = json.Unmarshal([]byte(str), &attr)
+	// the wrong key doesn't give the marker
+	if string(buf[:4]) != "MEGA" {
+		return attr, EBADATTR
 	}
+	// the object is followed by null padding
+	err = json.NewDecoder(bytes.NewReader(buf[4:])).Decode(&attr)
 	return attr, err
 }
 
@@ -365,6 +412,21 @@ func randString(l int) (string, error) {
 	return strings.NewReplacer("/", "A", "+", "B").Replace(string(d)), nil
 }
 
+// ctrStream returns the AES-CTR stream for decrypting a file from
+// byte pos. The first 8 bytes of nonce are the file's nonce.
+func ctrStream(block cipher.Block, nonce []byte, pos int64) cipher.Stream {
+	iv := make([]byte, 16)
+	copy(iv, nonce[:8])
+	binary.BigEndian.PutUint64(iv[8:], uint64(pos)/16)
+	stream := cipher.NewCTR(block, iv)
+	if skip := pos % 16; skip != 0 {
+		// discard the key stream before pos in its block
+		var discard [16]byte
+		stream.XORKeyStream(discard[:skip], discard[:skip])
+	}
+	return stream
+}
+
 // halfCPUCores returns half the number of logical CPU cores available.
 // The return value is always at least 1, even if the system reports fewer than 2 cores.
 func halfCPUCores() int {
@@ -1,6 +1,10 @@
 package mega
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"reflect"
 	"testing"
 )
@@ -103,3 +107,75 @@ func TestGetChunkSizes(t *testing.T) {
 		}
 	}
 }
+
+func TestMacChunkEnd(t *testing.T) {
+	const size = 12 * 1024 * 1024
+	for _, c := range getChunkSizes(size) {
+		end := c.position + int64(c.size)
+		for _, pos := range []int64{c.position, c.position + 1, end - 1} {
+			// the last chunk is cut short by the end of the file
+			if got := min(macChunkEnd(pos), size); got != end {
+				t.Errorf("macChunkEnd(%d) = %d, want %d", pos, got, end)
+			}
+		}
+	}
+}
+
+func TestGetRequestChunks(t *testing.T) {
+	const k = 1024
+	for _, size := range []int64{0, 1, 100 * k, 5*1024*k + 17, 20 * 1024 * k} {
+		macChunks := getChunkSizes(size)
+		for _, requestSize := range []int{1, 128 * k, 1000 * k, 2048 * k, 8192 * k} {
+			chunks := getRequestChunks(size, requestSize)
+			// the chunks must cover the file with whole MAC chunks
+			i := 0
+			for _, c := range chunks {
+				if c.size > requestSize && c.size != macChunks[i].size {
+					t.Errorf("size %d request %d: chunk %+v too big", size, requestSize, c)
+				}
+				end := c.position + int64(c.size)
+				for i < len(macChunks) && macChunks[i].position < end {
+					if macChunks[i].position+int64(macChunks[i].size) > end {
+						t.Errorf("size %d request %d: chunk %+v splits a MAC chunk", size, requestSize, c)
+					}
+					i++
+				}
+			}
+			if i != len(macChunks) {
+				t.Errorf("size %d request %d: chunks don't cover the file", size, requestSize)
+			}
+			if requestSize == 1 && !reflect.DeepEqual(chunks, macChunks) {
+				t.Errorf("size %d: expected MAC chunks for request size 1", size)
+			}
+		}
+	}
+}
+
+func TestChunkMACs(t *testing.T) {
+	key := make([]byte, 16)
+	iv := make([]byte, 16)
+	data := make([]byte, 5*1024*1024+17)
+	for _, b := range [][]byte{key, iv, data} {
+		if _, err := rand.Read(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	macOf := func(requestSize int) []byte {
+		var macs [][]byte
+		for _, c := range getRequestChunks(int64(len(data)), requestSize) {
+			mac := chunkMACs(block, iv, c.position, data[c.position:c.position+int64(c.size)])
+			macs = append(macs, mac)
+		}
+		return metaMAC(cipher.NewCBCEncrypter(block, make([]byte, 16)), macs)
+	}
+	want := macOf(1)
+	for _, requestSize := range []int{512 * 1024, 3 * 1024 * 1024, MAX_REQUEST_SIZE} {
+		if got := macOf(requestSize); !bytes.Equal(got, want) {
+			t.Errorf("MAC differs for request size %d", requestSize)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package mega
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// VerifyReport describes the verification of a remote file
+type VerifyReport struct {
+	// Node is the file verified
+	Node *Node
+	// Path is the name of the file, or its path below the folder for
+	// VerifyFolder
+	Path string
+	// Size is the size of the file
+	Size int64
+	// Chunks is the number of chunks read
+	Chunks int
+	// Bytes is the number of bytes read and checked
+	Bytes int64
+	// ExpectedMAC is the MAC of the file stored in its key
+	ExpectedMAC []byte
+	// ComputedMAC is the MAC of the contents read, nil unless every
+	// chunk could be read. Empty files have no MAC to check.
+	ComputedMAC []byte
+	// ChunkErrors lists the chunks which couldn't be read, in order
+	ChunkErrors []ChunkError
+	// Start is when the verification started
+	Start time.Time
+	// Duration is how long it took
+	Duration time.Duration
+	// Err is nil if the file is intact. It is EMACMISMATCH if the
+	// contents don't match the MAC, otherwise the reason the file
+	// couldn't be checked.
+	Err error
+}
+
+// OK returns whether the file was verified as intact
+func (r *VerifyReport) OK() bool {
+	return r.Err == nil
+}
+
+// ChunkError describes a chunk which couldn't be read
+type ChunkError struct {
+	// Chunk is the chunk number
+	Chunk int
+	// Offset is the position of the chunk in the file
+	Offset int64
+	// Size is the size of the chunk
+	Size int
+	// Err is the error reading it
+	Err error
+}
+
+// Verify reads the whole of the file node from the server, checking
+// the MAC of each chunk and of the file, without saving anything. It
+// returns a report of what was checked along with its Err.
+//
+// The chunks are read by as many workers as downloads use. The
+// progress is reported to the Progress set with SetProgress.
+func (m *Mega) Verify(ctx context.Context, node *Node) (*VerifyReport, error) {
+	if node == nil || node.GetType() != FILE {
+		return nil, EARGS
+	}
+	report := m.verify(ctx, node, node.GetName())
+	return report, report.Err
+}
+
+// verify makes the report for Verify
+func (m *Mega) verify(ctx context.Context, node *Node, name string) (report *VerifyReport) {
+	node.fs.mutex.Lock()
+	report = &VerifyReport{
+		Node:        node,
+		Path:        name,
+		Size:        node.size,
+		ExpectedMAC: append([]byte(nil), node.meta.mac...),
+		Start:       time.Now(),
+	}
+	node.fs.mutex.Unlock()
+
+	tracker := m.newProgressTracker(nil, nil, node.GetName(), false)
+	defer func() {
+		report.Duration = time.Since(report.Start)
+		tracker.done(report.Err)
+	}()
+
+	d, err := m.NewDownloadContext(ctx, node)
+	if err != nil {
+		report.Err = err
+		return report
+	}
+	report.Chunks = d.Chunks()
+	tracker.start(report.Size, 0)
+
+	var (
+		mu   sync.Mutex // to protect report.ChunkErrors
+		read atomic.Int64
+		wg   sync.WaitGroup
+	)
+	workch := make(chan int)
+	for w := 0; w < m.dl_workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range workch {
+				chk_start, chk_size, err := d.ChunkLocation(id)
+				if err == nil {
+					chunk := getBuffer(chk_size)
+					err = d.downloadChunkInto(ctx, id, *chunk, tracker.chunkRetry(id, chk_size))
+					putBuffer(chunk)
+				}
+				if err != nil {
+					mu.Lock()
+					report.ChunkErrors = append(report.ChunkErrors, ChunkError{Chunk: id, Offset: chk_start, Size: chk_size, Err: err})
+					mu.Unlock()
+					continue
+				}
+				read.Add(int64(chk_size))
+				tracker.chunkDone(id, chk_size)
+			}
+		}()
+	}
+	for id := 0; id < d.Chunks() && ctx.Err() == nil; id++ {
+		select {
+		case workch <- id:
+		case <-ctx.Done():
+		}
+	}
+	close(workch)
+	wg.Wait()
+
+	report.Bytes = read.Load()
+	sort.Slice(report.ChunkErrors, func(i, j int) bool {
+		return report.ChunkErrors[i].Chunk < report.ChunkErrors[j].Chunk
+	})
+	switch {
+	case ctx.Err() != nil:
+		report.Err = ctx.Err()
+	case len(report.ChunkErrors) > 0:
+		first := report.ChunkErrors[0]
+		report.Err = fmt.Errorf("%d of %d chunks unreadable, first at offset %d: %w", len(report.ChunkErrors), report.Chunks, first.Offset, first.Err)
+	case report.Chunks == 0:
+		// nothing to check
+	default:
+		report.ComputedMAC, report.Err = d.fileMAC()
+		if report.Err == nil && !bytes.Equal(report.ComputedMAC, report.ExpectedMAC) {
+			report.Err = EMACMISMATCH
+		}
+	}
+	return report
+}
+
+// VerifyFolder verifies every file in the tree below folder, up to
+// workers of them at once. The reports are returned sorted by path,
+// with an error summarising any files which aren't intact.
+//
+// If folder is a file just that is verified.
+func (m *Mega) VerifyFolder(ctx context.Context, folder *Node, workers int) ([]*VerifyReport, error) {
+	if folder == nil || workers < 1 {
+		return nil, EARGS
+	}
+
+	type file struct {
+		node *Node
+		path string
+	}
+	var files []file
+	var walk func(n *Node, p string) error
+	walk = func(n *Node, p string) error {
+		if n.GetType() == FILE {
+			files = append(files, file{n, p})
+			return nil
+		}
+		children, err := n.fs.GetChildren(n)
+		if err != nil {
+			return err
+		}
+		for _, c := range children {
+			err = walk(c, path.Join(p, c.GetName()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	root := ""
+	if folder.GetType() == FILE {
+		root = folder.GetName()
+	}
+	err := walk(folder, root)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].path < files[j].path
+	})
+
+	reports := make([]*VerifyReport, len(files))
+	workch := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range workch {
+				reports[i] = m.verify(ctx, files[i].node, files[i].path)
+			}
+		}()
+	}
+	for i := range files {
+		workch <- i
+	}
+	close(workch)
+	wg.Wait()
+
+	var failed int
+	var first *VerifyReport
+	for _, r := range reports {
+		if r.Err != nil {
+			failed++
+			if first == nil {
+				first = r
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return reports, ctx.Err()
+	}
+	if failed > 0 {
+		return reports, fmt.Errorf("%d of %d files failed verification, first %q: %w", failed, len(reports), first.Path, first.Err)
+	}
+	return reports, nil
+}